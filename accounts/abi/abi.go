@@ -17,11 +17,18 @@
 package abi
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
+// revertSelector is the method id of Error(string), which solidity uses to
+// encode the reason of a revert.
+var revertSelector = crypto.Keccak256([]byte("Error(string)"))[:4]
+
 // The ABI holds information about a contract's context and available
 // invokable methods. It will allow you to type check function calls and
 // packs data accordingly.
@@ -137,3 +144,20 @@ func (abi *ABI) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// UnpackRevert decodes the reason of a reverted execution from its return data,
+// which is expected to be the ABI encoding of a call to Error(string).
+func UnpackRevert(data []byte) (string, error) {
+	if len(data) < 4 || !bytes.Equal(data[:4], revertSelector) {
+		return "", errBadRevert
+	}
+	if err := bytesAreProper(data[4:]); err != nil {
+		return "", err
+	}
+	typ, _ := NewType("string")
+	reason, err := toGoType(0, typ, data[4:])
+	if err != nil {
+		return "", err
+	}
+	return reason.(string), nil
+}
@@ -418,3 +418,29 @@ func TestBareEvents(t *testing.T) {
 		}
 	}
 }
+
+func TestUnpackRevert(t *testing.T) {
+	abi, err := JSON(strings.NewReader(`[{ "type" : "function", "name" : "Error", "inputs" : [ { "name" : "reason", "type" : "string" } ] }]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reason := range []string{"", "boom", strings.Repeat("a long revert reason ", 5)} {
+		data, err := abi.Pack("Error", reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := UnpackRevert(data)
+		if err != nil {
+			t.Errorf("reason %q: failed to unpack: %v", reason, err)
+		} else if have != reason {
+			t.Errorf("reason mismatch: have %q, want %q", have, reason)
+		}
+	}
+	// Empty reverts and foreign selectors carry no reason
+	data, _ := abi.Pack("Error", "boom")
+	for _, bad := range [][]byte{nil, data[:3], append([]byte{0xde, 0xad, 0xbe, 0xef}, data[4:]...), data[:40]} {
+		if _, err := UnpackRevert(bad); err == nil {
+			t.Errorf("expected error unpacking %x", bad)
+		}
+	}
+}
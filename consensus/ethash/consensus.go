@@ -526,28 +526,45 @@ var (
 	big32 = big.NewInt(32)
 )
 
-// AccumulateRewards credits the coinbase of the given block with the mining
-// reward. The total reward consists of the static block reward and rewards for
-// included uncles. The coinbase of each uncle block is also rewarded.
-// TODO (karalabe): Move the chain maker into this package and make this private!
-func AccumulateRewards(config *params.ChainConfig, state *state.StateDB, header *types.Header, uncles []*types.Header) {
+// BlockRewards computes the mining rewards of the given block without touching
+// any state: the reward of the block's coinbase, consisting of the static block
+// reward and the rewards for included uncles, and the rewards of the uncles'
+// coinbases (summed up if several uncles share one).
+func BlockRewards(config *params.ChainConfig, header *types.Header, uncles []*types.Header) (blockReward *big.Int, uncleRewards map[common.Address]*big.Int) {
 	// Select the correct block reward based on chain progression
-	blockReward := frontierBlockReward
+	static := frontierBlockReward
 	if config.IsByzantium(header.Number) {
-		blockReward = byzantiumBlockReward
+		static = byzantiumBlockReward
 	}
 	// Accumulate the rewards for the miner and any included uncles
-	reward := new(big.Int).Set(blockReward)
-	r := new(big.Int)
+	blockReward = new(big.Int).Set(static)
+	uncleRewards = make(map[common.Address]*big.Int)
 	for _, uncle := range uncles {
-		r.Add(uncle.Number, big8)
+		r := new(big.Int).Add(uncle.Number, big8)
 		r.Sub(r, header.Number)
-		r.Mul(r, blockReward)
+		r.Mul(r, static)
 		r.Div(r, big8)
-		state.AddBalance(uncle.Coinbase, r)
+		if prev, ok := uncleRewards[uncle.Coinbase]; ok {
+			r.Add(r, prev)
+		}
+		uncleRewards[uncle.Coinbase] = r
+
+		blockReward.Add(blockReward, new(big.Int).Div(static, big32))
+	}
+	return blockReward, uncleRewards
+}
 
-		r.Div(blockReward, big32)
-		reward.Add(reward, r)
+// AccumulateRewards credits the coinbase of the given block with the mining
+// reward. The total reward consists of the static block reward and rewards for
+// included uncles. The coinbase of each uncle block is also rewarded.
+// TODO (karalabe): Move the chain maker into this package and make this private!
+func AccumulateRewards(config *params.ChainConfig, state *state.StateDB, header *types.Header, uncles []*types.Header) {
+	blockReward, uncleRewards := BlockRewards(config, header, uncles)
+	for _, uncle := range uncles {
+		if reward, ok := uncleRewards[uncle.Coinbase]; ok {
+			state.AddBalance(uncle.Coinbase, reward)
+			delete(uncleRewards, uncle.Coinbase)
+		}
 	}
-	state.AddBalance(header.Coinbase, reward)
+	state.AddBalance(header.Coinbase, blockReward)
 }
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/params"
@@ -83,3 +84,51 @@ func TestCalcDifficulty(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the block and uncle rewards are computed according to the reward
+// schedule before and after Byzantium.
+func TestBlockRewards(t *testing.T) {
+	var (
+		ether    = big.NewInt(1e18)
+		coinbase = common.Address{0x01}
+		uncle1   = common.Address{0x02}
+		uncle2   = common.Address{0x03}
+	)
+	eth := func(num, den int64) *big.Int {
+		r := new(big.Int).Mul(ether, big.NewInt(num))
+		return r.Div(r, big.NewInt(den))
+	}
+	tests := []struct {
+		number  int64
+		uncles  []*types.Header
+		block   *big.Int
+		rewards map[common.Address]*big.Int
+	}{
+		// Frontier reward of 5 ether, without and with uncles
+		{100, nil, eth(5, 1), map[common.Address]*big.Int{}},
+		{100, []*types.Header{{Number: big.NewInt(99), Coinbase: uncle1}, {Number: big.NewInt(94), Coinbase: uncle2}}, eth(5*34, 32),
+			map[common.Address]*big.Int{uncle1: eth(5*7, 8), uncle2: eth(5*2, 8)}},
+		// Uncles sharing a coinbase are summed up
+		{4369999, []*types.Header{{Number: big.NewInt(4369998), Coinbase: uncle1}, {Number: big.NewInt(4369997), Coinbase: uncle1}}, eth(5*34, 32),
+			map[common.Address]*big.Int{uncle1: eth(5*13, 8)}},
+		// Byzantium reward of 3 ether
+		{4370000, nil, eth(3, 1), map[common.Address]*big.Int{}},
+		{4370000, []*types.Header{{Number: big.NewInt(4369999), Coinbase: uncle1}}, eth(3*33, 32),
+			map[common.Address]*big.Int{uncle1: eth(3*7, 8)}},
+	}
+	for i, tt := range tests {
+		header := &types.Header{Number: big.NewInt(tt.number), Coinbase: coinbase}
+		block, rewards := BlockRewards(params.MainnetChainConfig, header, tt.uncles)
+		if block.Cmp(tt.block) != 0 {
+			t.Errorf("test %d: block reward mismatch: have %v, want %v", i, block, tt.block)
+		}
+		if len(rewards) != len(tt.rewards) {
+			t.Errorf("test %d: uncle reward count mismatch: have %d, want %d", i, len(rewards), len(tt.rewards))
+		}
+		for addr, want := range tt.rewards {
+			if have := rewards[addr]; have == nil || have.Cmp(want) != 0 {
+				t.Errorf("test %d: uncle %x reward mismatch: have %v, want %v", i, addr, have, want)
+			}
+		}
+	}
+}
@@ -16,7 +16,12 @@
 
 package core
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
 
 var (
 	// ErrKnownBlock is returned when a block to import is already known locally.
@@ -32,4 +37,87 @@ var (
 	// ErrNonceTooHigh is returned if the nonce of a transaction is higher than the
 	// next one expected based on the local chain.
 	ErrNonceTooHigh = errors.New("nonce too high")
+
+	// ErrTipAboveFeeCap is returned if a message's tip cap exceeds its total fee
+	// cap, which would make the tip unpayable.
+	ErrTipAboveFeeCap = errors.New("max priority fee per gas higher than max fee per gas")
+
+	// ErrFeeCapTooLow is returned if a message's fee cap is below the base fee of
+	// the block it's executed in.
+	ErrFeeCapTooLow = errors.New("max fee per gas less than block base fee")
+
+	// ErrMaxInitCodeSizeExceeded is returned if a contract creation transaction
+	// carries an init code larger than the limit introduced by EIP-3860.
+	ErrMaxInitCodeSizeExceeded = errors.New("max initcode size exceeded")
+
+	// ErrGasUintOverflow is returned if the intrinsic gas of a transaction does
+	// not fit into 64 bits.
+	ErrGasUintOverflow = errors.New("gas uint64 overflow")
+
+	// ErrIntrinsicGasOverflow is returned if the intrinsic gas of a set of
+	// transactions does not fit into 64 bits.
+	ErrIntrinsicGasOverflow = errors.New("intrinsic gas overflow")
+
+	// ErrNonceOrdering is returned (wrapped into a NonceOrderingError) if the
+	// transactions of a sender within a block are not strictly increasing and
+	// contiguous starting from the sender's current nonce.
+	ErrNonceOrdering = errors.New("transaction nonce out of order")
+
+	// ErrGasUsedMismatch is returned if the gas used by the transactions of a
+	// block differs from the gas used recorded in its header.
+	ErrGasUsedMismatch = errors.New("invalid gas used")
 )
+
+// TxApplyError is returned if a transaction of a block could not be applied,
+// identifying the transaction along with the cause.
+type TxApplyError struct {
+	Err    error       // Error applying the transaction
+	TxHash common.Hash // Hash of the failed transaction
+	Index  int         // Index of the failed transaction within the block, -1 if unknown
+}
+
+// Error generates a textual representation of the transaction application error.
+func (e *TxApplyError) Error() string {
+	return fmt.Sprintf("could not apply transaction %d [%x]: %v", e.Index, e.TxHash, e.Err)
+}
+
+// Unwrap returns the error the transaction failed with.
+func (e *TxApplyError) Unwrap() error {
+	return e.Err
+}
+
+// NonceOrderingError is returned if a block contains a transaction whose nonce
+// doesn't follow the previous transaction of the same sender.
+type NonceOrderingError struct {
+	Sender   common.Address // Sender of the offending transaction
+	Index    int            // Index of the offending transaction within the block
+	Nonce    uint64         // Nonce of the offending transaction
+	Expected uint64         // Nonce expected based on the state and previous transactions
+}
+
+// Error generates a textual representation of the nonce ordering error.
+func (e *NonceOrderingError) Error() string {
+	return fmt.Sprintf("%v: sender %x, transaction %d: have nonce %d, want %d", ErrNonceOrdering, e.Sender, e.Index, e.Nonce, e.Expected)
+}
+
+// Unwrap returns ErrNonceOrdering, allowing the error to be matched by errors.Is.
+func (e *NonceOrderingError) Unwrap() error {
+	return ErrNonceOrdering
+}
+
+// ProcessInterruptedError is returned if processing a block was cancelled before
+// all of its transactions were applied.
+type ProcessInterruptedError struct {
+	Err       error // Error of the cancelled context
+	Processed int   // Number of transactions applied before the cancellation
+}
+
+// Error generates a textual representation of the interruption.
+func (e *ProcessInterruptedError) Error() string {
+	return fmt.Sprintf("block processing interrupted after %d transactions: %v", e.Processed, e.Err)
+}
+
+// Unwrap returns the error of the cancelled context.
+func (e *ProcessInterruptedError) Unwrap() error {
+	return e.Err
+}
@@ -41,6 +41,41 @@ func (gp *GasPool) SubGas(amount *big.Int) error {
 	return nil
 }
 
+// GasReservation is an amount of gas earmarked from a GasPool. Until it is
+// either committed or released, the reserved gas is not available to others.
+type GasReservation struct {
+	pool    *GasPool
+	amount  *big.Int
+	settled bool
+}
+
+// Reserve earmarks the given amount of gas from the pool, returning an error
+// if not enough gas is available. The reserved gas can't be consumed by other
+// transactions until the reservation is released.
+func (gp *GasPool) Reserve(amount uint64) (*GasReservation, error) {
+	gas := new(big.Int).SetUint64(amount)
+	if err := gp.SubGas(gas); err != nil {
+		return nil, err
+	}
+	return &GasReservation{pool: gp, amount: gas}, nil
+}
+
+// Commit consumes the reserved gas, permanently deducting it from the pool.
+// Settled reservations are left untouched.
+func (r *GasReservation) Commit() {
+	r.settled = true
+}
+
+// Release returns the reserved gas back into the pool. Settled reservations
+// are left untouched.
+func (r *GasReservation) Release() {
+	if r.settled {
+		return
+	}
+	r.settled = true
+	r.pool.AddGas(r.amount)
+}
+
 func (gp *GasPool) String() string {
 	return (*big.Int)(gp).String()
 }
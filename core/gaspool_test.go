@@ -0,0 +1,53 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Tests that reserved gas is unavailable until released, and permanently
+// consumed when committed.
+func TestGasPoolReservation(t *testing.T) {
+	gp := new(GasPool).AddGas(big.NewInt(1000))
+
+	if _, err := gp.Reserve(1001); err != ErrGasLimitReached {
+		t.Fatalf("oversized reservation error mismatch: have %v, want %v", err, ErrGasLimitReached)
+	}
+	committed, err := gp.Reserve(300)
+	if err != nil {
+		t.Fatalf("failed to reserve gas: %v", err)
+	}
+	released, err := gp.Reserve(500)
+	if err != nil {
+		t.Fatalf("failed to reserve gas: %v", err)
+	}
+	if err := gp.SubGas(big.NewInt(201)); err != ErrGasLimitReached {
+		t.Fatalf("reserved gas consumed: have %v, want %v", err, ErrGasLimitReached)
+	}
+	committed.Commit()
+	committed.Release() // no-op after commit
+	if have := (*big.Int)(gp).Uint64(); have != 200 {
+		t.Fatalf("pool gas after commit mismatch: have %d, want %d", have, 200)
+	}
+	released.Release()
+	released.Release() // no-op when already released
+	if have := (*big.Int)(gp).Uint64(); have != 700 {
+		t.Fatalf("pool gas after release mismatch: have %d, want %d", have, 700)
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/misc"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// accessRecorder is a vm.StateDB recording the accounts a transaction accesses
+// through it, used to detect transactions whose speculative execution has been
+// invalidated by the transactions preceding them.
+//
+// Balance credits to the coinbase aren't recorded as accesses, since they are
+// made by every transaction paying fees and commute with each other.
+type accessRecorder struct {
+	*state.StateDB
+
+	coinbase    common.Address
+	coinbaseBal *big.Int // Balance of the coinbase before the transaction
+	credited    bool     // Whether the coinbase was credited
+
+	accessed map[common.Address]struct{} // Accounts read or written
+	written  map[common.Address]struct{} // Accounts written
+}
+
+func newAccessRecorder(statedb *state.StateDB, coinbase common.Address) *accessRecorder {
+	return &accessRecorder{
+		StateDB:     statedb,
+		coinbase:    coinbase,
+		coinbaseBal: statedb.GetBalance(coinbase),
+		accessed:    make(map[common.Address]struct{}),
+		written:     make(map[common.Address]struct{}),
+	}
+}
+
+func (r *accessRecorder) read(addr common.Address) {
+	r.accessed[addr] = struct{}{}
+}
+
+func (r *accessRecorder) write(addr common.Address) {
+	r.accessed[addr] = struct{}{}
+	r.written[addr] = struct{}{}
+}
+
+// conflicts reports whether any of the accounts accessed by the transaction is
+// among the given modified ones.
+func (r *accessRecorder) conflicts(modified map[common.Address]struct{}) bool {
+	for addr := range r.accessed {
+		if _, ok := modified[addr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// modifies adds the accounts modified by the transaction to the given set.
+func (r *accessRecorder) modifies(modified map[common.Address]struct{}) {
+	for addr := range r.written {
+		modified[addr] = struct{}{}
+	}
+	if r.credited {
+		modified[r.coinbase] = struct{}{}
+	}
+}
+
+// merge applies the changes the transaction made to the state it was executed
+// on to the given state, which mustn't have modified any accessed accounts.
+func (r *accessRecorder) merge(statedb *state.StateDB, txhash common.Hash) {
+	written := make([]common.Address, 0, len(r.written))
+	for addr := range r.written {
+		written = append(written, addr)
+	}
+	statedb.CopyAccounts(r.StateDB, written)
+
+	// The coinbase is only copied if the transaction accessed it, otherwise
+	// it's credited with what it has received.
+	if _, ok := r.written[r.coinbase]; !ok && r.credited {
+		statedb.AddBalance(r.coinbase, new(big.Int).Sub(r.StateDB.GetBalance(r.coinbase), r.coinbaseBal))
+	}
+	for _, log := range r.StateDB.GetLogs(txhash) {
+		statedb.AddLog(log)
+	}
+	for hash, preimage := range r.StateDB.Preimages() {
+		statedb.AddPreimage(hash, preimage)
+	}
+}
+
+func (r *accessRecorder) CreateAccount(addr common.Address) {
+	r.write(addr)
+	r.StateDB.CreateAccount(addr)
+}
+
+func (r *accessRecorder) SubBalance(addr common.Address, amount *big.Int) {
+	r.write(addr)
+	r.StateDB.SubBalance(addr, amount)
+}
+
+func (r *accessRecorder) AddBalance(addr common.Address, amount *big.Int) {
+	if addr == r.coinbase {
+		r.credited = true
+	} else {
+		r.write(addr)
+	}
+	r.StateDB.AddBalance(addr, amount)
+}
+
+func (r *accessRecorder) GetBalance(addr common.Address) *big.Int {
+	r.read(addr)
+	return r.StateDB.GetBalance(addr)
+}
+
+func (r *accessRecorder) GetNonce(addr common.Address) uint64 {
+	r.read(addr)
+	return r.StateDB.GetNonce(addr)
+}
+
+func (r *accessRecorder) SetNonce(addr common.Address, nonce uint64) {
+	r.write(addr)
+	r.StateDB.SetNonce(addr, nonce)
+}
+
+func (r *accessRecorder) GetCodeHash(addr common.Address) common.Hash {
+	r.read(addr)
+	return r.StateDB.GetCodeHash(addr)
+}
+
+func (r *accessRecorder) GetCode(addr common.Address) []byte {
+	r.read(addr)
+	return r.StateDB.GetCode(addr)
+}
+
+func (r *accessRecorder) SetCode(addr common.Address, code []byte) {
+	r.write(addr)
+	r.StateDB.SetCode(addr, code)
+}
+
+func (r *accessRecorder) GetCodeSize(addr common.Address) int {
+	r.read(addr)
+	return r.StateDB.GetCodeSize(addr)
+}
+
+func (r *accessRecorder) GetState(addr common.Address, key common.Hash) common.Hash {
+	r.read(addr)
+	return r.StateDB.GetState(addr, key)
+}
+
+func (r *accessRecorder) SetState(addr common.Address, key common.Hash, value common.Hash) {
+	r.write(addr)
+	r.StateDB.SetState(addr, key, value)
+}
+
+func (r *accessRecorder) Suicide(addr common.Address) bool {
+	r.write(addr)
+	return r.StateDB.Suicide(addr)
+}
+
+func (r *accessRecorder) HasSuicided(addr common.Address) bool {
+	r.read(addr)
+	return r.StateDB.HasSuicided(addr)
+}
+
+func (r *accessRecorder) Exist(addr common.Address) bool {
+	r.read(addr)
+	return r.StateDB.Exist(addr)
+}
+
+func (r *accessRecorder) Empty(addr common.Address) bool {
+	r.read(addr)
+	return r.StateDB.Empty(addr)
+}
+
+func (r *accessRecorder) ForEachStorage(addr common.Address, cb func(key, value common.Hash) bool) {
+	r.read(addr)
+	r.StateDB.ForEachStorage(addr, cb)
+}
+
+// txExecution is the outcome of a transaction executed through an access
+// recorder.
+type txExecution struct {
+	msg    types.Message
+	rec    *accessRecorder
+	gas    *big.Int
+	failed bool
+	err    error
+}
+
+// execute applies the block's i'th transaction to the given state, recording
+// the accounts it accesses.
+func (p *StateProcessor) execute(block *types.Block, i int, msg types.Message, statedb *state.StateDB, gp *GasPool, cfg vm.Config) *txExecution {
+	tx := block.Transactions()[i]
+	statedb.Prepare(tx.Hash(), block.Hash(), i)
+
+	context := NewEVMContext(msg, block.Header(), p.bc, nil)
+	rec := newAccessRecorder(statedb, context.Coinbase)
+	_, gas, failed, err := ApplyMessage(vm.NewEVM(context, rec, p.config, cfg), msg, gp)
+
+	return &txExecution{msg: msg, rec: rec, gas: gas, failed: failed, err: err}
+}
+
+// speculate executes all the block's transactions concurrently, each on its own
+// copy of the given state.
+func (p *StateProcessor) speculate(block *types.Block, statedb *state.StateDB, cfg vm.Config, workers int) []*txExecution {
+	var (
+		txs     = block.Transactions()
+		signer  = types.MakeSigner(p.config, block.Number())
+		results = make([]*txExecution, len(txs))
+		tasks   = make(chan int, len(txs))
+		pend    sync.WaitGroup
+	)
+	// Integer pools can't be shared by concurrent interpreters
+	cfg.IntPool = nil
+
+	for i := range txs {
+		tasks <- i
+	}
+	close(tasks)
+
+	for w := 0; w < workers; w++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+			for i := range tasks {
+				msg, err := txs[i].AsMessage(signer)
+				if err != nil {
+					results[i] = &txExecution{err: err}
+					continue
+				}
+				gp := new(GasPool).AddGas(block.GasLimit())
+				results[i] = p.execute(block, i, msg, statedb.Copy(), gp, cfg)
+			}
+		}()
+	}
+	pend.Wait()
+	return results
+}
+
+// ProcessParallel processes the block just like Process, producing the same
+// receipts, logs, gas usage and state, but executes its transactions on the
+// given number of concurrent workers.
+//
+// All transactions are executed speculatively on copies of the state before
+// the block. Their changes are then merged into the state in block order, as
+// long as none of the accounts a transaction accessed was modified by the ones
+// merged before it. Otherwise the transaction is executed again, on the merged
+// state. Independent transactions are thus processed in parallel, dependent
+// ones serially.
+//
+// The workers share the vm configuration, so its tracer (if any) has to be safe
+// for concurrent use. It also traces the speculative executions.
+func (p *StateProcessor) ProcessParallel(block *types.Block, statedb *state.StateDB, cfg vm.Config, workers int) (types.Receipts, []*types.Log, *big.Int, error) {
+	if workers < 2 {
+		return p.Process(block, statedb, cfg)
+	}
+	var (
+		receipts     types.Receipts
+		totalUsedGas = big.NewInt(0)
+		header       = block.Header()
+		allLogs      []*types.Log
+		gp           = new(GasPool).AddGas(block.GasLimit())
+	)
+	// Mutate the the block and state according to any hard-fork specs
+	if p.config.DAOForkSupport && p.config.DAOForkBlock != nil && p.config.DAOForkBlock.Cmp(block.Number()) == 0 {
+		misc.ApplyDAOHardFork(statedb)
+	}
+	// Reject out of order sender nonces before executing anything
+	if err := validateNonceOrdering(types.MakeSigner(p.config, header.Number), statedb, block.Transactions()); err != nil {
+		return nil, nil, nil, err
+	}
+	speculations := p.speculate(block, statedb, cfg, workers)
+
+	// Merge the speculative executions in order, redoing the invalid ones
+	modified := make(map[common.Address]struct{})
+	for i, tx := range block.Transactions() {
+		exec := speculations[i]
+		if exec.err == nil && !exec.rec.conflicts(modified) && gp.SubGas(exec.msg.Gas()) == nil {
+			gp.AddGas(new(big.Int).Sub(exec.msg.Gas(), exec.gas))
+			statedb.Prepare(tx.Hash(), block.Hash(), i)
+			exec.rec.merge(statedb, tx.Hash())
+		} else {
+			if exec.rec == nil {
+				return nil, nil, nil, &TxApplyError{Err: exec.err, TxHash: tx.Hash(), Index: i} // invalid transaction signature
+			}
+			if exec = p.execute(block, i, exec.msg, statedb, gp, cfg); exec.err != nil {
+				return nil, nil, nil, &TxApplyError{Err: exec.err, TxHash: tx.Hash(), Index: i}
+			}
+		}
+		exec.rec.modifies(modified)
+
+		receipt := finaliseTransaction(p.config, statedb, header, tx, exec.msg, exec.gas, exec.failed, totalUsedGas)
+		receipts = append(receipts, receipt)
+		allLogs = append(allLogs, receipt.Logs...)
+	}
+	if err := p.checkGasUsed(header, totalUsedGas); err != nil {
+		return nil, nil, nil, err
+	}
+	// Finalize the block, applying any consensus engine specific extras (e.g. block rewards)
+	p.engine.Finalize(p.bc, header, statedb, block.Transactions(), block.Uncles(), receipts)
+	return receipts, allLogs, totalUsedGas, nil
+}
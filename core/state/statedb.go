@@ -453,7 +453,7 @@ func (self *StateDB) Copy() *StateDB {
 	// Copy all the basic fields, initialize the memory ones
 	state := &StateDB{
 		db:                self.db,
-		trie:              self.trie,
+		trie:              self.db.CopyTrie(self.trie),
 		stateObjects:      make(map[common.Address]*stateObject, len(self.stateObjectsDirty)),
 		stateObjectsDirty: make(map[common.Address]struct{}, len(self.stateObjectsDirty)),
 		refund:            new(big.Int).Set(self.refund),
@@ -476,6 +476,23 @@ func (self *StateDB) Copy() *StateDB {
 	return state
 }
 
+// CopyAccounts overwrites the given accounts with their live versions in src,
+// which is meant to be a Copy of the state a transaction was executed on. The
+// accounts must not have been modified in self since the copy was made. The
+// overwrites aren't journalled, so they can't be reverted.
+func (self *StateDB) CopyAccounts(src *StateDB, addrs []common.Address) {
+	for _, addr := range addrs {
+		obj := src.stateObjects[addr]
+		if obj == nil {
+			continue
+		}
+		self.stateObjects[addr] = obj.deepCopy(self, self.MarkStateObjectDirty)
+		if _, dirty := src.stateObjectsDirty[addr]; dirty {
+			self.stateObjectsDirty[addr] = struct{}{}
+		}
+	}
+}
+
 // Snapshot returns an identifier for the current revision of the state.
 func (self *StateDB) Snapshot() int {
 	id := self.nextRevisionId
@@ -117,6 +117,37 @@ func TestIntermediateLeaks(t *testing.T) {
 	}
 }
 
+// Tests that copies of a state are independent of it, and that the accounts
+// modified in a copy can be merged back into the original.
+func TestCopyAccounts(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	orig, _ := New(common.Hash{}, NewDatabase(db))
+	for i := byte(0); i < 10; i++ {
+		orig.SetBalance(common.Address{i}, big.NewInt(int64(i)))
+		orig.SetState(common.Address{i}, common.Hash{i}, common.Hash{i})
+	}
+	root := orig.IntermediateRoot(false)
+
+	// Modify half of the accounts in a copy and directly in another one
+	modified, direct := orig.Copy(), orig.Copy()
+	var addrs []common.Address
+	for i := byte(0); i < 5; i++ {
+		for _, state := range []*StateDB{modified, direct} {
+			state.AddBalance(common.Address{i}, big.NewInt(100))
+			state.SetState(common.Address{i}, common.Hash{i}, common.Hash{0xff})
+			state.SetCode(common.Address{i}, []byte{i})
+		}
+		addrs = append(addrs, common.Address{i})
+	}
+	if have := orig.IntermediateRoot(false); have != root {
+		t.Fatalf("original state modified by copies: have %x, want %x", have, root)
+	}
+	orig.CopyAccounts(modified, addrs)
+	if have, want := orig.IntermediateRoot(false), direct.IntermediateRoot(false); have != want {
+		t.Errorf("merged state root mismatch: have %x, want %x", have, want)
+	}
+}
+
 func TestSnapshotRandom(t *testing.T) {
 	config := &quick.Config{MaxCount: 1000}
 	err := quick.Check((*snapshotTest).run, config)
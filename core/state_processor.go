@@ -17,7 +17,12 @@
 package core
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math/big"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
@@ -42,6 +47,8 @@ type StateProcessor struct {
 	bc     *BlockChain         // Canonical block chain
 	// 用于区块奖励的共识引擎
 	engine consensus.Engine    // Consensus engine used for block rewards
+
+	skipGasUsedCheck bool // Whether the gas used recorded in block headers is ignored
 }
 
 // NewStateProcessor initialises a new StateProcessor.
@@ -54,16 +61,99 @@ func NewStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consen
 	}
 }
 
+// SkipGasUsedCheck returns a copy of the processor which doesn't verify that the
+// gas used by the transactions of a block matches the one in its header. It is
+// meant for processing blocks still being built, whose headers don't record the
+// gas used yet.
+func (p *StateProcessor) SkipGasUsedCheck() *StateProcessor {
+	cpy := *p
+	cpy.skipGasUsedCheck = true
+	return &cpy
+}
+
 // Process processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb and applying any rewards to both
 // the processor (coinbase) and any included uncles.
 // Process 根据以太坊规则运行交易信息来对 statedb 进行状态改变，以及奖励挖矿者或者是其他的叔父节点。
 // Process returns the receipts and logs accumulated during the process and
-// returns the amount of gas that was used in the process. If any of the
-// transactions failed to execute due to insufficient gas it will return an error.
+// returns the amount of gas that was used in the process, which equals the
+// cumulative gas used of the last receipt. If any of the transactions failed
+// to execute due to insufficient gas it will return an error, as it does with
+// ErrGasUsedMismatch if the gas used differs from the one in the block header
+// (unless the processor skips the check, see SkipGasUsedCheck).
 // Process 返回执行过程中累计的收据和日志，并返回过程中使用的 Gas。
 // 如果由于 Gas 不足而导致任何交易执行失败，将返回错误。
 func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, *big.Int, error) {
+	return p.process(context.Background(), block, statedb, cfg, nil, nil)
+}
+
+// ProcessCtx processes the block just like Process, but stops once the given
+// context is cancelled, both between transactions and within the execution of
+// one. On cancellation the block isn't finalised and a *ProcessInterruptedError
+// wrapping the context error is returned, the state being left with the
+// changes of the transactions processed before (and possibly part of the one
+// being executed).
+func (p *StateProcessor) ProcessCtx(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, *big.Int, error) {
+	return p.process(ctx, block, statedb, cfg, nil, nil)
+}
+
+// ProcessWithCallback processes the block just like Process, calling onReceipt
+// with the receipt (carrying the logs) of each transaction right after it was
+// applied, in block order. Receipts are streamed before the whole block was
+// processed, so they're only valid if no error is returned in the end.
+func (p *StateProcessor) ProcessWithCallback(block *types.Block, statedb *state.StateDB, cfg vm.Config, onReceipt func(*types.Receipt)) (types.Receipts, []*types.Log, *big.Int, error) {
+	return p.process(context.Background(), block, statedb, cfg, nil, func(tx *types.Transaction, receipt *types.Receipt) {
+		onReceipt(receipt)
+	})
+}
+
+// ProcessWithBloom processes the block just like Process, additionally returning
+// the bloom filter of the block, accumulated from its receipts' blooms as they
+// are created.
+func (p *StateProcessor) ProcessWithBloom(block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, *big.Int, types.Bloom, error) {
+	var bloom types.Bloom
+	receipts, logs, usedGas, err := p.process(context.Background(), block, statedb, cfg, nil, func(tx *types.Transaction, receipt *types.Receipt) {
+		bloom.Or(receipt.Bloom)
+	})
+	if err != nil {
+		return nil, nil, nil, types.Bloom{}, err
+	}
+	return receipts, logs, usedGas, bloom, nil
+}
+
+// TxTrace is the trace of a single transaction of a block.
+type TxTrace struct {
+	TxHash common.Hash // Hash of the traced transaction
+	Tracer vm.Tracer   // Tracer the transaction was traced with, holding its results
+}
+
+// ProcessWithTracer processes the block just like Process, but traces the
+// execution of each of its transactions with a fresh tracer created by
+// newTracer, returning the tracers along with the results. Each trace thus only
+// covers its own transaction.
+func (p *StateProcessor) ProcessWithTracer(block *types.Block, statedb *state.StateDB, cfg vm.Config, newTracer func() vm.Tracer) (types.Receipts, []*types.Log, *big.Int, []TxTrace, error) {
+	var (
+		traces []TxTrace
+		tracer vm.Tracer
+	)
+	trace := func(tx *types.Transaction) vm.Tracer {
+		tracer = newTracer()
+		return tracer
+	}
+	receipts, logs, usedGas, err := p.process(context.Background(), block, statedb, cfg, trace, func(tx *types.Transaction, receipt *types.Receipt) {
+		traces = append(traces, TxTrace{TxHash: tx.Hash(), Tracer: tracer})
+	})
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return receipts, logs, usedGas, traces, nil
+}
+
+// process implements Process and ProcessCtx, debugging each of the block's
+// transactions with the tracer returned by trace (if not nil), and calling
+// applied (if not nil) with each transaction and its receipt after it was
+// applied.
+func (p *StateProcessor) process(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg vm.Config, trace func(tx *types.Transaction) vm.Tracer, applied func(tx *types.Transaction, receipt *types.Receipt)) (types.Receipts, []*types.Log, *big.Int, error) {
 	var (
 		receipts     types.Receipts
 		totalUsedGas = big.NewInt(0)
@@ -76,16 +166,40 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 	if p.config.DAOForkSupport && p.config.DAOForkBlock != nil && p.config.DAOForkBlock.Cmp(block.Number()) == 0 {
 		misc.ApplyDAOHardFork(statedb)
 	}
+	// Reject out of order sender nonces before executing anything
+	if err := validateNonceOrdering(types.MakeSigner(p.config, header.Number), statedb, block.Transactions()); err != nil {
+		return nil, nil, nil, err
+	}
 	// Iterate over and process the individual transactions
 	// 迭代并处理各个交易
 	for i, tx := range block.Transactions() {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, &ProcessInterruptedError{Err: err, Processed: i}
+		}
 		statedb.Prepare(tx.Hash(), block.Hash(), i)
-		receipt, _, err := ApplyTransaction(p.config, p.bc, nil, gp, statedb, header, tx, totalUsedGas, cfg)
+		txcfg := cfg
+		if trace != nil {
+			txcfg.Debug, txcfg.Tracer = true, trace(tx)
+		}
+		receipt, _, err := applyTransaction(ctx, p.config, p.bc, nil, gp, statedb, header, tx, totalUsedGas, txcfg)
 		if err != nil {
+			if cerr := ctx.Err(); cerr != nil {
+				return nil, nil, nil, &ProcessInterruptedError{Err: cerr, Processed: i}
+			}
+			var aerr *TxApplyError
+			if errors.As(err, &aerr) {
+				aerr.Index = i
+			}
 			return nil, nil, nil, err
 		}
 		receipts = append(receipts, receipt)
 		allLogs = append(allLogs, receipt.Logs...)
+		if applied != nil {
+			applied(tx, receipt)
+		}
+	}
+	if err := p.checkGasUsed(header, totalUsedGas); err != nil {
+		return nil, nil, nil, err
 	}
 	// Finalize the block, applying any consensus engine specific extras (e.g. block rewards)
 	// 完成区块，应用一些共识引擎特定的附加功能（例如区块奖励）
@@ -94,17 +208,125 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 	return receipts, allLogs, totalUsedGas, nil
 }
 
+// Prefetch executes the block's transactions on top of the given state only to
+// warm up the caches of the accounts and storage tries they access. Receipts
+// and errors are discarded, and the block isn't finalised, i.e., no rewards are
+// applied. Prefetching stops once interrupt (if not nil) is set to 1, aborting
+// the transaction being executed.
+func (p *StateProcessor) Prefetch(block *types.Block, statedb *state.StateDB, cfg vm.Config, interrupt *uint32) {
+	var (
+		header = block.Header()
+		signer = types.MakeSigner(p.config, header.Number)
+		gp     = new(GasPool).AddGas(block.GasLimit())
+	)
+	for i, tx := range block.Transactions() {
+		if interrupt != nil && atomic.LoadUint32(interrupt) == 1 {
+			return
+		}
+		msg, err := tx.AsMessage(signer)
+		if err != nil {
+			continue
+		}
+		statedb.Prepare(tx.Hash(), block.Hash(), i)
+		vmenv := vm.NewEVM(NewEVMContext(msg, header, p.bc, nil), statedb, p.config, cfg)
+		if interrupt != nil {
+			stop := watchInterrupt(vmenv, interrupt)
+			ApplyMessage(vmenv, msg, gp)
+			stop()
+		} else {
+			ApplyMessage(vmenv, msg, gp)
+		}
+	}
+}
+
+// prefetchInterruptRecheck is the interval at which the interrupt flag of a
+// prefetch is polled while a transaction is being executed.
+const prefetchInterruptRecheck = time.Millisecond
+
+// watchInterrupt cancels the EVM once the interrupt flag is set to 1, until the
+// returned function is called.
+func watchInterrupt(vmenv *vm.EVM, interrupt *uint32) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(prefetchInterruptRecheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if atomic.LoadUint32(interrupt) == 1 {
+					vmenv.Cancel()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// checkGasUsed checks that the gas used by the transactions of a block matches
+// the gas used recorded in its header, with a missing one counting as zero. It
+// passes if the processor was told to skip the check.
+func (p *StateProcessor) checkGasUsed(header *types.Header, usedGas *big.Int) error {
+	if p.skipGasUsedCheck {
+		return nil
+	}
+	recorded := header.GasUsed
+	if recorded == nil {
+		recorded = new(big.Int)
+	}
+	if recorded.Cmp(usedGas) != 0 {
+		return fmt.Errorf("%w (remote: %v local: %v)", ErrGasUsedMismatch, recorded, usedGas)
+	}
+	return nil
+}
+
+// validateNonceOrdering checks that the nonces of each sender's transactions are
+// strictly increasing and contiguous, starting from the sender's nonce in the
+// given state.
+func validateNonceOrdering(signer types.Signer, statedb *state.StateDB, txs types.Transactions) error {
+	next := make(map[common.Address]uint64)
+	for i, tx := range txs {
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			return err
+		}
+		nonce, ok := next[from]
+		if !ok {
+			nonce = statedb.GetNonce(from)
+		}
+		if tx.Nonce() != nonce {
+			return &NonceOrderingError{Sender: from, Index: i, Nonce: tx.Nonce(), Expected: nonce}
+		}
+		next[from] = nonce + 1
+	}
+	return nil
+}
+
 // ApplyTransaction attempts to apply a transaction to the given state database
 // and uses the input parameters for its environment. It returns the receipt
 // for the transaction, gas used and an error if the transaction failed,
-// indicating the block was invalid.
+// indicating the block was invalid. The error is a *TxApplyError identifying the
+// transaction, whose index is left for the caller to fill in.
+//
+// usedGas is the gas used by the preceding transactions of the block. The gas
+// used by the transaction is added to it, and the receipt records both the
+// transaction's own gas used and a copy of the resulting cumulative total.
 // ApplyTransaction 尝试将交易应用于给定的状态数据库，并使用其环境的输入参数。
 // 它返回交易的收据，使用的 Gas 和错误，如果交易失败，表明块是无效的。
 func ApplyTransaction(config *params.ChainConfig, bc *BlockChain, author *common.Address, gp *GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *big.Int, cfg vm.Config) (*types.Receipt, *big.Int, error) {
+	return applyTransaction(context.Background(), config, bc, author, gp, statedb, header, tx, usedGas, cfg)
+}
+
+// applyTransaction implements ApplyTransaction, cancelling the EVM once the given
+// context is cancelled. The context error is then returned as is, without a
+// receipt.
+func applyTransaction(ctx context.Context, config *params.ChainConfig, bc ChainContext, author *common.Address, gp *GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *big.Int, cfg vm.Config) (*types.Receipt, *big.Int, error) {
 	// 把交易转换成 Message
 	msg, err := tx.AsMessage(types.MakeSigner(config, header.Number))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, &TxApplyError{Err: err, TxHash: tx.Hash(), Index: -1}
 	}
 	// Create a new context to be used in the EVM environment
 	// 每一个交易都创建了新的虚拟机环境。
@@ -113,13 +335,56 @@ func ApplyTransaction(config *params.ChainConfig, bc *BlockChain, author *common
 	// about the transaction and calling mechanisms.
 	// 创建一个新环境，其中包含有关交易和调用机制的所有相关信息。
 	vmenv := vm.NewEVM(context, statedb, config, cfg)
+	if done := ctx.Done(); done != nil {
+		applied := make(chan struct{})
+		defer close(applied)
+		go func() {
+			select {
+			case <-done:
+				vmenv.Cancel()
+			case <-applied:
+			}
+		}()
+	}
 	// Apply the transaction to the current state (included in the env)
 	// 将交易应用到当前状态（包含在 env 中）
 	_, gas, failed, err := ApplyMessage(vmenv, msg, gp)
+	// An aborted execution looks successful, so it's only detected by the context
+	if cerr := ctx.Err(); cerr != nil {
+		return nil, nil, cerr
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, &TxApplyError{Err: err, TxHash: tx.Hash(), Index: -1}
 	}
+	return finaliseTransaction(config, statedb, header, tx, msg, gas, failed, usedGas), gas, err
+}
+
+// TryApplyTransaction applies a transaction like ApplyTransaction, but leaves
+// the state and the gas pool as they were if it can't be applied, so that the
+// caller can carry on with the next transaction. It reports whether the
+// transaction was committed.
+//
+// A transaction may fail after its gas has been bought from the pool (e.g. if
+// the sender can't afford the transferred value), so reverting the state alone
+// would leak the gas it took.
+// TryApplyTransaction 在交易失败时回滚状态和 gaspool，供打包区块时跳过无效交易使用。
+func TryApplyTransaction(config *params.ChainConfig, bc *BlockChain, author *common.Address, gp *GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *big.Int, cfg vm.Config) (committed bool, receipt *types.Receipt, err error) {
+	var (
+		snap  = statedb.Snapshot()
+		avail = new(big.Int).Set((*big.Int)(gp))
+	)
+	receipt, _, err = ApplyTransaction(config, bc, author, gp, statedb, header, tx, usedGas, cfg)
+	if err != nil {
+		statedb.RevertToSnapshot(snap)
+		(*big.Int)(gp).Set(avail)
+		return false, nil, err
+	}
+	return true, receipt, nil
+}
 
+// finaliseTransaction updates the state with the pending changes of an applied
+// transaction, adds the gas it used to usedGas and creates its receipt.
+func finaliseTransaction(config *params.ChainConfig, statedb *state.StateDB, header *types.Header, tx *types.Transaction, msg types.Message, gas *big.Int, failed bool, usedGas *big.Int) *types.Receipt {
 	// Update the state with pending changes
 	// 求得中间状态
 	var root []byte
@@ -139,12 +404,46 @@ func ApplyTransaction(config *params.ChainConfig, bc *BlockChain, author *common
 	// if the transaction created a contract, store the creation address in the receipt.
 	// 如果是创建合约的交易.那么我们把创建地址存储到收据里面.
 	if msg.To() == nil {
-		receipt.ContractAddress = crypto.CreateAddress(vmenv.Context.Origin, tx.Nonce())
+		receipt.ContractAddress = crypto.CreateAddress(msg.From(), tx.Nonce())
 	}
 
 	// Set the receipt logs and create a bloom for filtering
 	receipt.Logs = statedb.GetLogs(tx.Hash())
 	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
 	// 拿到所有的日志并创建日志的布隆过滤器.
-	return receipt, gas, err
+	return receipt
+}
+
+// VerifyReceipt re-executes a transaction on top of the given state and checks
+// that the produced receipt matches the expected one in gas used, status, logs
+// bloom and created contract address. The state database is modified in the
+// process, so callers should pass a copy positioned right before the transaction,
+// which is the txIndex-th one of its block.
+//
+// The chain is needed to derive the block author and to serve the BLOCKHASH
+// opcode, so it must not be nil.
+func VerifyReceipt(config *params.ChainConfig, chain ChainContext, statedb *state.StateDB, header *types.Header, tx *types.Transaction, txIndex int, expected *types.Receipt) error {
+	if chain == nil {
+		return errors.New("no chain to verify receipt against")
+	}
+	statedb.Prepare(tx.Hash(), header.Hash(), txIndex)
+
+	gp := new(GasPool).AddGas(header.GasLimit)
+	receipt, _, err := applyTransaction(context.Background(), config, chain, nil, gp, statedb, header, tx, new(big.Int), vm.Config{})
+	if err != nil {
+		return err
+	}
+	if receipt.GasUsed.Cmp(expected.GasUsed) != 0 {
+		return fmt.Errorf("receipt gas used mismatch: have %v, want %v", receipt.GasUsed, expected.GasUsed)
+	}
+	if receipt.Status != expected.Status {
+		return fmt.Errorf("receipt status mismatch: have %d, want %d", receipt.Status, expected.Status)
+	}
+	if receipt.Bloom != expected.Bloom {
+		return fmt.Errorf("receipt bloom mismatch: have %x, want %x", receipt.Bloom, expected.Bloom)
+	}
+	if receipt.ContractAddress != expected.ContractAddress {
+		return fmt.Errorf("receipt contract address mismatch: have %x, want %x", receipt.ContractAddress, expected.ContractAddress)
+	}
+	return nil
 }
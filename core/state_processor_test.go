@@ -0,0 +1,734 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var (
+	processorTestKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	processorTestAddr   = crypto.PubkeyToAddress(processorTestKey.PublicKey)
+)
+
+// newProcessorTestGenesis creates a fresh database with a genesis block funding
+// the processor test account.
+func newProcessorTestGenesis() (ethdb.Database, *Genesis, *types.Block) {
+	db, _ := ethdb.NewMemDatabase()
+	gspec := &Genesis{
+		Config: params.TestChainConfig,
+		Alloc:  GenesisAlloc{processorTestAddr: {Balance: big.NewInt(1000000000)}},
+	}
+	return db, gspec, gspec.MustCommit(db)
+}
+
+// processorTestTx creates a signed value transfer from the processor test account.
+func processorTestTx(nonce uint64, to common.Address, amount *big.Int) *types.Transaction {
+	tx, _ := types.SignTx(types.NewTransaction(nonce, to, amount, bigTxGas, nil, nil), types.HomesteadSigner{}, processorTestKey)
+	return tx
+}
+
+// Tests that re-executing a transaction verifies its genuine receipt, but
+// detects a receipt that was tampered with.
+func TestVerifyReceipt(t *testing.T) {
+	db, gspec, genesis := newProcessorTestGenesis()
+
+	tx := processorTestTx(0, common.Address{0xaa}, big.NewInt(1000))
+	blocks, receipts := GenerateChain(gspec.Config, genesis, db, 1, func(i int, gen *BlockGen) {
+		gen.AddTx(tx)
+	})
+	header := blocks[0].Header()
+
+	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), vm.Config{})
+	defer blockchain.Stop()
+
+	statedb, _ := state.New(genesis.Root(), state.NewDatabase(db))
+	if err := VerifyReceipt(gspec.Config, blockchain, statedb, header, tx, 0, receipts[0][0]); err != nil {
+		t.Fatalf("failed to verify genuine receipt: %v", err)
+	}
+	tampered := *receipts[0][0]
+	tampered.GasUsed = new(big.Int).Add(tampered.GasUsed, common.Big1)
+
+	statedb, _ = state.New(genesis.Root(), state.NewDatabase(db))
+	if err := VerifyReceipt(gspec.Config, blockchain, statedb, header, tx, 0, &tampered); err == nil {
+		t.Fatalf("tampered receipt gas went undetected")
+	}
+	// Verifying without a chain is rejected instead of crashing on BLOCKHASH
+	statedb, _ = state.New(genesis.Root(), state.NewDatabase(db))
+	if err := VerifyReceipt(gspec.Config, nil, statedb, header, tx, 0, receipts[0][0]); err == nil {
+		t.Fatalf("receipt verified without a chain")
+	}
+}
+
+// Tests that a block containing a sender's transactions out of nonce order is
+// rejected upfront, reporting the sender and the offending transaction.
+func TestProcessNonceOrdering(t *testing.T) {
+	db, gspec, genesis := newProcessorTestGenesis()
+
+	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), vm.Config{})
+	defer blockchain.Stop()
+
+	txs := types.Transactions{
+		processorTestTx(1, common.Address{0xaa}, big.NewInt(1000)),
+		processorTestTx(0, common.Address{0xaa}, big.NewInt(1000)),
+	}
+	header := &types.Header{
+		ParentHash: genesis.Hash(),
+		Number:     big.NewInt(1),
+		GasLimit:   genesis.GasLimit(),
+		Difficulty: big.NewInt(1),
+	}
+	block := types.NewBlock(header, txs, nil, nil)
+
+	statedb, _ := state.New(genesis.Root(), state.NewDatabase(db))
+	_, _, _, err := blockchain.Processor().Process(block, statedb, vm.Config{})
+
+	nerr, ok := err.(*NonceOrderingError)
+	if !ok {
+		t.Fatalf("error mismatch: have %v, want NonceOrderingError", err)
+	}
+	if nerr.Sender != processorTestAddr || nerr.Index != 0 || nerr.Nonce != 1 || nerr.Expected != 0 {
+		t.Errorf("error details mismatch: have %+v", nerr)
+	}
+	if !errors.Is(err, ErrNonceOrdering) {
+		t.Errorf("error %v doesn't match ErrNonceOrdering", err)
+	}
+	if nonce := statedb.GetNonce(processorTestAddr); nonce != 0 {
+		t.Errorf("state modified: nonce %d", nonce)
+	}
+}
+
+// parallelTestCounter is the code of a contract incrementing the counter in its
+// first storage slot and logging the new value.
+var parallelTestCounter = []byte{
+	byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.PUSH1), 1, byte(vm.ADD),
+	byte(vm.DUP1), byte(vm.PUSH1), 0, byte(vm.SSTORE),
+	byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.LOG0),
+}
+
+// newParallelTestBlock creates a chain whose genesis funds the given senders and
+// deploys a counter contract at each of the given addresses, along with a block
+// of transactions on top of it generated by txs from the senders' keys.
+func newParallelTestBlock(t testing.TB, config *params.ChainConfig, senders int, counters []common.Address, txs func(keys []*ecdsa.PrivateKey) types.Transactions) (ethdb.Database, *BlockChain, *types.Block) {
+	var (
+		keys  = make([]*ecdsa.PrivateKey, senders)
+		alloc = make(GenesisAlloc)
+	)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+		alloc[crypto.PubkeyToAddress(keys[i].PublicKey)] = GenesisAccount{Balance: big.NewInt(1000000000)}
+	}
+	for _, addr := range counters {
+		alloc[addr] = GenesisAccount{Balance: new(big.Int), Code: parallelTestCounter}
+	}
+	db, _ := ethdb.NewMemDatabase()
+	gspec := &Genesis{Config: config, Alloc: alloc}
+	genesis := gspec.MustCommit(db)
+
+	blockchain, err := NewBlockChain(db, config, ethash.NewFaker(), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	header := &types.Header{
+		ParentHash: genesis.Hash(),
+		Coinbase:   common.Address{0xc0},
+		Number:     big.NewInt(1),
+		GasLimit:   genesis.GasLimit(),
+		Difficulty: big.NewInt(1),
+		Time:       big.NewInt(10),
+	}
+	return db, blockchain, types.NewBlock(header, txs(keys), nil, nil)
+}
+
+// parallelTestTx creates a signed transaction calling the given account.
+func parallelTestTx(key *ecdsa.PrivateKey, nonce uint64, to common.Address, amount *big.Int) *types.Transaction {
+	tx, _ := types.SignTx(types.NewTransaction(nonce, to, amount, big.NewInt(100000), big.NewInt(1), nil), types.HomesteadSigner{}, key)
+	return tx
+}
+
+// Tests that processing blocks in parallel produces exactly the same results as
+// processing them serially, both for independent and dependent transactions.
+func TestProcessParallel(t *testing.T) {
+	counters := []common.Address{{0x01, 0x01}, {0x01, 0x02}, {0x01, 0x03}, {0x01, 0x04}}
+	tests := []struct {
+		name string
+		txs  func(keys []*ecdsa.PrivateKey) types.Transactions
+	}{
+		{
+			// Half the senders call their own counters, the others pay distinct
+			// recipients
+			name: "independent",
+			txs: func(keys []*ecdsa.PrivateKey) types.Transactions {
+				var txs types.Transactions
+				for i, key := range keys[:len(counters)] {
+					txs = append(txs, parallelTestTx(key, 0, counters[i], new(big.Int)))
+				}
+				for i, key := range keys[len(counters):] {
+					txs = append(txs, parallelTestTx(key, 0, common.Address{0x02, byte(i)}, big.NewInt(1000)))
+				}
+				return txs
+			},
+		},
+		{
+			// All senders call the same counter, then the first one sends funds
+			// to the second one, which spends them on a transfer to the coinbase
+			name: "dependent",
+			txs: func(keys []*ecdsa.PrivateKey) types.Transactions {
+				var txs types.Transactions
+				for _, key := range keys {
+					txs = append(txs, parallelTestTx(key, 0, counters[0], new(big.Int)))
+				}
+				txs = append(txs, parallelTestTx(keys[0], 1, crypto.PubkeyToAddress(keys[1].PublicKey), big.NewInt(5000000)))
+				txs = append(txs, parallelTestTx(keys[1], 1, common.Address{0xc0}, big.NewInt(1000)))
+				return txs
+			},
+		},
+	}
+	preByzantium := *params.TestChainConfig
+	preByzantium.ByzantiumBlock = nil
+
+	for _, config := range []*params.ChainConfig{params.TestChainConfig, &preByzantium} {
+		for _, tt := range tests {
+			db, blockchain, block := newParallelTestBlock(t, config, 2*len(counters), counters, tt.txs)
+			root := blockchain.Genesis().Root()
+
+			serialdb, _ := state.New(root, state.NewDatabase(db))
+			wantReceipts, wantLogs, wantGas, err := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck().Process(block, serialdb, vm.Config{})
+			if err != nil {
+				t.Fatalf("%s: failed to process block serially: %v", tt.name, err)
+			}
+			paralleldb, _ := state.New(root, state.NewDatabase(db))
+			receipts, logs, gas, err := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck().ProcessParallel(block, paralleldb, vm.Config{}, 4)
+			if err != nil {
+				t.Fatalf("%s: failed to process block in parallel: %v", tt.name, err)
+			}
+			blockchain.Stop()
+
+			if gas.Cmp(wantGas) != 0 {
+				t.Errorf("%s: gas used mismatch: have %v, want %v", tt.name, gas, wantGas)
+			}
+			if !reflect.DeepEqual(receipts, wantReceipts) {
+				t.Errorf("%s: receipts mismatch", tt.name)
+			}
+			if !reflect.DeepEqual(logs, wantLogs) {
+				t.Errorf("%s: logs mismatch: have %v, want %v", tt.name, logs, wantLogs)
+			}
+			if have, want := paralleldb.IntermediateRoot(true), serialdb.IntermediateRoot(true); have != want {
+				t.Errorf("%s: state root mismatch: have %x, want %x", tt.name, have, want)
+			}
+			if count := serialdb.GetState(counters[0], common.Hash{}); len(wantLogs) == 0 || count == (common.Hash{}) {
+				t.Errorf("%s: counter not incremented", tt.name)
+			}
+		}
+	}
+}
+
+func BenchmarkProcessSerial(b *testing.B)   { benchmarkProcessParallel(b, 1) }
+func BenchmarkProcessParallel(b *testing.B) { benchmarkProcessParallel(b, 4) }
+
+// benchmarkProcessParallel processes a block of independent contract calls on
+// the given number of workers.
+func benchmarkProcessParallel(b *testing.B, workers int) {
+	counters := make([]common.Address, 32)
+	for i := range counters {
+		counters[i] = common.Address{0x01, byte(i)}
+	}
+	db, blockchain, block := newParallelTestBlock(b, params.TestChainConfig, len(counters), counters, func(keys []*ecdsa.PrivateKey) types.Transactions {
+		var txs types.Transactions
+		for i, key := range keys {
+			txs = append(txs, parallelTestTx(key, 0, counters[i], new(big.Int)))
+		}
+		return txs
+	})
+	defer blockchain.Stop()
+
+	processor := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		statedb, _ := state.New(blockchain.Genesis().Root(), state.NewDatabase(db))
+		if _, _, _, err := processor.ProcessParallel(block, statedb, vm.Config{}, workers); err != nil {
+			b.Fatalf("failed to process block: %v", err)
+		}
+	}
+}
+
+// Tests that the receipts of a processed block carry the gas used by each of its
+// transactions along with the running total, which ends at the block's gas used.
+func TestProcessCumulativeGas(t *testing.T) {
+	db, gspec, genesis := newProcessorTestGenesis()
+
+	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), vm.Config{})
+	defer blockchain.Stop()
+
+	txs := types.Transactions{
+		processorTestTx(0, common.Address{0xaa}, big.NewInt(1000)),
+		parallelTestTx(processorTestKey, 1, common.Address{0xbb}, big.NewInt(1000)),
+		// Calls the identity precompile, using more than the plain transfers
+		parallelTestTx(processorTestKey, 2, common.BytesToAddress([]byte{4}), big.NewInt(1000)),
+	}
+	header := &types.Header{
+		ParentHash: genesis.Hash(),
+		Number:     big.NewInt(1),
+		GasLimit:   genesis.GasLimit(),
+		Difficulty: big.NewInt(1),
+	}
+	block := types.NewBlock(header, txs, nil, nil)
+
+	statedb, _ := state.New(genesis.Root(), state.NewDatabase(db))
+	receipts, _, usedGas, err := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck().Process(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	if len(receipts) != len(txs) {
+		t.Fatalf("receipt count mismatch: have %d, want %d", len(receipts), len(txs))
+	}
+	sum := new(big.Int)
+	for i, receipt := range receipts {
+		sum.Add(sum, receipt.GasUsed)
+		if receipt.CumulativeGasUsed.Cmp(sum) != 0 {
+			t.Errorf("receipt %d: cumulative gas mismatch: have %v, want %v", i, receipt.CumulativeGasUsed, sum)
+		}
+	}
+	if usedGas.Cmp(sum) != 0 {
+		t.Errorf("block gas used mismatch: have %v, want %v", usedGas, sum)
+	}
+	if receipts[2].GasUsed.Cmp(receipts[0].GasUsed) <= 0 {
+		t.Errorf("precompile call gas not above transfer gas: have %v, transfer %v", receipts[2].GasUsed, receipts[0].GasUsed)
+	}
+}
+
+// Tests that the transactions of a block processed with a tracer are traced
+// independently of each other.
+func TestProcessWithTracer(t *testing.T) {
+	counter := common.Address{0x01}
+	db, blockchain, block := newParallelTestBlock(t, params.TestChainConfig, 2, []common.Address{counter}, func(keys []*ecdsa.PrivateKey) types.Transactions {
+		return types.Transactions{
+			parallelTestTx(keys[0], 0, counter, new(big.Int)),
+			parallelTestTx(keys[1], 0, counter, new(big.Int)),
+		}
+	})
+	defer blockchain.Stop()
+
+	statedb, _ := state.New(blockchain.Genesis().Root(), state.NewDatabase(db))
+	receipts, _, _, traces, err := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck().ProcessWithTracer(block, statedb, vm.Config{}, func() vm.Tracer { return vm.NewStructLogger(nil) })
+	if err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	if len(traces) != 2 || len(receipts) != 2 {
+		t.Fatalf("trace count mismatch: have %d traces, %d receipts, want 2", len(traces), len(receipts))
+	}
+	for i, trace := range traces {
+		if trace.TxHash != block.Transactions()[i].Hash() {
+			t.Errorf("trace %d: transaction hash mismatch: have %x, want %x", i, trace.TxHash, block.Transactions()[i].Hash())
+		}
+		if i > 0 && trace.Tracer == traces[i-1].Tracer {
+			t.Fatalf("trace %d: tracer shared with previous transaction", i)
+		}
+		logger, ok := trace.Tracer.(*vm.StructLogger)
+		if !ok {
+			t.Fatalf("trace %d: tracer type mismatch: have %T", i, trace.Tracer)
+		}
+		// 12 instructions and the implicit STOP
+		logs := logger.StructLogs()
+		if len(logs) != 13 {
+			t.Fatalf("trace %d: step count mismatch: have %d, want 13", i, len(logs))
+		}
+		// The counter was incremented once by each transaction
+		last := logs[len(logs)-1]
+		if have, want := last.Storage[common.Hash{}], common.BigToHash(big.NewInt(int64(i+1))); have != want {
+			t.Errorf("trace %d: counter value mismatch: have %x, want %x", i, have, want)
+		}
+	}
+}
+
+// interruptTracer is a Tracer setting an interrupt flag on the first step and
+// counting the steps executed. It waits a bit after setting the flag to give the
+// watchers of the flag a chance to notice it.
+type interruptTracer struct {
+	interrupt *uint32
+	steps     int
+}
+
+func (t *interruptTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if t.steps++; t.steps == 1 {
+		atomic.StoreUint32(t.interrupt, 1)
+		time.Sleep(20 * prefetchInterruptRecheck)
+	}
+	return nil
+}
+
+func (t *interruptTracer) CaptureBreakpoint(env *vm.EVM, pc uint64, op vm.OpCode, gas uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int) error {
+	return nil
+}
+
+func (t *interruptTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+// Tests that prefetching a block applies its transactions to the state just like
+// processing it, without finalising the block, and that it can be interrupted.
+func TestPrefetch(t *testing.T) {
+	counter, recipient := common.Address{0x01}, common.Address{0x02}
+	db, blockchain, block := newParallelTestBlock(t, params.TestChainConfig, 2, []common.Address{counter}, func(keys []*ecdsa.PrivateKey) types.Transactions {
+		return types.Transactions{
+			parallelTestTx(keys[0], 0, counter, new(big.Int)),
+			parallelTestTx(keys[1], 0, recipient, big.NewInt(1000)),
+		}
+	})
+	defer blockchain.Stop()
+
+	root := blockchain.Genesis().Root()
+	senders := make([]common.Address, 2)
+	for i, tx := range block.Transactions() {
+		senders[i], _ = types.Sender(types.HomesteadSigner{}, tx)
+	}
+	processed, _ := state.New(root, state.NewDatabase(db))
+	if _, _, _, err := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck().Process(block, processed, vm.Config{}); err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	processor := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck()
+
+	prefetched, _ := state.New(root, state.NewDatabase(db))
+	processor.Prefetch(block, prefetched, vm.Config{}, nil)
+	for _, addr := range append(senders, recipient) {
+		if have, want := prefetched.GetBalance(addr), processed.GetBalance(addr); have.Cmp(want) != 0 {
+			t.Errorf("account %x: balance mismatch: have %v, want %v", addr, have, want)
+		}
+		if have, want := prefetched.GetNonce(addr), processed.GetNonce(addr); have != want {
+			t.Errorf("account %x: nonce mismatch: have %v, want %v", addr, have, want)
+		}
+	}
+	if have, want := prefetched.GetState(counter, common.Hash{}), processed.GetState(counter, common.Hash{}); have != want {
+		t.Errorf("counter mismatch: have %x, want %x", have, want)
+	}
+	// The coinbase received the fees, but not the block reward
+	coinbase := block.Coinbase()
+	if prefetched.GetBalance(coinbase).Sign() == 0 || prefetched.GetBalance(coinbase).Cmp(processed.GetBalance(coinbase)) >= 0 {
+		t.Errorf("coinbase balance mismatch: have %v, processed %v", prefetched.GetBalance(coinbase), processed.GetBalance(coinbase))
+	}
+	// Interrupt the prefetching during the first transaction, which loops until
+	// running out of gas, tens of thousands of steps
+	var interrupt uint32
+	interrupted, _ := state.New(root, state.NewDatabase(db))
+	interrupted.SetCode(counter, []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0x00, byte(vm.JUMP)})
+
+	tracer := &interruptTracer{interrupt: &interrupt}
+	processor.Prefetch(block, interrupted, vm.Config{Debug: true, Tracer: tracer}, &interrupt)
+
+	if tracer.steps > 100 {
+		t.Errorf("interrupted transaction not aborted: %d steps executed", tracer.steps)
+	}
+	if nonce := interrupted.GetNonce(senders[1]); nonce != 0 {
+		t.Errorf("transaction executed after interrupt: nonce %d", nonce)
+	}
+}
+
+// Tests that a block failing to apply one of its transactions reports the hash
+// and index of the transaction, while preserving the cause of the failure.
+func TestProcessTxApplyError(t *testing.T) {
+	db, gspec, genesis := newProcessorTestGenesis()
+
+	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), vm.Config{})
+	defer blockchain.Stop()
+
+	txs := types.Transactions{
+		processorTestTx(0, common.Address{0xaa}, big.NewInt(1000)),
+		// Requests more gas than left in the block
+		parallelTestTx(processorTestKey, 1, common.Address{0xaa}, big.NewInt(1000)),
+	}
+	header := &types.Header{
+		ParentHash: genesis.Hash(),
+		Number:     big.NewInt(1),
+		GasLimit:   big.NewInt(50000),
+		Difficulty: big.NewInt(1),
+	}
+	block := types.NewBlock(header, txs, nil, nil)
+
+	statedb, _ := state.New(genesis.Root(), state.NewDatabase(db))
+	_, _, _, err := blockchain.Processor().Process(block, statedb, vm.Config{})
+
+	var aerr *TxApplyError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("error mismatch: have %v, want TxApplyError", err)
+	}
+	if aerr.TxHash != txs[1].Hash() || aerr.Index != 1 {
+		t.Errorf("failed transaction mismatch: have %x at %d, want %x at 1", aerr.TxHash, aerr.Index, txs[1].Hash())
+	}
+	if !errors.Is(err, ErrGasLimitReached) {
+		t.Errorf("cause mismatch: have %v, want %v", aerr.Err, ErrGasLimitReached)
+	}
+}
+
+// Tests that a transaction failing after buying its gas leaves neither the state
+// nor the gas pool changed, while a valid one is committed.
+func TestTryApplyTransaction(t *testing.T) {
+	db, gspec, genesis := newProcessorTestGenesis()
+
+	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), vm.Config{})
+	defer blockchain.Stop()
+
+	header := &types.Header{
+		ParentHash: genesis.Hash(),
+		Number:     big.NewInt(1),
+		GasLimit:   big.NewInt(100000),
+		Difficulty: big.NewInt(1),
+		Time:       big.NewInt(10),
+	}
+	var (
+		statedb, _ = state.New(genesis.Root(), state.NewDatabase(db))
+		gp         = new(GasPool).AddGas(header.GasLimit)
+		usedGas    = new(big.Int)
+		root       = statedb.IntermediateRoot(false)
+	)
+	// Transfers more than the sender's balance
+	tx := processorTestTx(0, common.Address{0xaa}, big.NewInt(2000000000))
+	committed, receipt, err := TryApplyTransaction(gspec.Config, blockchain, nil, gp, statedb, header, tx, usedGas, vm.Config{})
+	if committed || receipt != nil {
+		t.Fatalf("failed transaction committed")
+	}
+	if !errors.Is(err, errInsufficientFundsForTransfer) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errInsufficientFundsForTransfer)
+	}
+	if have := statedb.IntermediateRoot(false); have != root {
+		t.Errorf("state root mismatch: have %x, want %x", have, root)
+	}
+	if (*big.Int)(gp).Cmp(header.GasLimit) != 0 {
+		t.Errorf("gas pool mismatch: have %v, want %v", gp, header.GasLimit)
+	}
+	if usedGas.Sign() != 0 {
+		t.Errorf("used gas mismatch: have %v, want 0", usedGas)
+	}
+	// The sender can still send a valid transaction with the same nonce
+	tx = processorTestTx(0, common.Address{0xaa}, big.NewInt(1000))
+	if committed, receipt, err = TryApplyTransaction(gspec.Config, blockchain, nil, gp, statedb, header, tx, usedGas, vm.Config{}); !committed || err != nil {
+		t.Fatalf("valid transaction not committed: %v", err)
+	}
+	if want := new(big.Int).Sub(header.GasLimit, receipt.GasUsed); (*big.Int)(gp).Cmp(want) != 0 {
+		t.Errorf("gas pool mismatch: have %v, want %v", gp, want)
+	}
+	if nonce := statedb.GetNonce(processorTestAddr); nonce != 1 {
+		t.Errorf("nonce mismatch: have %d, want 1", nonce)
+	}
+}
+
+// Tests that the bloom accumulated while processing a block equals the one
+// created from all of its receipts.
+func TestProcessWithBloom(t *testing.T) {
+	counters := []common.Address{{0x01, 0x01}, {0x01, 0x02}}
+	db, blockchain, block := newParallelTestBlock(t, params.TestChainConfig, 3, counters, func(keys []*ecdsa.PrivateKey) types.Transactions {
+		return types.Transactions{
+			parallelTestTx(keys[0], 0, counters[0], new(big.Int)),
+			// A plain transfer, without logs
+			parallelTestTx(keys[1], 0, common.Address{0xaa}, big.NewInt(1000)),
+			parallelTestTx(keys[2], 0, counters[1], new(big.Int)),
+		}
+	})
+	defer blockchain.Stop()
+
+	statedb, _ := state.New(blockchain.Genesis().Root(), state.NewDatabase(db))
+	receipts, _, _, bloom, err := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck().ProcessWithBloom(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	if want := types.CreateBloom(receipts); bloom != want {
+		t.Errorf("bloom mismatch: have %x, want %x", bloom, want)
+	}
+	for _, addr := range counters {
+		if !bloom.TestBytes(addr[:]) {
+			t.Errorf("bloom missing log address %x", addr)
+		}
+	}
+}
+
+// cancelTracer is a Tracer cancelling a context on the first step.
+type cancelTracer struct {
+	cancel context.CancelFunc
+}
+
+func (t *cancelTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	t.cancel()
+	return nil
+}
+
+func (t *cancelTracer) CaptureBreakpoint(env *vm.EVM, pc uint64, op vm.OpCode, gas uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int) error {
+	return nil
+}
+
+func (t *cancelTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+// finalizeRecorder is a consensus engine recording whether a block was finalised.
+type finalizeRecorder struct {
+	consensus.Engine
+	finalized bool
+}
+
+func (e *finalizeRecorder) Finalize(chain consensus.ChainReader, header *types.Header, state *state.StateDB, txs []*types.Transaction, uncles []*types.Header, receipts []*types.Receipt) (*types.Block, error) {
+	e.finalized = true
+	return e.Engine.Finalize(chain, header, state, txs, uncles, receipts)
+}
+
+// Tests that cancelling the processing of a block stops it without finalising the
+// block, reporting how many transactions were applied.
+func TestProcessCtx(t *testing.T) {
+	counter, recipient := common.Address{0x01}, common.Address{0x02}
+	db, blockchain, block := newParallelTestBlock(t, params.TestChainConfig, 3, []common.Address{counter}, func(keys []*ecdsa.PrivateKey) types.Transactions {
+		return types.Transactions{
+			parallelTestTx(keys[0], 0, recipient, big.NewInt(1000)),
+			parallelTestTx(keys[1], 0, counter, new(big.Int)),
+			parallelTestTx(keys[2], 0, recipient, big.NewInt(1000)),
+		}
+	})
+	defer blockchain.Stop()
+
+	engine := &finalizeRecorder{Engine: ethash.NewFaker()}
+	processor := NewStateProcessor(params.TestChainConfig, blockchain, engine).SkipGasUsedCheck()
+
+	// An uncancelled context processes the block fully
+	statedb, _ := state.New(blockchain.Genesis().Root(), state.NewDatabase(db))
+	if _, _, _, err := processor.ProcessCtx(context.Background(), block, statedb, vm.Config{}); err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	if !engine.finalized {
+		t.Fatalf("block not finalised")
+	}
+	// Cancel the processing during the second transaction, the only one traced
+	engine.finalized = false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	statedb, _ = state.New(blockchain.Genesis().Root(), state.NewDatabase(db))
+	receipts, _, _, err := processor.ProcessCtx(ctx, block, statedb, vm.Config{Debug: true, Tracer: &cancelTracer{cancel}})
+
+	var ierr *ProcessInterruptedError
+	if !errors.As(err, &ierr) {
+		t.Fatalf("error mismatch: have %v, want ProcessInterruptedError", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cause mismatch: have %v, want %v", ierr.Err, context.Canceled)
+	}
+	if ierr.Processed != 1 {
+		t.Errorf("processed transactions mismatch: have %d, want 1", ierr.Processed)
+	}
+	if receipts != nil {
+		t.Errorf("receipts returned for interrupted block: %v", receipts)
+	}
+	if engine.finalized {
+		t.Errorf("interrupted block finalised")
+	}
+	if balance := statedb.GetBalance(recipient); balance.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("recipient balance mismatch: have %v, want 1000", balance)
+	}
+}
+
+// Tests that a block whose header records a gas used differing from the one of
+// its transactions is rejected, including headers recording none, unless the
+// processor skips the check.
+func TestProcessGasUsedMismatch(t *testing.T) {
+	db, gspec, genesis := newProcessorTestGenesis()
+
+	blockchain, _ := NewBlockChain(db, gspec.Config, ethash.NewFaker(), vm.Config{})
+	defer blockchain.Stop()
+
+	txs := types.Transactions{processorTestTx(0, common.Address{0xaa}, big.NewInt(1000))}
+	for i, tt := range []struct {
+		gasUsed *big.Int
+		skip    bool
+		err     error
+	}{
+		{bigTxGas, false, nil},
+		{new(big.Int).Add(bigTxGas, common.Big1), false, ErrGasUsedMismatch},
+		{nil, false, ErrGasUsedMismatch},
+		{new(big.Int), false, ErrGasUsedMismatch},
+		{nil, true, nil},
+		{new(big.Int), true, nil},
+		{new(big.Int).Add(bigTxGas, common.Big1), true, nil},
+	} {
+		header := &types.Header{
+			ParentHash: genesis.Hash(),
+			Number:     big.NewInt(1),
+			GasLimit:   genesis.GasLimit(),
+			GasUsed:    tt.gasUsed,
+			Difficulty: big.NewInt(1),
+		}
+		block := types.NewBlock(header, txs, nil, nil)
+
+		processor := blockchain.Processor().(*StateProcessor)
+		if tt.skip {
+			processor = processor.SkipGasUsedCheck()
+		}
+		statedb, _ := state.New(genesis.Root(), state.NewDatabase(db))
+		if _, _, _, err := processor.Process(block, statedb, vm.Config{}); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that the receipt callback is called once per transaction, in order and
+// with the receipts eventually returned.
+func TestProcessWithCallback(t *testing.T) {
+	counter := common.Address{0x01}
+	db, blockchain, block := newParallelTestBlock(t, params.TestChainConfig, 2, []common.Address{counter}, func(keys []*ecdsa.PrivateKey) types.Transactions {
+		return types.Transactions{
+			parallelTestTx(keys[0], 0, counter, new(big.Int)),
+			parallelTestTx(keys[1], 0, common.Address{0xaa}, big.NewInt(1000)),
+			parallelTestTx(keys[0], 1, counter, new(big.Int)),
+		}
+	})
+	defer blockchain.Stop()
+
+	var streamed types.Receipts
+	statedb, _ := state.New(blockchain.Genesis().Root(), state.NewDatabase(db))
+	receipts, _, _, err := blockchain.Processor().(*StateProcessor).SkipGasUsedCheck().ProcessWithCallback(block, statedb, vm.Config{}, func(receipt *types.Receipt) {
+		streamed = append(streamed, receipt)
+	})
+	if err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	if len(streamed) != len(block.Transactions()) {
+		t.Fatalf("callback count mismatch: have %d, want %d", len(streamed), len(block.Transactions()))
+	}
+	for i, receipt := range streamed {
+		if receipt != receipts[i] {
+			t.Errorf("receipt %d mismatch: have %v, want %v", i, receipt, receipts[i])
+		}
+		if receipt.TxHash != block.Transactions()[i].Hash() {
+			t.Errorf("receipt %d: transaction mismatch: have %x, want %x", i, receipt.TxHash, block.Transactions()[i].Hash())
+		}
+	}
+	if len(streamed[0].Logs) != 1 || len(streamed[1].Logs) != 0 || len(streamed[2].Logs) != 1 {
+		t.Errorf("receipt logs mismatch: have %d, %d, %d", len(streamed[0].Logs), len(streamed[1].Logs), len(streamed[2].Logs))
+	}
+}
@@ -19,9 +19,11 @@ package core
 import (
 	"errors"
 	"math/big"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
@@ -30,6 +32,9 @@ import (
 var (
 	Big0                         = big.NewInt(0)
 	errInsufficientBalanceForGas = errors.New("insufficient balance to pay for gas")
+
+	errInsufficientFundsForTransfer = errors.New("insufficient funds for gas * price + value")
+	errCostOverflow                 = errors.New("gas * price + value overflows 256 bits")
 )
 
 /*
@@ -59,9 +64,14 @@ type StateTransition struct {
 	msg        Message
 	gas        uint64
 	// gas 的价格
-	gasPrice   *big.Int
+	gasPrice   *big.Int // Effective gas price paid by the sender
+	gasFeeCap  *big.Int // Maximum gas price bought gas up front with
+	gasTipCap  *big.Int // Maximum gas price paid to the miner on top of the base fee
+	baseFee    *big.Int // Base fee burnt per gas (nil if there's no fee market)
 	// 最开始的 gas
-	initialGas *big.Int
+	initialGas uint64
+	// 退还给发送者的 gas（已封顶）
+	refunded   uint64
 	// 转账的值
 	value      *big.Int
 	// 输入数据
@@ -79,6 +89,9 @@ type Message interface {
 	To() *common.Address
 	// Message 的 GasPrice
 	GasPrice() *big.Int
+	// Fee market gas price caps, both equal to GasPrice for legacy messages
+	GasFeeCap() *big.Int
+	GasTipCap() *big.Int
 	// message 的 GasLimit
 	Gas() *big.Int
 	Value() *big.Int
@@ -91,7 +104,10 @@ type Message interface {
 // IntrinsicGas computes the 'intrinsic gas' for a message
 // with the given data.
 // IntrinsicGas 计算具有给定数据的消息的“intrinsic gas”。
-// TODO convert to uint64
+//
+// Contract creations are only charged TxGasContractCreation from homestead on,
+// before that they cost the same TxGas as any other transaction. Use
+// IntrinsicGasUint64 to avoid big integer arithmetic.
 func IntrinsicGas(data []byte, contractCreation, homestead bool) *big.Int {
 	igas := new(big.Int)
 	if contractCreation && homestead {
@@ -117,19 +133,163 @@ func IntrinsicGas(data []byte, contractCreation, homestead bool) *big.Int {
 	return igas
 }
 
+// IntrinsicGasUint64 computes the 'intrinsic gas' for a message with the given
+// data just like IntrinsicGas, but in 64 bit arithmetic, returning
+// ErrGasUintOverflow if the gas doesn't fit.
+func IntrinsicGasUint64(data []byte, contractCreation, homestead bool) (uint64, error) {
+	var nz uint64
+	for _, byt := range data {
+		if byt != 0 {
+			nz++
+		}
+	}
+	return intrinsicGasUint64(uint64(len(data))-nz, nz, contractCreation, homestead)
+}
+
+// intrinsicGasUint64 computes the intrinsic gas of a message with the given
+// number of zero and nonzero data bytes, checking every step for overflows.
+func intrinsicGasUint64(zeroes, nonZeroes uint64, contractCreation, homestead bool) (uint64, error) {
+	gas := params.TxGas
+	if contractCreation && homestead {
+		gas = params.TxGasContractCreation
+	}
+	nonZeroGas, overflow := math.SafeMul(nonZeroes, params.TxDataNonZeroGas)
+	if overflow {
+		return 0, ErrGasUintOverflow
+	}
+	if gas, overflow = math.SafeAdd(gas, nonZeroGas); overflow {
+		return 0, ErrGasUintOverflow
+	}
+	zeroGas, overflow := math.SafeMul(zeroes, params.TxDataZeroGas)
+	if overflow {
+		return 0, ErrGasUintOverflow
+	}
+	if gas, overflow = math.SafeAdd(gas, zeroGas); overflow {
+		return 0, ErrGasUintOverflow
+	}
+	return gas, nil
+}
+
+// DataGasFunc computes the gas charged for the data of a message, on top of the
+// base cost of the transaction.
+type DataGasFunc func(data []byte) uint64
+
+// DefaultDataGas charges the data of a message per byte, at a different price
+// for zero and nonzero bytes.
+func DefaultDataGas(data []byte) uint64 {
+	_, _, zeroGas, nonZeroGas := CalldataGasBreakdown(data)
+	return zeroGas + nonZeroGas
+}
+
+// FloorDataGas returns a data gas strategy charging at least floorPerToken gas
+// per token of the data, where a zero byte counts as one token and a nonzero
+// byte as four. Data cheaper than the floor under the default per-byte prices
+// is charged the floor instead. A floor not fitting into 64 bits saturates,
+// making the intrinsic gas computation fail with an overflow.
+func FloorDataGas(floorPerToken uint64) DataGasFunc {
+	return func(data []byte) uint64 {
+		zeroBytes, nonZeroBytes, _, _ := CalldataGasBreakdown(data)
+		floor, overflow := math.SafeMul(uint64(zeroBytes)+4*uint64(nonZeroBytes), floorPerToken)
+		if overflow {
+			return math.MaxUint64
+		}
+		if gas := DefaultDataGas(data); gas > floor {
+			return gas
+		}
+		return floor
+	}
+}
+
+// DataGasFuncFor returns the data gas strategy of the fork active at the given
+// block: the default per-byte prices, floored from the data gas floor block on
+// if the chain configures one.
+func DataGasFuncFor(config *params.ChainConfig, num *big.Int) DataGasFunc {
+	if config.IsDataGasFloor(num) && config.DataGasFloorPerToken > 0 {
+		return FloorDataGas(config.DataGasFloorPerToken)
+	}
+	return DefaultDataGas
+}
+
+// IntrinsicGasWithDataGas computes the 'intrinsic gas' for a message with the
+// given data just like IntrinsicGasUint64, but charges the data according to
+// the given strategy.
+func IntrinsicGasWithDataGas(data []byte, contractCreation, homestead bool, dataGas DataGasFunc) (uint64, error) {
+	gas, err := intrinsicGasUint64(0, 0, contractCreation, homestead)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return gas, nil
+	}
+	gas, overflow := math.SafeAdd(gas, dataGas(data))
+	if overflow {
+		return 0, ErrGasUintOverflow
+	}
+	return gas, nil
+}
+
+// CalldataGasBreakdown splits the intrinsic gas charged for a message's data
+// into the parts attributable to zero and to nonzero bytes, using the same
+// per-byte prices as IntrinsicGas.
+func CalldataGasBreakdown(data []byte) (zeroBytes, nonZeroBytes int, zeroGas, nonZeroGas uint64) {
+	for _, byt := range data {
+		if byt == 0 {
+			zeroBytes++
+		} else {
+			nonZeroBytes++
+		}
+	}
+	return zeroBytes, nonZeroBytes, uint64(zeroBytes) * params.TxDataZeroGas, uint64(nonZeroBytes) * params.TxDataNonZeroGas
+}
+
+// BlockIntrinsicGas sums the intrinsic gas of all the transactions in a block,
+// which is the minimum amount of gas the block uses before any execution. An
+// error is returned as soon as the running total no longer fits into 64 bits.
+func BlockIntrinsicGas(block *types.Block, homestead bool) (*big.Int, error) {
+	total := new(big.Int)
+	for _, tx := range block.Transactions() {
+		total.Add(total, IntrinsicGas(tx.Data(), tx.To() == nil, homestead))
+		if total.BitLen() > 64 {
+			return nil, ErrIntrinsicGasOverflow
+		}
+	}
+	return total, nil
+}
+
+// ExecutionResult is the outcome of applying a message to the state, gathered
+// into a struct so it can be extended without breaking its users.
+type ExecutionResult struct {
+	ReturnData  []byte // Data returned by the EVM execution (if it took place)
+	UsedGas     uint64 // Gas billed to the sender, i.e. after the refunds
+	RequiredGas uint64 // Gas consumed by the execution, before the refunds
+	Failed      bool   // Whether the EVM execution failed (not a consensus error)
+	Err         error  // Error the EVM execution failed with, if any
+}
+
 // NewStateTransition initialises and returns a new state transition object.
 // NewStateTransition 初始化并返回一个新的状态转换对象。
+//
+// The base fee of the fee market is taken from the EVM context, since the block
+// headers of this chain don't carry one. Without a base fee, the message simply
+// pays its gas price, all of it going to the miner.
 func NewStateTransition(evm *vm.EVM, msg Message, gp *GasPool) *StateTransition {
-	return &StateTransition{
-		gp:         gp,
-		evm:        evm,
-		msg:        msg,
-		gasPrice:   msg.GasPrice(),
-		initialGas: new(big.Int),
-		value:      msg.Value(),
-		data:       msg.Data(),
-		state:      evm.StateDB,
+	st := &StateTransition{
+		gp:        gp,
+		evm:       evm,
+		msg:       msg,
+		gasPrice:  msg.GasPrice(),
+		gasFeeCap: msg.GasFeeCap(),
+		gasTipCap: msg.GasTipCap(),
+		baseFee:   evm.BaseFee,
+		value:     msg.Value(),
+		data:      msg.Data(),
+		state:     evm.StateDB,
+	}
+	// Under the fee market, pay the base fee plus as much tip as the fee cap allows
+	if st.baseFee != nil {
+		st.gasPrice = math.BigMin(new(big.Int).Add(st.baseFee, st.gasTipCap), st.gasFeeCap)
 	}
+	return st
 }
 
 // ApplyMessage computes the new state by applying the given message
@@ -151,6 +311,135 @@ func ApplyMessage(evm *vm.EVM, msg Message, gp *GasPool) ([]byte, *big.Int, bool
 	return ret, gasUsed, failed, err
 }
 
+// EstimateNetGas applies the message just like ApplyMessage and returns the gas
+// actually billed to the sender, i.e. the gas used by the execution minus the
+// refunds earned (e.g. for clearing storage). This is not the gas limit needed
+// to execute the message, which is the higher, pre-refund amount.
+func EstimateNetGas(evm *vm.EVM, msg Message, gp *GasPool) (netGas uint64, err error) {
+	_, gasUsed, _, err := ApplyMessage(evm, msg, gp)
+	if err != nil {
+		return 0, err
+	}
+	return gasUsed.Uint64(), nil
+}
+
+// EstimateGas applies the message as a dry run: it reports the gas used and
+// whether the execution failed, but reverts all the state changes afterwards,
+// including the gas purchase, the nonce increment, the refunds and the payment
+// of the miner. The gas pool is left untouched too.
+func EstimateGas(evm *vm.EVM, msg Message, gp *GasPool) (uint64, bool, error) {
+	st := NewStateTransition(evm, msg, gp)
+
+	snapshot, available := st.state.Snapshot(), new(big.Int).Set((*big.Int)(gp))
+	defer func() {
+		st.state.RevertToSnapshot(snapshot)
+		(*big.Int)(gp).Set(available)
+	}()
+	result, err := st.Execute()
+	if err != nil {
+		return 0, false, err
+	}
+	return result.UsedGas, result.Failed, nil
+}
+
+// StorageSlot identifies a single storage slot of a contract account.
+type StorageSlot struct {
+	Address common.Address
+	Slot    common.Hash
+}
+
+// ApplyMessageClears applies the given message just like ApplyMessage, but also
+// traces the execution and returns every storage slot that was set from a
+// nonzero value to zero (i.e. that generated a storage clearing refund).
+//
+// Slots cleared within a reverted call frame, or cleared and later set again,
+// are not reported since they don't contribute to the final refund.
+//
+// The configuration of the given EVM is retained. If it traces the execution
+// already, its tracer keeps receiving all the events.
+func ApplyMessageClears(evm *vm.EVM, msg Message, gp *GasPool) ([]StorageSlot, []byte, *big.Int, bool, error) {
+	cfg := evm.VMConfig()
+
+	tracer := &storageClearTracer{seen: make(map[StorageSlot]struct{})}
+	if cfg.Debug {
+		tracer.inner = cfg.Tracer
+	}
+	cfg.Debug, cfg.Tracer = true, tracer
+	evm = vm.NewEVM(evm.Context, evm.StateDB, evm.ChainConfig(), cfg)
+
+	ret, gasUsed, failed, err := ApplyMessage(evm, msg, gp)
+	if err != nil || failed {
+		return nil, ret, gasUsed, failed, err
+	}
+	// Drop any slot which was reverted or overwritten after clearing
+	var cleared []StorageSlot
+	for _, slot := range tracer.cleared {
+		if evm.StateDB.GetState(slot.Address, slot.Slot) == (common.Hash{}) {
+			cleared = append(cleared, slot)
+		}
+	}
+	return cleared, ret, gasUsed, failed, err
+}
+
+// storageClearTracer is a vm.Tracer collecting all the SSTORE operations that
+// zero out a previously nonzero storage slot. All events are forwarded to the
+// inner tracer, if any.
+type storageClearTracer struct {
+	inner   vm.Tracer
+	seen    map[StorageSlot]struct{}
+	cleared []StorageSlot
+}
+
+func (t *storageClearTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	t.captureClear(env, op, stack, contract, err)
+	if t.inner != nil {
+		return t.inner.CaptureState(env, pc, op, gas, cost, memory, stack, contract, depth, err)
+	}
+	return nil
+}
+
+// captureClear records the slot written by an SSTORE if it gets zeroed out.
+func (t *storageClearTracer) captureClear(env *vm.EVM, op vm.OpCode, stack *vm.Stack, contract *vm.Contract, err error) {
+	if err != nil || op != vm.SSTORE {
+		return
+	}
+	data := stack.Data()
+	if len(data) < 2 {
+		return
+	}
+	var (
+		slot  = StorageSlot{Address: contract.Address(), Slot: common.BigToHash(data[len(data)-1])}
+		value = data[len(data)-2]
+	)
+	if value.Sign() != 0 || env.StateDB.GetState(slot.Address, slot.Slot) == (common.Hash{}) {
+		return
+	}
+	if _, ok := t.seen[slot]; !ok {
+		t.seen[slot] = struct{}{}
+		t.cleared = append(t.cleared, slot)
+	}
+}
+
+func (t *storageClearTracer) CaptureBreakpoint(env *vm.EVM, pc uint64, op vm.OpCode, gas uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int) error {
+	if t.inner != nil {
+		return t.inner.CaptureBreakpoint(env, pc, op, gas, memory, stack, contract, depth)
+	}
+	return nil
+}
+
+func (t *storageClearTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	if t.inner != nil {
+		return t.inner.CaptureEnd(output, gasUsed, d, err)
+	}
+	return nil
+}
+
+func (t *storageClearTracer) CaptureStorageAccess(env *vm.EVM, addr common.Address, slot, value common.Hash, write bool) {
+	if inner, ok := t.inner.(vm.StorageTracer); ok {
+		inner.CaptureStorageAccess(env, addr, slot, value, write)
+	}
+}
+
 func (st *StateTransition) from() vm.AccountRef {
 	f := st.msg.From()
 	if !st.state.Exist(f) {
@@ -186,12 +475,22 @@ func (st *StateTransition) useGas(amount uint64) error {
 
 //  实现 Gas 的预扣费
 func (st *StateTransition) buyGas() error {
+	// The gas limit is the only value converted from big.Int to uint64 gas, all
+	// the later gas bookkeeping is bounded by it
 	mgas := st.msg.Gas()
 	if mgas.BitLen() > 64 {
 		return vm.ErrOutOfGas
 	}
+	gas, overflow := math.SafeAdd(st.gas, mgas.Uint64())
+	if overflow {
+		return ErrGasUintOverflow
+	}
 
-	mgval := new(big.Int).Mul(mgas, st.gasPrice)
+	// Buy the gas at the fee cap, the excess over the effective price is refunded
+	mgval := new(big.Int).Mul(mgas, st.gasFeeCap)
+	if st.value != nil && new(big.Int).Add(mgval, st.value).BitLen() > 256 {
+		return errCostOverflow
+	}
 
 	var (
 		state  = st.state
@@ -204,10 +503,10 @@ func (st *StateTransition) buyGas() error {
 	if err := st.gp.SubGas(mgas); err != nil {
 		return err
 	}
-	st.gas += mgas.Uint64()
+	st.gas = gas
 
-	st.initialGas.Set(mgas)
-	// 从账号里面减去 GasLimit * GasPrice
+	st.initialGas = gas
+	// 从账号里面减去 GasLimit * GasFeeCap
 	state.SubBalance(sender.Address(), mgval)
 	return nil
 }
@@ -227,7 +526,25 @@ func (st *StateTransition) preCheck() error {
 			return ErrNonceTooLow
 		}
 	}
-	return st.buyGas()
+	// Make sure the fee caps are payable under the fee market
+	if st.baseFee != nil {
+		if st.gasTipCap.Cmp(st.gasFeeCap) > 0 {
+			return ErrTipAboveFeeCap
+		}
+		if st.gasFeeCap.Cmp(st.baseFee) < 0 {
+			return ErrFeeCapTooLow
+		}
+	}
+	if err := st.buyGas(); err != nil {
+		return err
+	}
+	// Make sure the value can be transferred with what's left after buying the
+	// gas, instead of finding out deep inside the EVM. This applies to message
+	// simulations too: only the nonce check is waived for them.
+	if st.state.GetBalance(sender.Address()).Cmp(st.value) < 0 {
+		return errInsufficientFundsForTransfer
+	}
+	return nil
 }
 
 // TransitionDb will transition the state by applying the current message and returning the result
@@ -237,8 +554,19 @@ func (st *StateTransition) preCheck() error {
 // 包括操作所需的 gas 以及使用的 gas。 如果失败，它会返回一个错误。
 // 错误表示共识问题。
 func (st *StateTransition) TransitionDb() (ret []byte, requiredGas, usedGas *big.Int, failed bool, err error) {
-	if err = st.preCheck(); err != nil {
-		return
+	result, err := st.Execute()
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	return result.ReturnData, new(big.Int).SetUint64(result.RequiredGas), new(big.Int).SetUint64(result.UsedGas), result.Failed, nil
+}
+
+// Execute transitions the state by applying the current message, just like
+// TransitionDb, but gathers the outcome of the execution into an ExecutionResult.
+// The returned error is a consensus error, in which case no result is returned.
+func (st *StateTransition) Execute() (*ExecutionResult, error) {
+	if err := st.preCheck(); err != nil {
+		return nil, err
 	}
 	msg := st.msg
 	sender := st.from() // err checked in preCheck
@@ -248,18 +576,27 @@ func (st *StateTransition) TransitionDb() (ret []byte, requiredGas, usedGas *big
 	contractCreation := msg.To() == nil
 
 	// Pay intrinsic gas
-	// TODO convert to uint64
 	// 计算最开始的 Gas  g0
-	intrinsicGas := IntrinsicGas(st.data, contractCreation, homestead)
-	if intrinsicGas.BitLen() > 64 {
-		return nil, nil, nil, false, vm.ErrOutOfGas
+	dataGas := DataGasFuncFor(st.evm.ChainConfig(), st.evm.BlockNumber)
+	intrinsicGas, err := IntrinsicGasWithDataGas(st.data, contractCreation, homestead, dataGas)
+	if err != nil {
+		return nil, err
 	}
-	if err = st.useGas(intrinsicGas.Uint64()); err != nil {
-		return nil, nil, nil, false, err
+	// Since Shanghai the init code of a contract creation is capped in size and
+	// charged per word (EIP-3860)
+	if contractCreation && st.evm.ChainConfig().IsShanghai(st.evm.BlockNumber) {
+		if len(st.data) > params.MaxInitCodeSize {
+			return nil, ErrMaxInitCodeSizeExceeded
+		}
+		intrinsicGas += (uint64(len(st.data)) + 31) / 32 * params.InitCodeWordGas
+	}
+	if err = st.useGas(intrinsicGas); err != nil {
+		return nil, err
 	}
 
 	var (
 		evm = st.evm
+		ret []byte
 		// vm errors do not effect consensus and are therefor
 		// not assigned to err, except for insufficient balance
 		// error.
@@ -280,42 +617,89 @@ func (st *StateTransition) TransitionDb() (ret []byte, requiredGas, usedGas *big
 		// sufficient balance to make the transfer happen. The first
 		// balance transfer may never fail.
 		if vmerr == vm.ErrInsufficientBalance {
-			return nil, nil, nil, false, vmerr
+			return nil, vmerr
+		}
+		// Only a revert carries meaningful return data (e.g. the revert reason)
+		if vmerr != vm.ErrExecutionReverted {
+			ret = nil
 		}
 	}
 	// 计算被使用的 Gas 数量
-	requiredGas = new(big.Int).Set(st.gasUsed())
+	requiredGas := st.gasUsed()
 	// 计算 Gas 的退费 会增加到 st.gas 上面。 所以矿工拿到的是退税后的
 	st.refundGas()
-	// 给矿工增加收入。
-	st.state.AddBalance(st.evm.Coinbase, new(big.Int).Mul(st.gasUsed(), st.gasPrice))
+	// 给矿工增加收入。 The base fee is burnt, only the tip goes to the miner.
+	tip := st.gasPrice
+	if st.baseFee != nil {
+		tip = new(big.Int).Sub(st.gasPrice, st.baseFee)
+	}
+	st.state.AddBalance(st.evm.Coinbase, new(big.Int).Mul(new(big.Int).SetUint64(st.gasUsed()), tip))
 	// requiredGas 和 gasUsed 的区别一个是没有退税的， 一个是退税了的。
 	// 看上面的调用 ApplyMessage 直接丢弃了 requiredGas, 说明返回的是退税了的。
-	return ret, requiredGas, st.gasUsed(), vmerr != nil, err
+	return &ExecutionResult{
+		ReturnData:  ret,
+		UsedGas:     st.gasUsed(),
+		RequiredGas: requiredGas,
+		Failed:      vmerr != nil,
+		Err:         vmerr,
+	}, nil
+}
+
+// refundQuotient returns the divisor of the used gas capping the refund, as
+// defined by the chain rules active in the current block.
+func (st *StateTransition) refundQuotient() uint64 {
+	if st.evm.ChainConfig().IsLondon(st.evm.BlockNumber) {
+		return params.RefundQuotientEIP3529
+	}
+	return params.RefundQuotient
 }
 
 func (st *StateTransition) refundGas() {
-	// Return eth for remaining gas to the sender account,
-	// exchanged at the original rate.
-	// 将剩余 gas 的 eth 返还至发送方账户，按原汇率兑换。
+	// Apply refund counter, capped to a fraction of the used gas: half of it
+	// before London, a fifth since EIP-3529.
+	// 应用退款计数器，上限为已用 gas 的一半（London 之后为五分之一）。
+	refund := st.gasUsed() / st.refundQuotient()
+	if counter := st.state.GetRefund(); counter.IsUint64() && counter.Uint64() < refund {
+		refund = counter.Uint64()
+	}
+	// The refund is capped below the gas used, so this can't overflow the gas bought
+	st.refunded = refund
+	st.gas += refund
+
+	// Return eth for remaining gas (including the refund) to the sender account,
+	// exchanged at the original rate, along with the part of the gas bought in
+	// excess of the effective gas price. All of it is credited at once to keep
+	// the state journal small.
+	// 将剩余 gas（含退款）的 eth 一次性返还至发送方账户，按原汇率兑换。
 	sender := st.from() // err already checked
 	remaining := new(big.Int).Mul(new(big.Int).SetUint64(st.gas), st.gasPrice)
+	if excess := new(big.Int).Sub(st.gasFeeCap, st.gasPrice); excess.Sign() > 0 {
+		remaining.Add(remaining, excess.Mul(excess, new(big.Int).SetUint64(st.initialGas)))
+	}
 	st.state.AddBalance(sender.Address(), remaining)
 
-	// Apply refund counter, capped to half of the used gas.
-	// 应用退款计数器，上限为已用 gas 的一半。
-	uhalf := remaining.Div(st.gasUsed(), common.Big2)
-	refund := math.BigMin(uhalf, st.state.GetRefund())
-	st.gas += refund.Uint64()
-
-	st.state.AddBalance(sender.Address(), refund.Mul(refund, st.gasPrice))
-
 	// Also return remaining gas to the block gas counter so it is
 	// available for the next transaction.
 	st.gp.AddGas(new(big.Int).SetUint64(st.gas))
 }
 
+// GasRefunded returns the gas refunded to the sender by the last transition, as
+// capped by the chain rules, rather than the raw refund counter of the state.
+func (st *StateTransition) GasRefunded() uint64 {
+	return st.refunded
+}
+
+// EffectiveGasPrice returns the gas price paid by the sender of the message under
+// the given base fee: the fee cap if there's no fee market, otherwise the base
+// fee plus as much of the tip as the fee cap allows.
+func (st *StateTransition) EffectiveGasPrice(baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return new(big.Int).Set(st.gasFeeCap)
+	}
+	return math.BigMin(new(big.Int).Add(baseFee, st.gasTipCap), st.gasFeeCap)
+}
+
 // 计算已使用的 gas
-func (st *StateTransition) gasUsed() *big.Int {
-	return new(big.Int).Sub(st.initialGas, new(big.Int).SetUint64(st.gas))
+func (st *StateTransition) gasUsed() uint64 {
+	return st.initialGas - st.gas
 }
@@ -0,0 +1,818 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var (
+	transitionTestSender   = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	transitionTestContract = common.HexToAddress("0x2000000000000000000000000000000000000002")
+)
+
+// newTransitionTestEVM creates an EVM operating on a fresh in-memory state
+// database with the test sender pre-funded.
+func newTransitionTestEVM(config *params.ChainConfig, number *big.Int, cfg vm.Config) (*vm.EVM, *state.StateDB) {
+	db, _ := ethdb.NewMemDatabase()
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	statedb.AddBalance(transitionTestSender, big.NewInt(1000000000))
+
+	context := vm.Context{
+		CanTransfer: CanTransfer,
+		Transfer:    Transfer,
+		GetHash:     func(uint64) common.Hash { return common.Hash{} },
+		Origin:      transitionTestSender,
+		Coinbase:    common.HexToAddress("0xc0ffee"),
+		BlockNumber: new(big.Int).Set(number),
+		Time:        new(big.Int),
+		Difficulty:  new(big.Int),
+		GasLimit:    big.NewInt(10000000),
+		GasPrice:    big.NewInt(1),
+	}
+	return vm.NewEVM(context, statedb, config, cfg), statedb
+}
+
+// Tests that storage slots zeroed out during execution are reported, while
+// slots merely overwritten with a different nonzero value are not.
+func TestApplyMessageClears(t *testing.T) {
+	evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+
+	// SSTORE(1, 0); SSTORE(2, 7); STOP
+	statedb.SetCode(transitionTestContract, []byte{
+		byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x01, byte(vm.SSTORE),
+		byte(vm.PUSH1), 0x07, byte(vm.PUSH1), 0x02, byte(vm.SSTORE),
+		byte(vm.STOP),
+	})
+	statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+	statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(2)), common.BigToHash(big.NewInt(5)))
+
+	msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), nil, true)
+	cleared, _, _, failed, err := ApplyMessageClears(evm, msg, new(GasPool).AddGas(big.NewInt(100000)))
+	if err != nil || failed {
+		t.Fatalf("failed to apply message: failed %v, err %v", failed, err)
+	}
+	want := StorageSlot{Address: transitionTestContract, Slot: common.BigToHash(big.NewInt(1))}
+	if len(cleared) != 1 || cleared[0] != want {
+		t.Fatalf("cleared slot mismatch: have %v, want [%v]", cleared, want)
+	}
+	if statedb.GetRefund().Sign() == 0 {
+		t.Errorf("expected storage clearing refund")
+	}
+	// A tracer configured by the caller keeps tracing the execution
+	logger := vm.NewStructLogger(nil)
+	evm, statedb = newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{Debug: true, Tracer: logger})
+	statedb.SetCode(transitionTestContract, []byte{byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x01, byte(vm.SSTORE), byte(vm.STOP)})
+	statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+
+	cleared, _, _, failed, err = ApplyMessageClears(evm, msg, new(GasPool).AddGas(big.NewInt(100000)))
+	if err != nil || failed {
+		t.Fatalf("failed to apply traced message: failed %v, err %v", failed, err)
+	}
+	if len(cleared) != 1 || cleared[0] != want {
+		t.Errorf("traced cleared slot mismatch: have %v, want [%v]", cleared, want)
+	}
+	if logs := logger.StructLogs(); len(logs) != 4 {
+		t.Errorf("caller tracer step count mismatch: have %d, want %d", len(logs), 4)
+	}
+}
+
+// Tests that the intrinsic gas of a block sums up that of each transaction,
+// charging contract creations according to the homestead rules.
+func TestBlockIntrinsicGas(t *testing.T) {
+	txs := types.Transactions{
+		types.NewTransaction(0, transitionTestContract, new(big.Int), big.NewInt(100000), big.NewInt(1), []byte{0x00, 0x01, 0x02}),
+		types.NewContractCreation(1, new(big.Int), big.NewInt(100000), big.NewInt(1), []byte{0xff}),
+	}
+	block := types.NewBlock(&types.Header{}, txs, nil, nil)
+
+	tests := []struct {
+		homestead bool
+		gas       uint64
+	}{
+		{false, 2*params.TxGas + params.TxDataZeroGas + 3*params.TxDataNonZeroGas},
+		{true, params.TxGas + params.TxGasContractCreation + params.TxDataZeroGas + 3*params.TxDataNonZeroGas},
+	}
+	for i, tt := range tests {
+		gas, err := BlockIntrinsicGas(block, tt.homestead)
+		if err != nil {
+			t.Fatalf("test %d: failed to compute intrinsic gas: %v", i, err)
+		}
+		if gas.Uint64() != tt.gas {
+			t.Errorf("test %d: intrinsic gas mismatch: have %v, want %d", i, gas, tt.gas)
+		}
+	}
+}
+
+// Tests that the 64 bit intrinsic gas matches the big integer one, and that huge
+// data sizes are reported as an overflow instead of wrapping around.
+func TestIntrinsicGasUint64(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		creation bool
+		gas      uint64
+	}{
+		{nil, false, params.TxGas},
+		{nil, true, params.TxGasContractCreation},
+		{make([]byte, 10), false, params.TxGas + 10*params.TxDataZeroGas},
+		{bytes.Repeat([]byte{0xff}, 10), false, params.TxGas + 10*params.TxDataNonZeroGas},
+		{[]byte{0, 1, 0, 2}, true, params.TxGasContractCreation + 2*params.TxDataZeroGas + 2*params.TxDataNonZeroGas},
+	}
+	for i, tt := range tests {
+		gas, err := IntrinsicGasUint64(tt.data, tt.creation, true)
+		if err != nil {
+			t.Fatalf("test %d: failed to compute intrinsic gas: %v", i, err)
+		}
+		if gas != tt.gas {
+			t.Errorf("test %d: intrinsic gas mismatch: have %d, want %d", i, gas, tt.gas)
+		}
+		if bigGas := IntrinsicGas(tt.data, tt.creation, true); bigGas.Uint64() != gas {
+			t.Errorf("test %d: big intrinsic gas mismatch: have %v, want %d", i, bigGas, gas)
+		}
+	}
+	// Synthesize byte counts too large to allocate
+	for _, counts := range [][2]uint64{{0, math.MaxUint64 / params.TxDataNonZeroGas}, {math.MaxUint64 / 2, 0}, {math.MaxUint64 / params.TxDataZeroGas, 1}} {
+		if _, err := intrinsicGasUint64(counts[0], counts[1], false, true); err != ErrGasUintOverflow {
+			t.Errorf("counts %v: error mismatch: have %v, want %v", counts, err, ErrGasUintOverflow)
+		}
+	}
+}
+
+// Tests that the calldata gas breakdown of a mixed payload accounts for all the
+// data gas charged by IntrinsicGas.
+func TestCalldataGasBreakdown(t *testing.T) {
+	data := []byte{0x00, 0x01, 0x00, 0x00, 0xff, 0x10, 0x00}
+
+	zeroBytes, nonZeroBytes, zeroGas, nonZeroGas := CalldataGasBreakdown(data)
+	if zeroBytes != 4 || nonZeroBytes != 3 {
+		t.Fatalf("byte count mismatch: have (%d, %d), want (4, 3)", zeroBytes, nonZeroBytes)
+	}
+	if zeroGas != 4*params.TxDataZeroGas || nonZeroGas != 3*params.TxDataNonZeroGas {
+		t.Fatalf("gas mismatch: have (%d, %d), want (%d, %d)", zeroGas, nonZeroGas, 4*params.TxDataZeroGas, 3*params.TxDataNonZeroGas)
+	}
+	if total := IntrinsicGas(data, false, true).Uint64(); total != params.TxGas+zeroGas+nonZeroGas {
+		t.Errorf("intrinsic gas mismatch: have %d, want %d", total, params.TxGas+zeroGas+nonZeroGas)
+	}
+}
+
+// Tests that the default data gas strategy charges exactly what IntrinsicGas
+// does, while a floor strategy raises the cost of cheap data to its floor.
+func TestIntrinsicGasWithDataGas(t *testing.T) {
+	payloads := [][]byte{
+		nil,
+		{0x00},
+		{0xff},
+		{0x00, 0x01, 0x00, 0x00, 0xff, 0x10, 0x00},
+		make([]byte, 1024),
+		bytes.Repeat([]byte{0xff}, 1024),
+	}
+	for i, data := range payloads {
+		for _, creation := range []bool{false, true} {
+			have, err := IntrinsicGasWithDataGas(data, creation, true, DefaultDataGas)
+			if err != nil {
+				t.Fatalf("payload %d: failed to compute intrinsic gas: %v", i, err)
+			}
+			if want := IntrinsicGas(data, creation, true).Uint64(); have != want {
+				t.Errorf("payload %d, creation %v: default intrinsic gas mismatch: have %d, want %d", i, creation, have, want)
+			}
+		}
+	}
+	// A floor of 10 gas per token exceeds the 4 gas of zero bytes, but not the
+	// 68 gas (17 per token) of nonzero bytes
+	floor := FloorDataGas(10)
+	tests := []struct {
+		data []byte
+		gas  uint64
+	}{
+		{nil, 0},
+		{make([]byte, 10), 10 * 10},
+		{bytes.Repeat([]byte{0xff}, 10), 10 * params.TxDataNonZeroGas},
+		{[]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff}, (7 + 4) * 10},
+	}
+	for i, tt := range tests {
+		if have := floor(tt.data); have != tt.gas {
+			t.Errorf("test %d: floor data gas mismatch: have %d, want %d", i, have, tt.gas)
+		}
+		have, err := IntrinsicGasWithDataGas(tt.data, false, true, floor)
+		if err != nil {
+			t.Fatalf("test %d: failed to compute intrinsic gas: %v", i, err)
+		}
+		if have != params.TxGas+tt.gas {
+			t.Errorf("test %d: floored intrinsic gas mismatch: have %d, want %d", i, have, params.TxGas+tt.gas)
+		}
+	}
+	// Floors not fitting into 64 bits saturate instead of wrapping around
+	huge := FloorDataGas(math.MaxUint64 / 2)
+	if have := huge([]byte{0xff}); have != math.MaxUint64 {
+		t.Errorf("overflowing floor mismatch: have %d, want %d", have, uint64(math.MaxUint64))
+	}
+	if _, err := IntrinsicGasWithDataGas([]byte{0xff}, false, true, huge); err != ErrGasUintOverflow {
+		t.Errorf("overflowing floor error mismatch: have %v, want %v", err, ErrGasUintOverflow)
+	}
+}
+
+// Tests that messages are charged the data gas floor configured by the chain
+// from its activation block on, and the default data gas before it.
+func TestExecuteDataGasFloor(t *testing.T) {
+	floored := *params.TestChainConfig
+	floored.DataGasFloorBlock = big.NewInt(1)
+	floored.DataGasFloorPerToken = 10
+
+	tests := []struct {
+		number int64
+		data   []byte
+		gas    uint64
+	}{
+		{0, make([]byte, 10), params.TxGas + 10*params.TxDataZeroGas},
+		{1, make([]byte, 10), params.TxGas + 10*10},
+		{1, bytes.Repeat([]byte{0xff}, 10), params.TxGas + 10*params.TxDataNonZeroGas},
+	}
+	for i, tt := range tests {
+		evm, _ := newTransitionTestEVM(&floored, big.NewInt(tt.number), vm.Config{})
+		msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), tt.data, true)
+		result, err := NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(100000))).Execute()
+		if err != nil {
+			t.Fatalf("test %d: failed to execute message: %v", i, err)
+		}
+		if result.UsedGas != tt.gas {
+			t.Errorf("test %d: used gas mismatch: have %d, want %d", i, result.UsedGas, tt.gas)
+		}
+	}
+	// A floor block without a price per token leaves the default pricing in place
+	floored.DataGasFloorPerToken = 0
+
+	data := make([]byte, 10)
+	if have, want := DataGasFuncFor(&floored, big.NewInt(1))(data), DefaultDataGas(data); have != want {
+		t.Errorf("unpriced floor mismatch: have %d, want %d", have, want)
+	}
+}
+
+// Tests that contract creations are only charged the higher creation cost from
+// homestead on, while frontier creations pay the plain transaction cost.
+func TestIntrinsicGasContractCreation(t *testing.T) {
+	tests := []struct {
+		creation  bool
+		homestead bool
+		gas       uint64
+	}{
+		{false, false, params.TxGas},
+		{false, true, params.TxGas},
+		{true, false, params.TxGas},
+		{true, true, params.TxGasContractCreation},
+	}
+	for i, tt := range tests {
+		if gas := IntrinsicGas(nil, tt.creation, tt.homestead); gas.Uint64() != tt.gas {
+			t.Errorf("test %d: intrinsic gas mismatch: have %v, want %d", i, gas, tt.gas)
+		}
+	}
+	// Verify that applying an empty creation charges exactly the intrinsic gas
+	config := &params.ChainConfig{HomesteadBlock: big.NewInt(1)}
+	for number, want := range map[int64]uint64{0: params.TxGas, 1: params.TxGasContractCreation} {
+		evm, _ := newTransitionTestEVM(config, big.NewInt(number), vm.Config{})
+
+		msg := types.NewMessage(transitionTestSender, nil, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), nil, true)
+		_, gas, failed, err := ApplyMessage(evm, msg, new(GasPool).AddGas(big.NewInt(100000)))
+		if err != nil || failed {
+			t.Fatalf("block %d: failed to apply creation: failed %v, err %v", number, failed, err)
+		}
+		if gas.Uint64() != want {
+			t.Errorf("block %d: creation gas mismatch: have %v, want %d", number, gas, want)
+		}
+	}
+}
+
+// Tests that the net gas of a refund-generating message is the execution gas
+// minus the (capped) refund.
+func TestEstimateNetGas(t *testing.T) {
+	// SSTORE(1, 0) clearing a previously set slot
+	code := []byte{byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x01, byte(vm.SSTORE), byte(vm.STOP)}
+	newEVM := func() *vm.EVM {
+		evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+		statedb.SetCode(transitionTestContract, code)
+		statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+		return evm
+	}
+	msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), nil, true)
+
+	_, execGas, _, _, err := NewStateTransition(newEVM(), msg, new(GasPool).AddGas(big.NewInt(100000))).TransitionDb()
+	if err != nil {
+		t.Fatalf("failed to execute message: %v", err)
+	}
+	netGas, err := EstimateNetGas(newEVM(), msg, new(GasPool).AddGas(big.NewInt(100000)))
+	if err != nil {
+		t.Fatalf("failed to estimate net gas: %v", err)
+	}
+	if netGas >= execGas.Uint64() {
+		t.Fatalf("net gas not below execution gas: net %d, execution %v", netGas, execGas)
+	}
+	// The storage clearing refund exceeds the cap of half the execution gas
+	if want := execGas.Uint64() - execGas.Uint64()/2; netGas != want {
+		t.Errorf("net gas mismatch: have %d, want %d", netGas, want)
+	}
+}
+
+// Tests that under the fee market, legacy and dynamic fee messages paying the
+// same effective price settle to identical balances, with the base fee burnt and
+// only the tip credited to the miner.
+func TestStateTransitionFeeMarket(t *testing.T) {
+	var (
+		baseFee  = big.NewInt(7)
+		gas      = big.NewInt(100000)
+		coinbase = common.HexToAddress("0xc0ffee")
+	)
+	tests := []struct {
+		msg    types.Message
+		paid   int64 // Effective gas price paid by the sender
+		tipped int64 // Effective gas price credited to the miner
+		err    error
+	}{
+		{types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), gas, big.NewInt(10), nil, true), 10, 3, nil},
+		{types.NewDynamicFeeMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), gas, big.NewInt(10), big.NewInt(3), nil, true), 10, 3, nil},
+		{types.NewDynamicFeeMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), gas, big.NewInt(20), big.NewInt(3), nil, true), 10, 3, nil},
+		{types.NewDynamicFeeMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), gas, big.NewInt(8), big.NewInt(3), nil, true), 8, 1, nil},
+		{types.NewDynamicFeeMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), gas, big.NewInt(10), big.NewInt(11), nil, true), 0, 0, ErrTipAboveFeeCap},
+		{types.NewDynamicFeeMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), gas, big.NewInt(6), big.NewInt(1), nil, true), 0, 0, ErrFeeCapTooLow},
+	}
+	for i, tt := range tests {
+		evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+		evm.BaseFee = baseFee
+		before := statedb.GetBalance(transitionTestSender)
+
+		_, used, _, err := ApplyMessage(evm, tt.msg, new(GasPool).AddGas(gas))
+		if err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if used.Uint64() != params.TxGas {
+			t.Fatalf("test %d: gas used mismatch: have %v, want %d", i, used, params.TxGas)
+		}
+		paid := new(big.Int).Sub(before, statedb.GetBalance(transitionTestSender))
+		if want := new(big.Int).Mul(used, big.NewInt(tt.paid)); paid.Cmp(want) != 0 {
+			t.Errorf("test %d: sender payment mismatch: have %v, want %v", i, paid, want)
+		}
+		if have, want := statedb.GetBalance(coinbase), new(big.Int).Mul(used, big.NewInt(tt.tipped)); have.Cmp(want) != 0 {
+			t.Errorf("test %d: miner tip mismatch: have %v, want %v", i, have, want)
+		}
+	}
+}
+
+// Tests that the gas refund is capped at half the used gas before London and at
+// a fifth of it afterwards, as per EIP-3529.
+func TestRefundQuotient(t *testing.T) {
+	london := *params.TestChainConfig
+	london.LondonBlock = big.NewInt(0)
+
+	tests := []struct {
+		config   *params.ChainConfig
+		quotient uint64
+	}{
+		{params.TestChainConfig, params.RefundQuotient},
+		{&london, params.RefundQuotientEIP3529},
+	}
+	for i, tt := range tests {
+		evm, statedb := newTransitionTestEVM(tt.config, new(big.Int), vm.Config{})
+
+		// SSTORE(1, 0) clearing a previously set slot, refunding more than either cap
+		statedb.SetCode(transitionTestContract, []byte{byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x01, byte(vm.SSTORE), byte(vm.STOP)})
+		statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+
+		msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), nil, true)
+		_, required, used, failed, err := NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(100000))).TransitionDb()
+		if err != nil || failed {
+			t.Fatalf("test %d: failed to execute message: failed %v, err %v", i, failed, err)
+		}
+		if params.SstoreRefundGas <= required.Uint64()/tt.quotient {
+			t.Fatalf("test %d: refund %d below the cap %d", i, params.SstoreRefundGas, required.Uint64()/tt.quotient)
+		}
+		if want := required.Uint64() - required.Uint64()/tt.quotient; used.Uint64() != want {
+			t.Errorf("test %d: gas used mismatch: have %v, want %d", i, used, want)
+		}
+	}
+}
+
+// Tests that the execution result of a message matches the legacy tuple returned
+// by TransitionDb, for successful, failing and refunding executions.
+func TestExecuteMatchesTransitionDb(t *testing.T) {
+	tests := []struct {
+		code []byte
+		data []byte
+	}{
+		// Plain value transfer
+		{nil, nil},
+		// Transfer with calldata
+		{nil, []byte{0x00, 0x01, 0x02}},
+		// Invalid jump
+		{[]byte{byte(vm.PUSH1), 0x00, byte(vm.JUMP)}, nil},
+		// Storage clearing refund
+		{[]byte{byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x01, byte(vm.SSTORE), byte(vm.STOP)}, nil},
+		// Return data
+		{[]byte{byte(vm.PUSH1), 0x2a, byte(vm.PUSH1), 0x00, byte(vm.MSTORE), byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x00, byte(vm.RETURN)}, nil},
+	}
+	for i, tt := range tests {
+		newTransition := func() *StateTransition {
+			evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+			statedb.SetCode(transitionTestContract, tt.code)
+			statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+			msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), tt.data, true)
+			return NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(100000)))
+		}
+		ret, required, used, failed, err := newTransition().TransitionDb()
+		if err != nil {
+			t.Fatalf("test %d: failed to transition state: %v", i, err)
+		}
+		result, err := newTransition().Execute()
+		if err != nil {
+			t.Fatalf("test %d: failed to execute message: %v", i, err)
+		}
+		if !bytes.Equal(result.ReturnData, ret) {
+			t.Errorf("test %d: return data mismatch: have %x, want %x", i, result.ReturnData, ret)
+		}
+		if result.RequiredGas != required.Uint64() || result.UsedGas != used.Uint64() {
+			t.Errorf("test %d: gas mismatch: have required %d used %d, want required %v used %v", i, result.RequiredGas, result.UsedGas, required, used)
+		}
+		if result.Failed != failed || (result.Err != nil) != failed {
+			t.Errorf("test %d: failure mismatch: have %v (err %v), want %v", i, result.Failed, result.Err, failed)
+		}
+	}
+	// Consensus errors are returned without a result
+	evm, _ := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+	msg := types.NewMessage(transitionTestSender, &transitionTestContract, 1, new(big.Int), big.NewInt(100000), big.NewInt(1), nil, true)
+	if result, err := NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(100000))).Execute(); err != ErrNonceTooHigh || result != nil {
+		t.Errorf("nonce error mismatch: have %v (result %v), want %v", err, result, ErrNonceTooHigh)
+	}
+}
+
+// Tests that since Shanghai contract creations are rejected if their init code
+// exceeds the EIP-3860 limit and are otherwise charged for it per word, while
+// message calls and pre-fork blocks remain unaffected.
+func TestInitCodeLimit(t *testing.T) {
+	shanghai := *params.TestChainConfig
+	shanghai.ShanghaiBlock = big.NewInt(1)
+
+	apply := func(number int64, creation bool, size int) (uint64, error) {
+		evm, _ := newTransitionTestEVM(&shanghai, big.NewInt(number), vm.Config{})
+
+		to := &transitionTestContract
+		if creation {
+			to = nil
+		}
+		msg := types.NewMessage(transitionTestSender, to, 0, new(big.Int), big.NewInt(1000000), big.NewInt(1), make([]byte, size), true)
+		result, err := NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(1000000))).Execute()
+		if err != nil {
+			return 0, err
+		}
+		return result.UsedGas, nil
+	}
+	tests := []struct {
+		number   int64
+		creation bool
+		size     int
+		err      error
+	}{
+		{1, true, params.MaxInitCodeSize, nil},
+		{1, true, params.MaxInitCodeSize + 1, ErrMaxInitCodeSizeExceeded},
+		{0, true, params.MaxInitCodeSize + 1, nil},
+		{1, false, params.MaxInitCodeSize + 1, nil},
+	}
+	for i, tt := range tests {
+		if _, err := apply(tt.number, tt.creation, tt.size); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	// Init code is charged per started word after the fork only
+	for _, size := range []int{0, 1, 32, 33, params.MaxInitCodeSize} {
+		pre, err := apply(0, true, size)
+		if err != nil {
+			t.Fatalf("size %d: failed to create contract pre-fork: %v", size, err)
+		}
+		post, err := apply(1, true, size)
+		if err != nil {
+			t.Fatalf("size %d: failed to create contract post-fork: %v", size, err)
+		}
+		if want := uint64(size+31) / 32 * params.InitCodeWordGas; post-pre != want {
+			t.Errorf("size %d: init code gas mismatch: have %d, want %d", size, post-pre, want)
+		}
+	}
+}
+
+// Tests that messages whose sender can afford the gas but not the gas and value
+// together are rejected before execution, message simulations included.
+func TestInsufficientFundsForTransfer(t *testing.T) {
+	// The sender is funded with 1e9, the gas costs 21000 * 1000 = 2.1e7
+	tests := []struct {
+		value      int64
+		checkNonce bool
+		err        error
+	}{
+		{979000000, true, nil},
+		{979000001, true, errInsufficientFundsForTransfer},
+		{979000001, false, errInsufficientFundsForTransfer},
+		{2000000000, true, errInsufficientFundsForTransfer},
+	}
+	for i, tt := range tests {
+		evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+
+		msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, big.NewInt(tt.value), big.NewInt(21000), big.NewInt(1000), nil, tt.checkNonce)
+		gp := new(GasPool).AddGas(big.NewInt(21000))
+		if _, _, _, err := ApplyMessage(evm, msg, gp); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if tt.err != nil && statedb.GetBalance(transitionTestContract).Sign() != 0 {
+			t.Errorf("test %d: value transferred despite error", i)
+		}
+	}
+}
+
+// Tests that after a transition the refunded gas reflects the capped refund and
+// the effective gas price is the base fee plus the tip, bounded by the fee cap.
+func TestTransitionGasAccessors(t *testing.T) {
+	// SSTORE(1, 0) clearing a previously set slot, refunding more than the cap
+	evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+	statedb.SetCode(transitionTestContract, []byte{byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x01, byte(vm.SSTORE), byte(vm.STOP)})
+	statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+
+	msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), nil, true)
+	st := NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(100000)))
+	_, required, used, _, err := st.TransitionDb()
+	if err != nil {
+		t.Fatalf("failed to execute message: %v", err)
+	}
+	if refunded := st.GasRefunded(); refunded != required.Uint64()/2 || refunded >= params.SstoreRefundGas {
+		t.Errorf("refunded gas mismatch: have %d, want %d", refunded, required.Uint64()/2)
+	}
+	if refunded := st.GasRefunded(); required.Uint64()-used.Uint64() != refunded {
+		t.Errorf("refunded gas inconsistent with usage: required %v, used %v, refunded %d", required, used, refunded)
+	}
+	// Dynamic fee messages pay min(feeCap, baseFee+tip)
+	baseFee := big.NewInt(7)
+	tests := []struct {
+		feeCap, tipCap int64
+		price          int64
+	}{
+		{10, 3, 10},
+		{20, 3, 10},
+		{8, 3, 8},
+		{7, 0, 7},
+	}
+	for i, tt := range tests {
+		evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+		evm.BaseFee = baseFee
+		before := statedb.GetBalance(transitionTestSender)
+
+		msg := types.NewDynamicFeeMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(tt.feeCap), big.NewInt(tt.tipCap), nil, true)
+		st := NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(100000)))
+		_, _, used, _, err := st.TransitionDb()
+		if err != nil {
+			t.Fatalf("test %d: failed to execute message: %v", i, err)
+		}
+		price := st.EffectiveGasPrice(baseFee)
+		if price.Int64() != tt.price {
+			t.Errorf("test %d: effective gas price mismatch: have %v, want %d", i, price, tt.price)
+		}
+		if paid := new(big.Int).Sub(before, statedb.GetBalance(transitionTestSender)); paid.Cmp(new(big.Int).Mul(used, price)) != 0 {
+			t.Errorf("test %d: sender payment mismatch: have %v, want %v", i, paid, new(big.Int).Mul(used, price))
+		}
+		if price := st.EffectiveGasPrice(nil); price.Int64() != tt.feeCap {
+			t.Errorf("test %d: legacy gas price mismatch: have %v, want %d", i, price, tt.feeCap)
+		}
+	}
+}
+
+// Tests that buying gas close to the uint64 limit is refused with an error
+// instead of silently wrapping the gas counter, and that the combined cost of
+// the gas and value can't overflow either.
+func TestBuyGasOverflow(t *testing.T) {
+	maxGas := new(big.Int).SetUint64(math.MaxUint64)
+
+	evm, _ := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+	msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), maxGas, new(big.Int), nil, true)
+	gp := new(GasPool).AddGas(new(big.Int).Mul(maxGas, big.NewInt(2)))
+
+	st := NewStateTransition(evm, msg, gp)
+	if err := st.buyGas(); err != nil {
+		t.Fatalf("failed to buy max gas: %v", err)
+	}
+	if err := st.buyGas(); err != ErrGasUintOverflow {
+		t.Fatalf("second buy error mismatch: have %v, want %v", err, ErrGasUintOverflow)
+	}
+	if st.gas != math.MaxUint64 || st.initialGas != math.MaxUint64 {
+		t.Errorf("gas modified by failed buy: gas %d, initial %d", st.gas, st.initialGas)
+	}
+	if (*big.Int)(gp).Cmp(maxGas) != 0 {
+		t.Errorf("gas pool modified by failed buy: have %v, want %v", gp, maxGas)
+	}
+	// Gas limits beyond 64 bits can never be bought
+	msg = types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), new(big.Int).Add(maxGas, big.NewInt(1)), new(big.Int), nil, true)
+	if err := NewStateTransition(evm, msg, gp).buyGas(); err != vm.ErrOutOfGas {
+		t.Errorf("oversized gas error mismatch: have %v, want %v", err, vm.ErrOutOfGas)
+	}
+	// Gas cost and value together must fit into 256 bits
+	price := new(big.Int).Lsh(big.NewInt(1), 190)
+	value := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	msg = types.NewMessage(transitionTestSender, &transitionTestContract, 0, value, maxGas, price, nil, true)
+	if err := NewStateTransition(evm, msg, gp).buyGas(); err != errCostOverflow {
+		t.Errorf("cost overflow error mismatch: have %v, want %v", err, errCostOverflow)
+	}
+}
+
+// Tests that estimating the gas of a message reports the same gas and failure
+// as actually applying it, without leaving any trace in the state or gas pool.
+func TestEstimateGas(t *testing.T) {
+	tests := [][]byte{
+		// SSTORE(1, 0) clearing a previously set slot, earning a refund
+		{byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x01, byte(vm.SSTORE), byte(vm.STOP)},
+		// Invalid jump
+		{byte(vm.PUSH1), 0x00, byte(vm.JUMP)},
+	}
+	for i, code := range tests {
+		evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+		statedb.SetCode(transitionTestContract, code)
+		statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+		root := statedb.IntermediateRoot(false)
+
+		msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, big.NewInt(1000), big.NewInt(100000), big.NewInt(1), nil, true)
+		gp := new(GasPool).AddGas(big.NewInt(100000))
+
+		estimate, estimateFailed, err := EstimateGas(evm, msg, gp)
+		if err != nil {
+			t.Fatalf("test %d: failed to estimate gas: %v", i, err)
+		}
+		if have := statedb.IntermediateRoot(false); have != root {
+			t.Errorf("test %d: state modified by estimation: have root %x, want %x", i, have, root)
+		}
+		if (*big.Int)(gp).Cmp(big.NewInt(100000)) != 0 {
+			t.Errorf("test %d: gas pool modified by estimation: have %v, want %d", i, gp, 100000)
+		}
+		_, used, failed, err := ApplyMessage(evm, msg, gp)
+		if err != nil {
+			t.Fatalf("test %d: failed to apply message: %v", i, err)
+		}
+		if estimate != used.Uint64() || estimateFailed != failed {
+			t.Errorf("test %d: estimate mismatch: have %d (failed %v), want %v (failed %v)", i, estimate, estimateFailed, used, failed)
+		}
+	}
+}
+
+// revertCode returns bytecode reverting with the given payload as return data.
+func revertCode(payload []byte) []byte {
+	var code []byte
+	for i := 0; i < len(payload); i += 32 {
+		word := make([]byte, 32)
+		copy(word, payload[i:])
+		code = append(code, byte(vm.PUSH32))
+		code = append(code, word...)
+		code = append(code, byte(vm.PUSH1), byte(i), byte(vm.MSTORE))
+	}
+	return append(code, byte(vm.PUSH1), byte(len(payload)), byte(vm.PUSH1), 0x00, byte(vm.REVERT))
+}
+
+// Tests that the return data of a reverted execution is surfaced, so that the
+// revert reason can be decoded, while other failures return no data.
+func TestRevertReason(t *testing.T) {
+	definition, _ := abi.JSON(strings.NewReader(`[{ "type" : "function", "name" : "Error", "inputs" : [ { "name" : "reason", "type" : "string" } ] }]`))
+	payload, _ := definition.Pack("Error", "insufficient allowance")
+
+	tests := []struct {
+		code []byte
+		ret  []byte
+	}{
+		{revertCode(payload), payload},
+		{revertCode(nil), nil},
+		{[]byte{byte(vm.PUSH1), 0x00, byte(vm.JUMP)}, nil},
+	}
+	for i, tt := range tests {
+		evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+		statedb.SetCode(transitionTestContract, tt.code)
+
+		msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), nil, true)
+		result, err := NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(100000))).Execute()
+		if err != nil {
+			t.Fatalf("test %d: failed to execute message: %v", i, err)
+		}
+		if !result.Failed {
+			t.Fatalf("test %d: execution didn't fail", i)
+		}
+		if !bytes.Equal(result.ReturnData, tt.ret) {
+			t.Errorf("test %d: return data mismatch: have %x, want %x", i, result.ReturnData, tt.ret)
+		}
+	}
+	// The surfaced revert data should decode into the reason
+	evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+	statedb.SetCode(transitionTestContract, revertCode(payload))
+
+	msg := types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(1), nil, true)
+	ret, _, _, _, err := NewStateTransition(evm, msg, new(GasPool).AddGas(big.NewInt(100000))).TransitionDb()
+	if err != nil {
+		t.Fatalf("failed to transition state: %v", err)
+	}
+	if reason, err := abi.UnpackRevert(ret); err != nil || reason != "insufficient allowance" {
+		t.Errorf("revert reason mismatch: have %q (err %v), want %q", reason, err, "insufficient allowance")
+	}
+	if _, err := abi.UnpackRevert(nil); err == nil {
+		t.Errorf("expected error unpacking empty revert")
+	}
+}
+
+// Tests that call messages run regardless of the current nonce of the sender.
+func TestCallMessageNonce(t *testing.T) {
+	for _, nonce := range []uint64{0, 1, 5} {
+		evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+		statedb.SetNonce(transitionTestSender, nonce)
+
+		msg := types.NewCallMessage(transitionTestSender, &transitionTestContract, big.NewInt(100000), big.NewInt(1), big.NewInt(1000), nil)
+		if msg.CheckNonce() || msg.Nonce() != 0 {
+			t.Fatalf("call message nonce mismatch: have %d (checked %v), want 0 (unchecked)", msg.Nonce(), msg.CheckNonce())
+		}
+		if _, _, failed, err := ApplyMessage(evm, msg, new(GasPool).AddGas(big.NewInt(100000))); err != nil || failed {
+			t.Fatalf("nonce %d: failed to apply call message: failed %v, err %v", nonce, failed, err)
+		}
+		if have := statedb.GetBalance(transitionTestContract); have.Cmp(big.NewInt(1000)) != 0 {
+			t.Errorf("nonce %d: value not transferred: have %v, want %d", nonce, have, 1000)
+		}
+	}
+}
+
+// balanceCreditCounter is a state database counting the balance credits of an
+// account.
+type balanceCreditCounter struct {
+	vm.StateDB
+	addr    common.Address
+	credits int
+}
+
+func (db *balanceCreditCounter) AddBalance(addr common.Address, amount *big.Int) {
+	if addr == db.addr {
+		db.credits++
+	}
+	db.StateDB.AddBalance(addr, amount)
+}
+
+// Tests that refundGas credits the sender once for the remaining gas, the
+// capped refund and the excess over the effective gas price together.
+func TestRefundGasSingleCredit(t *testing.T) {
+	tests := []struct {
+		msg     types.Message
+		baseFee *big.Int
+		price   int64 // Effective gas price paid by the sender
+	}{
+		{types.NewMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(3), nil, true), nil, 3},
+		{types.NewDynamicFeeMessage(transitionTestSender, &transitionTestContract, 0, new(big.Int), big.NewInt(100000), big.NewInt(20), big.NewInt(3), nil, true), big.NewInt(7), 10},
+	}
+	for i, tt := range tests {
+		evm, statedb := newTransitionTestEVM(params.TestChainConfig, new(big.Int), vm.Config{})
+
+		// SSTORE(1, 0) clearing a previously set slot, earning a refund
+		statedb.SetCode(transitionTestContract, []byte{byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x01, byte(vm.SSTORE), byte(vm.STOP)})
+		statedb.SetState(transitionTestContract, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+		before := statedb.GetBalance(transitionTestSender)
+
+		counter := &balanceCreditCounter{StateDB: statedb, addr: transitionTestSender}
+		evm = vm.NewEVM(evm.Context, counter, params.TestChainConfig, vm.Config{})
+		evm.BaseFee = tt.baseFee
+
+		st := NewStateTransition(evm, tt.msg, new(GasPool).AddGas(big.NewInt(100000)))
+		_, _, used, _, err := st.TransitionDb()
+		if err != nil {
+			t.Fatalf("test %d: failed to execute message: %v", i, err)
+		}
+		if st.GasRefunded() == 0 {
+			t.Fatalf("test %d: no gas refunded", i)
+		}
+		if counter.credits != 1 {
+			t.Errorf("test %d: sender credit count mismatch: have %d, want 1", i, counter.credits)
+		}
+		paid := new(big.Int).Sub(before, statedb.GetBalance(transitionTestSender))
+		if want := new(big.Int).Mul(used, big.NewInt(tt.price)); paid.Cmp(want) != 0 {
+			t.Errorf("test %d: sender payment mismatch: have %v, want %v", i, paid, want)
+		}
+	}
+}
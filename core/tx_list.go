@@ -17,16 +17,27 @@
 package core
 
 import (
+	"bytes"
 	"container/heap"
+	"errors"
+	"io"
 	"math"
 	"math/big"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
+// errDuplicateNonce is returned when decoding a transaction list containing more
+// than one transaction with the same nonce.
+var errDuplicateNonce = errors.New("duplicate nonce in transaction list")
+
 // nonceHeap is a heap.Interface implementation over 64bit unsigned integers for
 // retrieving sorted transactions from the possibly gapped future queue.
 // nonceHeap 是一个基于 64 位无符号整数的 heap.Interface 实现，
@@ -60,6 +71,8 @@ type txSortedMap struct {
 	index *nonceHeap                    // Heap of nonces of all the stored transactions (non-strict mode)
 	// 用来缓存已经排好序的交易
 	cache types.Transactions            // Cache of the transactions already sorted
+	tags  map[uint64]string             // Optional metadata tags of the stored transactions
+	last  *types.Transaction            // Transaction with the highest nonce (nil if unknown)
 }
 
 // newTxSortedMap creates a new nonce-sorted transaction map.
@@ -77,6 +90,12 @@ func (m *txSortedMap) Get(nonce uint64) *types.Transaction {
 	return m.items[nonce]
 }
 
+// Has returns whether a transaction with the given nonce is stored in the map.
+func (m *txSortedMap) Has(nonce uint64) bool {
+	_, ok := m.items[nonce]
+	return ok
+}
+
 // Put inserts a new transaction into the map, also updating the map's nonce
 // index. If a transaction already exists with the same nonce, it's overwritten.
 // 把一个新的交易插入到 map 中，同时更新 map 的 nonce 索引。
@@ -86,7 +105,69 @@ func (m *txSortedMap) Put(tx *types.Transaction) {
 	if m.items[nonce] == nil {
 		heap.Push(m.index, nonce)
 	}
+	// Track the highest nonce if it's known (or trivially the only one)
+	if (m.last != nil && nonce >= m.last.Nonce()) || len(m.items) == 0 {
+		m.last = tx
+	}
 	m.items[nonce], m.cache = tx, nil
+	delete(m.tags, nonce)
+}
+
+// PutTagged inserts a new transaction into the map just like Put, but also
+// associates an arbitrary tag with it (e.g. its submission source). The tag is
+// dropped together with the transaction, or if it's overwritten.
+func (m *txSortedMap) PutTagged(tx *types.Transaction, tag string) {
+	m.Put(tx)
+	if m.tags == nil {
+		m.tags = make(map[uint64]string)
+	}
+	m.tags[tx.Nonce()] = tag
+}
+
+// Merge inserts all the transactions of another map into this one, carrying over
+// their tags. If both maps hold a transaction with the same nonce, onConflict
+// picks the one to keep (the incoming one overwrites if onConflict is nil). The
+// nonce index is rebuilt once at the end instead of being updated per insert.
+func (m *txSortedMap) Merge(other *txSortedMap, onConflict func(existing, incoming *types.Transaction) *types.Transaction) {
+	// The highest nonce stays known only if it was known (or trivially empty)
+	known := m.last != nil || len(m.items) == 0
+	for nonce, tx := range other.items {
+		if existing, ok := m.items[nonce]; ok {
+			if onConflict != nil {
+				tx = onConflict(existing, tx)
+			}
+			if tx == existing {
+				continue
+			}
+			delete(m.tags, nonce)
+		} else {
+			*m.index = append(*m.index, nonce)
+		}
+		m.items[nonce] = tx
+		if tag, ok := other.tags[nonce]; ok && tx == other.items[nonce] {
+			if m.tags == nil {
+				m.tags = make(map[uint64]string)
+			}
+			m.tags[nonce] = tag
+		}
+		if known && (m.last == nil || nonce >= m.last.Nonce()) {
+			m.last = tx
+		}
+	}
+	heap.Init(m.index)
+	m.cache = nil
+}
+
+// FilterByTag removes all transactions from the map that were inserted with the
+// given tag, returning them for any post-removal maintenance.
+func (m *txSortedMap) FilterByTag(tag string) types.Transactions {
+	if len(m.tags) == 0 {
+		return nil
+	}
+	return m.Filter(func(tx *types.Transaction) bool {
+		t, ok := m.tags[tx.Nonce()]
+		return ok && t == tag
+	})
 }
 
 // Forward removes all transactions from the map with a nonce lower than the
@@ -101,17 +182,22 @@ func (m *txSortedMap) Forward(threshold uint64) types.Transactions {
 		nonce := heap.Pop(m.index).(uint64)
 		removed = append(removed, m.items[nonce])
 		delete(m.items, nonce)
+		delete(m.tags, nonce)
 	}
 	// If we had a cached order, shift the front
 	// cache 是排好序的交易。
 	if m.cache != nil {
 		m.cache = m.cache[len(removed):]
 	}
+	if m.last != nil && m.last.Nonce() < threshold {
+		m.last = nil
+	}
 	return removed
 }
 
 // Filter iterates over the list of transactions and removes all of them for which
-// the specified function evaluates to true.
+// the specified function evaluates to true. The removed transactions are returned
+// sorted by nonce.
 // Filter，删除所有令 filter 函数调用返回 true 的交易，并返回那些交易。
 func (m *txSortedMap) Filter(filter func(*types.Transaction) bool) types.Transactions {
 	var removed types.Transactions
@@ -121,6 +207,7 @@ func (m *txSortedMap) Filter(filter func(*types.Transaction) bool) types.Transac
 		if filter(tx) {
 			removed = append(removed, tx)
 			delete(m.items, nonce)
+			delete(m.tags, nonce)
 		}
 	}
 	// If transactions were removed, the heap and cache are ruined
@@ -134,6 +221,12 @@ func (m *txSortedMap) Filter(filter func(*types.Transaction) bool) types.Transac
 		heap.Init(m.index)
 		// 设置 cache 为 nil
 		m.cache = nil
+
+		if m.last != nil && m.items[m.last.Nonce()] == nil {
+			m.last = nil
+		}
+		// Return the removed transactions in a deterministic order
+		sort.Sort(types.TxByNonce(removed))
 	}
 	return removed
 }
@@ -156,11 +249,18 @@ func (m *txSortedMap) Cap(threshold int) types.Transactions {
 	for size := len(m.items); size > threshold; size-- {
 		drops = append(drops, m.items[(*m.index)[size-1]])
 		delete(m.items, (*m.index)[size-1])
+		delete(m.tags, (*m.index)[size-1])
 	}
 	*m.index = (*m.index)[:threshold]
 	// 重建堆
 	heap.Init(m.index)
 
+	// The index was sorted, so the highest remaining nonce is known
+	m.last = nil
+	if threshold > 0 {
+		m.last = m.items[(*m.index)[threshold-1]]
+	}
+
 	// If we had a cache, shift the back
 	if m.cache != nil {
 		m.cache = m.cache[:len(m.cache)-len(drops)]
@@ -168,6 +268,40 @@ func (m *txSortedMap) Cap(threshold int) types.Transactions {
 	return drops
 }
 
+// CapByPrice places a hard limit on the number of items like Cap, but drops the
+// lowest priced transactions instead of the highest nonce'd ones, returning all
+// transactions dropped. Equally priced transactions are dropped by decreasing
+// nonce.
+//
+// Note, the remaining transactions are not necessarily contiguous anymore, so
+// this method is only meant for non-strict lists.
+func (m *txSortedMap) CapByPrice(threshold int) types.Transactions {
+	// Short circuit if the number of items is under the limit
+	if len(m.items) <= threshold {
+		return nil
+	}
+	// Otherwise sort the transactions by price and drop the cheapest ones
+	sorted := m.Flatten()
+	sort.Stable(types.TxByPrice(sorted))
+
+	drops := sorted[threshold:]
+	for _, tx := range drops {
+		delete(m.items, tx.Nonce())
+		delete(m.tags, tx.Nonce())
+	}
+	*m.index = (*m.index)[:0]
+	for nonce := range m.items {
+		*m.index = append(*m.index, nonce)
+	}
+	heap.Init(m.index)
+
+	m.cache = nil
+	if m.last != nil && m.items[m.last.Nonce()] == nil {
+		m.last = nil
+	}
+	return drops
+}
+
 // Remove deletes a transaction from the maintained map, returning whether the
 // transaction was found.
 // Remove 从维护的映射中删除一个交易，返回是否找到该交易。
@@ -185,8 +319,12 @@ func (m *txSortedMap) Remove(nonce uint64) bool {
 		}
 	}
 	delete(m.items, nonce)
+	delete(m.tags, nonce)
 	m.cache = nil
 
+	if m.last != nil && m.last.Nonce() == nonce {
+		m.last = nil
+	}
 	return true
 }
 
@@ -200,23 +338,83 @@ func (m *txSortedMap) Remove(nonce uint64) bool {
 // 注意，请注意，所有具有低于 start 的 nonce 的交易也将被返回，以防止进入和无效状态。
 // 这不是应该发生的事情，而是自我纠正而不是失败！
 func (m *txSortedMap) Ready(start uint64) types.Transactions {
+	return m.ReadyN(start, len(m.items))
+}
+
+// ReadyN retrieves at most max sequentially increasing transactions starting at
+// the provided nonce, just like Ready does. Any further ready transactions are
+// left in the map.
+func (m *txSortedMap) ReadyN(start uint64, max int) types.Transactions {
 	// Short circuit if no transactions are available
-	if m.index.Len() == 0 || (*m.index)[0] > start {
+	if max <= 0 || m.index.Len() == 0 || (*m.index)[0] > start {
 		return nil
 	}
 	// Otherwise start accumulating incremental transactions
 	// 从最小的开始，一个一个的增加
 	var ready types.Transactions
-	for next := (*m.index)[0]; m.index.Len() > 0 && (*m.index)[0] == next; next++ {
+	for next := (*m.index)[0]; len(ready) < max && m.index.Len() > 0 && (*m.index)[0] == next; next++ {
 		ready = append(ready, m.items[next])
 		delete(m.items, next)
+		delete(m.tags, next)
 		heap.Pop(m.index)
 	}
-	m.cache = nil
-
+	// The lowest nonces were removed, so a cached order only needs its front shifted
+	if m.cache != nil {
+		m.cache = m.cache[len(ready):]
+	}
+	if m.last != nil && m.items[m.last.Nonce()] == nil {
+		m.last = nil
+	}
 	return ready
 }
 
+// LongestRun reports the length of the contiguous nonce sequence starting at the
+// provided nonce, along with the first nonce following it, without removing any
+// transactions. It allows checking how much Ready would return beforehand.
+func (m *txSortedMap) LongestRun(start uint64) (length int, endNonce uint64) {
+	for endNonce = start; m.items[endNonce] != nil; endNonce++ {
+		length++
+	}
+	return length, endNonce
+}
+
+// Rough memory costs used by ApproxMemoryBytes for the bookkeeping overhead of
+// the map, on top of the transactions' own encoded sizes.
+const (
+	txSortedMapEntrySize = 48  // Approximate bytes per nonce->transaction map entry
+	txObjectOverhead     = 256 // Approximate bytes of decoded fields and caches per transaction
+)
+
+// ApproxMemoryBytes estimates the number of bytes held by the map, including
+// the hash map and index overheads, the sorted cache and the transactions'
+// own data. It is a rough figure meant for monitoring, not exact accounting.
+func (m *txSortedMap) ApproxMemoryBytes() int {
+	size := len(m.items)*txSortedMapEntrySize + cap(*m.index)*8 + cap(m.cache)*8
+	for _, tx := range m.items {
+		size += txObjectOverhead + int(tx.Size())
+	}
+	return size
+}
+
+// LastElement returns the transaction with the highest nonce in the map without
+// removing it, or nil if the map is empty. The maximum is tracked across
+// insertions, so the lookup is usually O(1), falling back to the sorted cache or
+// a linear scan only after the previous maximum was removed.
+func (m *txSortedMap) LastElement() *types.Transaction {
+	if m.last == nil && len(m.items) > 0 {
+		if m.cache != nil {
+			m.last = m.cache[len(m.cache)-1]
+		} else {
+			for _, tx := range m.items {
+				if m.last == nil || tx.Nonce() > m.last.Nonce() {
+					m.last = tx
+				}
+			}
+		}
+	}
+	return m.last
+}
+
 // Len returns the length of the transaction map.
 func (m *txSortedMap) Len() int {
 	return len(m.items)
@@ -228,6 +426,37 @@ func (m *txSortedMap) Len() int {
 // Flatten 返回一个基于 nonce 排序的交易列表。
 // 并缓存到 cache 字段里面，以便在没有修改的情况下反复使用。
 func (m *txSortedMap) Flatten() types.Transactions {
+	// Copy the cache to prevent accidental modifications
+	cache := m.flatten()
+	txs := make(types.Transactions, len(cache))
+	copy(txs, cache)
+	return txs
+}
+
+// Range calls fn for each transaction in the map in nonce-incrementing order,
+// stopping early if fn returns false. Unlike Flatten, no copy of the sorted
+// transactions is made. The map must not be modified during the iteration.
+func (m *txSortedMap) Range(fn func(*types.Transaction) bool) {
+	for _, tx := range m.flatten() {
+		if !fn(tx) {
+			return
+		}
+	}
+}
+
+// At returns the transaction at the given position of the nonce-sorted contents,
+// or nil if the index is out of range. The sorting is cached, so only the first
+// lookup after a modification needs to sort the transactions.
+func (m *txSortedMap) At(index int) *types.Transaction {
+	if index < 0 || index >= len(m.items) {
+		return nil
+	}
+	return m.flatten()[index]
+}
+
+// flatten returns the cached nonce-sorted transactions, creating and caching
+// them first if needed. The returned slice must not be modified.
+func (m *txSortedMap) flatten() types.Transactions {
 	// If the sorting was not cached yet, create and cache it
 	if m.cache == nil {
 		m.cache = make(types.Transactions, 0, len(m.items))
@@ -236,9 +465,115 @@ func (m *txSortedMap) Flatten() types.Transactions {
 		}
 		sort.Sort(types.TxByNonce(m.cache))
 	}
-	// Copy the cache to prevent accidental modifications
-	txs := make(types.Transactions, len(m.cache))
-	copy(txs, m.cache)
+	return m.cache
+}
+
+// SyncSortedMap is a nonce->transaction hash map just like txSortedMap, but safe
+// for concurrent use by multiple goroutines.
+type SyncSortedMap struct {
+	m  *txSortedMap
+	mu sync.RWMutex
+}
+
+// NewSyncSortedMap creates a new, concurrency safe nonce-sorted transaction map.
+func NewSyncSortedMap() *SyncSortedMap {
+	return &SyncSortedMap{m: newTxSortedMap()}
+}
+
+// Get retrieves the current transactions associated with the given nonce.
+func (s *SyncSortedMap) Get(nonce uint64) *types.Transaction {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.m.Get(nonce)
+}
+
+// Has returns whether a transaction with the given nonce is stored in the map.
+func (s *SyncSortedMap) Has(nonce uint64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.m.Has(nonce)
+}
+
+// Len returns the number of transactions in the map.
+func (s *SyncSortedMap) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.m.Len()
+}
+
+// Put inserts a new transaction into the map, overwriting any previous one with
+// the same nonce.
+func (s *SyncSortedMap) Put(tx *types.Transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.m.Put(tx)
+}
+
+// Forward removes and returns all transactions with a nonce lower than the
+// provided threshold.
+func (s *SyncSortedMap) Forward(threshold uint64) types.Transactions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.m.Forward(threshold)
+}
+
+// Filter removes and returns all transactions for which the specified function
+// evaluates to true. The function is called with the map locked, so it must not
+// access the map itself.
+func (s *SyncSortedMap) Filter(filter func(*types.Transaction) bool) types.Transactions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.m.Filter(filter)
+}
+
+// Cap places a hard limit on the number of items, removing and returning the
+// highest nonce'd transactions exceeding that limit.
+func (s *SyncSortedMap) Cap(threshold int) types.Transactions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.m.Cap(threshold)
+}
+
+// Remove deletes the transaction with the given nonce, returning whether it was
+// found.
+func (s *SyncSortedMap) Remove(nonce uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.m.Remove(nonce)
+}
+
+// Ready removes and returns the sequentially increasing run of transactions
+// starting at the provided nonce.
+func (s *SyncSortedMap) Ready(start uint64) types.Transactions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.m.Ready(start)
+}
+
+// Flatten returns a nonce-sorted copy of the transactions in the map. Only the
+// read lock is held, so concurrent readers don't block each other: the sorted
+// cache is copied if available, but never populated.
+func (s *SyncSortedMap) Flatten() types.Transactions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	txs := make(types.Transactions, 0, len(s.m.items))
+	if s.m.cache != nil {
+		return append(txs, s.m.cache...)
+	}
+	for _, tx := range s.m.items {
+		txs = append(txs, tx)
+	}
+	sort.Sort(types.TxByNonce(txs))
 	return txs
 }
 
@@ -257,24 +592,197 @@ type txList struct {
 	costcap *big.Int // Price of the highest costing transaction (reset only if exceeds balance)
 	// 所有交易里面， GasPrice 最高的值
 	gascap  *big.Int // Gas limit of the highest spending transaction (reset only if exceeds block limit)
+
+	totalcost *big.Int // Total cost of all the transactions in the list
+	totalgas  uint64   // Total gas limit of all the transactions in the list
+
+	clock    func() time.Time     // Source of arrival times (nil = arrivals not tracked)
+	arrivals map[uint64]time.Time // Time each transaction was added to the list at
+
+	minGasPrice *big.Int // Minimum gas price of transactions accepted into the list (nil = none)
+
+	snapshots bool         // Whether read snapshots are published on every modification
+	snapshot  atomic.Value // Latest published read snapshot of the contents (*txListSnapshot)
 }
 
 // newTxList create a new transaction list for maintaining nonce-indexable fast,
 // gapped, sortable transaction lists.
 func newTxList(strict bool) *txList {
-	return &txList{
-		strict:  strict,
-		txs:     newTxSortedMap(),
-		costcap: new(big.Int),
-		gascap:  new(big.Int),
+	list := &txList{
+		strict:    strict,
+		txs:       newTxSortedMap(),
+		costcap:   new(big.Int),
+		gascap:    new(big.Int),
+		totalcost: new(big.Int),
 	}
+	return list
+}
+
+// Clone creates a deep copy of the list, which can be modified without affecting
+// the original. The transactions themselves are immutable and thus shared.
+func (l *txList) Clone() *txList {
+	txs := &txSortedMap{
+		items: make(map[uint64]*types.Transaction, len(l.txs.items)),
+		index: new(nonceHeap),
+		last:  l.txs.last,
+	}
+	for nonce, tx := range l.txs.items {
+		txs.items[nonce] = tx
+		*txs.index = append(*txs.index, nonce)
+	}
+	heap.Init(txs.index)
+
+	if len(l.txs.tags) > 0 {
+		txs.tags = make(map[uint64]string, len(l.txs.tags))
+		for nonce, tag := range l.txs.tags {
+			txs.tags[nonce] = tag
+		}
+	}
+	clone := &txList{
+		strict:    l.strict,
+		txs:       txs,
+		costcap:   new(big.Int).Set(l.costcap),
+		gascap:    new(big.Int).Set(l.gascap),
+		totalcost: new(big.Int).Set(l.totalcost),
+		totalgas:  l.totalgas,
+		clock:     l.clock,
+
+		minGasPrice: l.minGasPrice,
+		snapshots:   l.snapshots,
+	}
+	if l.arrivals != nil {
+		clone.arrivals = make(map[uint64]time.Time, len(l.arrivals))
+		for nonce, arrival := range l.arrivals {
+			clone.arrivals[nonce] = arrival
+		}
+	}
+	clone.publish()
+	return clone
+}
+
+// TxListView is an immutable view of the contents of a transaction list at some
+// point in time. It is safe for concurrent use, even while the list is modified.
+type TxListView interface {
+	// Flatten returns the nonce-sorted transactions in the view.
+	Flatten() types.Transactions
+
+	// Len returns the number of transactions in the view.
+	Len() int
+
+	// Get returns the transaction with the given nonce, or nil if none exists.
+	Get(nonce uint64) *types.Transaction
+}
+
+// txListSnapshot is a TxListView over a nonce-sorted copy of a list's contents.
+type txListSnapshot struct {
+	txs types.Transactions
+}
+
+func (s *txListSnapshot) Flatten() types.Transactions {
+	txs := make(types.Transactions, len(s.txs))
+	copy(txs, s.txs)
+	return txs
+}
+
+func (s *txListSnapshot) Len() int {
+	return len(s.txs)
+}
+
+func (s *txListSnapshot) Get(nonce uint64) *types.Transaction {
+	i := sort.Search(len(s.txs), func(i int) bool { return s.txs[i].Nonce() >= nonce })
+	if i < len(s.txs) && s.txs[i].Nonce() == nonce {
+		return s.txs[i]
+	}
+	return nil
+}
+
+// EnableSnapshots publishes a read snapshot of the list's current contents and
+// keeps publishing a new one after every modification from then on. Until it is
+// called, modifications don't pay for snapshotting. Like all methods but
+// ReadSnapshot, it must not be called concurrently with modifications.
+func (l *txList) EnableSnapshots() {
+	if !l.snapshots {
+		l.snapshots = true
+		l.publish()
+	}
+}
+
+// publish creates a new read snapshot of the list's current contents if read
+// snapshots are enabled. It needs to be called after every modification of the
+// list.
+func (l *txList) publish() {
+	if l.snapshots {
+		l.snapshot.Store(&txListSnapshot{txs: l.txs.Flatten()})
+	}
+}
+
+// TrackArrivals starts recording the time each transaction is added to the list
+// at, as reported by clock (time.Now if nil), allowing EvictOlderThan to drop
+// stale transactions. Transactions already in the list count as arriving now.
+// Until it is called, additions don't pay for tracking arrivals.
+func (l *txList) TrackArrivals(clock func() time.Time) {
+	if clock == nil {
+		clock = time.Now
+	}
+	l.clock = clock
+	if l.arrivals == nil {
+		l.arrivals = make(map[uint64]time.Time, l.txs.Len())
+		now := clock()
+		for nonce := range l.txs.items {
+			l.arrivals[nonce] = now
+		}
+	}
+}
+
+// track accounts a newly inserted transaction in the running totals and records
+// its arrival time if arrivals are tracked.
+func (l *txList) track(tx *types.Transaction) {
+	l.totalcost.Add(l.totalcost, tx.Cost())
+	l.totalgas += tx.Gas().Uint64()
+	if l.arrivals != nil {
+		l.arrivals[tx.Nonce()] = l.clock()
+	}
+}
+
+// untrack removes a batch of dropped transactions from the running totals and
+// forgets their arrival times.
+func (l *txList) untrack(txs types.Transactions) {
+	for _, tx := range txs {
+		l.totalcost.Sub(l.totalcost, tx.Cost())
+		l.totalgas -= tx.Gas().Uint64()
+		delete(l.arrivals, tx.Nonce())
+	}
+}
+
+// TotalCost returns the sum of the costs of all the transactions in the list.
+func (l *txList) TotalCost() *big.Int {
+	return new(big.Int).Set(l.totalcost)
+}
+
+// TotalGas returns the sum of the gas limits of all the transactions in the list.
+func (l *txList) TotalGas() uint64 {
+	return l.totalgas
+}
+
+// ReadSnapshot returns the latest immutable view of the list's contents. Unlike
+// all other methods, it may be called concurrently with modifications, which
+// publish new views instead of mutating the returned one. Reading a view never
+// blocks, nor is it blocked by writers.
+//
+// Snapshots need to be enabled via EnableSnapshots first, otherwise an empty view
+// is returned.
+func (l *txList) ReadSnapshot() TxListView {
+	if snapshot, ok := l.snapshot.Load().(*txListSnapshot); ok {
+		return snapshot
+	}
+	return new(txListSnapshot)
 }
 
 // Overlaps returns whether the transaction specified has the same nonce as one
 // already contained within the list.
 // Overlaps 返回给定的交易是否有具有相同 nonce 的交易存在
 func (l *txList) Overlaps(tx *types.Transaction) bool {
-	return l.txs.Get(tx.Nonce()) != nil
+	return l.txs.Has(tx.Nonce())
 }
 
 // Add tries to insert a new transaction into the list, returning whether the
@@ -284,27 +792,76 @@ func (l *txList) Overlaps(tx *types.Transaction) bool {
 // thresholds are also potentially updated.
 // 如果新的交易被接收，那么总的 cost 和 gas 限制会被更新。
 func (l *txList) Add(tx *types.Transaction, priceBump uint64) (bool, *types.Transaction) {
+	inserted, old, _ := l.AddWithReason(tx, priceBump)
+	return inserted, old
+}
+
+// AddWithReason inserts a new transaction into the list just like Add, but also
+// returns why a rejected transaction was not accepted: ErrUnderpriced if it is
+// priced below the list's minimum gas price, ErrAlreadyKnown if the same
+// transaction is already in the list, or ErrReplaceUnderpriced if it does not
+// bump the price of the one it would replace enough.
+func (l *txList) AddWithReason(tx *types.Transaction, priceBump uint64) (bool, *types.Transaction, error) {
+	return l.add(tx, priceBump*100)
+}
+
+// AddBps inserts a new transaction into the list just like Add, but takes the
+// minimum price bump of a replacement in basis points (hundredths of a percent)
+// instead of whole percents, allowing fractional bump policies.
+func (l *txList) AddBps(tx *types.Transaction, bumpBps uint64) (bool, *types.Transaction) {
+	inserted, old, _ := l.add(tx, bumpBps)
+	return inserted, old
+}
+
+// add implements AddWithReason and AddBps, requiring any replacement to bump
+// the price of the old transaction by at least bumpBps basis points.
+func (l *txList) add(tx *types.Transaction, bumpBps uint64) (bool, *types.Transaction, error) {
+	// Reject anything below the price floor without considering replacements
+	if l.minGasPrice != nil && tx.GasPrice().Cmp(l.minGasPrice) < 0 {
+		return false, nil, ErrUnderpriced
+	}
 	// If there's an older better transaction, abort
 	// 如果存在老的交易。 而且新的交易的价格比老的高出一定的数量。那么替换。
 	old := l.txs.Get(tx.Nonce())
 	if old != nil {
-		threshold := new(big.Int).Div(new(big.Int).Mul(old.GasPrice(), big.NewInt(100+int64(priceBump))), big.NewInt(100))
+		if old.Hash() == tx.Hash() {
+			return false, nil, ErrAlreadyKnown
+		}
+		threshold := new(big.Int).Mul(old.GasPrice(), new(big.Int).SetUint64(10000+bumpBps))
+		threshold.Div(threshold, big.NewInt(10000))
 		// Have to ensure that the new gas price is higher than the old gas
 		// price as well as checking the percentage threshold to ensure that
 		// this is accurate for low (Wei-level) gas price replacements
 		if old.GasPrice().Cmp(tx.GasPrice()) >= 0 || threshold.Cmp(tx.GasPrice()) > 0 {
-			return false, nil
+			return false, nil, ErrReplaceUnderpriced
 		}
 	}
 	// Otherwise overwrite the old transaction with the current one
 	l.txs.Put(tx)
+	arrival, replaced := l.arrivals[tx.Nonce()]
+	if old != nil {
+		l.untrack(types.Transactions{old})
+	}
+	l.track(tx)
+	if replaced {
+		// Replacements keep the arrival time of the transaction they replace
+		l.arrivals[tx.Nonce()] = arrival
+	}
 	if cost := tx.Cost(); l.costcap.Cmp(cost) < 0 {
 		l.costcap = cost
 	}
 	if gas := tx.Gas(); l.gascap.Cmp(gas) < 0 {
 		l.gascap = gas
 	}
-	return true, old
+	l.publish()
+	return true, old, nil
+}
+
+// SetMinGasPrice sets the minimum gas price a transaction needs to pay to be
+// added to the list, nil disabling the check. Transactions already in the list
+// are not affected.
+func (l *txList) SetMinGasPrice(price *big.Int) {
+	l.minGasPrice = price
 }
 
 // Forward removes all transactions from the list with a nonce lower than the
@@ -312,7 +869,24 @@ func (l *txList) Add(tx *types.Transaction, priceBump uint64) (bool, *types.Tran
 // maintenance.
 // Forward 删除 nonce 小于某个值的所有交易。
 func (l *txList) Forward(threshold uint64) types.Transactions {
-	return l.txs.Forward(threshold)
+	removed := l.txs.Forward(threshold)
+	if len(removed) > 0 {
+		l.untrack(removed)
+		l.publish()
+	}
+	return removed
+}
+
+// ForwardReport removes all transactions from the list with a nonce lower than
+// the provided threshold just like Forward, but also reports how many of them
+// formed the contiguous run starting at the lowest nonce of the list. Removals
+// beyond that run were gapped leftovers rather than executable transactions.
+func (l *txList) ForwardReport(threshold uint64) (removed types.Transactions, contiguous int) {
+	removed = l.Forward(threshold) // Popped off the nonce heap, so sorted
+	for contiguous < len(removed) && removed[contiguous].Nonce() == removed[0].Nonce()+uint64(contiguous) {
+		contiguous++
+	}
+	return removed, contiguous
 }
 
 // Filter removes all transactions from the list with a cost or gas limit higher
@@ -354,13 +928,99 @@ func (l *txList) Filter(costLimit, gasLimit *big.Int) (types.Transactions, types
 		}
 		invalids = l.txs.Filter(func(tx *types.Transaction) bool { return tx.Nonce() > lowest })
 	}
+	if len(removed) > 0 {
+		l.untrack(removed)
+		l.untrack(invalids)
+		l.publish()
+	}
 	return removed, invalids
 }
 
+// MinBalanceRequired returns the minimum account balance needed for none of the
+// executable transactions (the contiguous run starting at the lowest nonce) to
+// be dropped by Filter.
+//
+// Note, this is the highest single transaction cost in the run, not the total
+// spending of the run, since Filter checks each transaction against the balance
+// individually.
+func (l *txList) MinBalanceRequired() *big.Int {
+	required := new(big.Int)
+
+	txs := l.txs.Flatten()
+	for i, tx := range txs {
+		if i > 0 && tx.Nonce() != txs[i-1].Nonce()+1 {
+			break
+		}
+		if cost := tx.Cost(); required.Cmp(cost) < 0 {
+			required = cost
+		}
+	}
+	return required
+}
+
+// GasWeightedAvgPrice returns the average gas price of all the transactions in
+// the list, weighted by their gas limits. For an empty list (or one with only
+// zero gas transactions) zero is returned.
+func (l *txList) GasWeightedAvgPrice() *big.Int {
+	var (
+		fees = new(big.Int)
+		gas  = new(big.Int)
+	)
+	for _, tx := range l.txs.items {
+		fees.Add(fees, new(big.Int).Mul(tx.GasPrice(), tx.Gas()))
+		gas.Add(gas, tx.Gas())
+	}
+	if gas.Sign() == 0 {
+		return new(big.Int)
+	}
+	return fees.Div(fees, gas)
+}
+
 // Cap places a hard limit on the number of items, returning all transactions
 // exceeding that limit.
 func (l *txList) Cap(threshold int) types.Transactions {
-	return l.txs.Cap(threshold)
+	drops := l.txs.Cap(threshold)
+	if len(drops) > 0 {
+		l.untrack(drops)
+		l.publish()
+	}
+	return drops
+}
+
+// CapPreservingExecutable places a hard limit on the number of items like Cap,
+// but instead of dropping the highest nonces, it keeps the contiguous run of
+// transactions starting at the lowest nonce intact and drops the cheapest of
+// the gapped transactions beyond it. It is meant for non-strict lists.
+//
+// If the contiguous run alone exceeds the limit, it is truncated from the top
+// just like Cap does, which keeps the remaining transactions executable.
+func (l *txList) CapPreservingExecutable(max int) types.Transactions {
+	// Short circuit if the number of items is under the limit
+	if l.txs.Len() <= max {
+		return nil
+	}
+	// Split the transactions into the contiguous prefix and the gapped rest
+	txs := l.txs.Flatten()
+
+	run := 1
+	for run < len(txs) && txs[run].Nonce() == txs[run-1].Nonce()+1 {
+		run++
+	}
+	if run >= max {
+		return l.Cap(max)
+	}
+	gapped := txs[run:]
+	sort.Sort(types.TxByPrice(gapped)) // most expensive first, cheapest last
+
+	// Drop the cheapest gapped transactions until within the limit
+	drops := gapped[len(gapped)-(len(txs)-max):]
+
+	for _, tx := range drops {
+		l.txs.Remove(tx.Nonce())
+	}
+	l.untrack(drops)
+	l.publish()
+	return drops
 }
 
 // Remove deletes a transaction from the maintained list, returning whether the
@@ -369,14 +1029,88 @@ func (l *txList) Cap(threshold int) types.Transactions {
 func (l *txList) Remove(tx *types.Transaction) (bool, types.Transactions) {
 	// Remove the transaction from the set
 	nonce := tx.Nonce()
+	old := l.txs.Get(nonce)
 	if removed := l.txs.Remove(nonce); !removed {
 		return false, nil
 	}
+	l.untrack(types.Transactions{old})
 	// In strict mode, filter out non-executable transactions
+	var invalids types.Transactions
 	if l.strict {
-		return true, l.txs.Filter(func(tx *types.Transaction) bool { return tx.Nonce() > nonce })
+		invalids = l.txs.Filter(func(tx *types.Transaction) bool { return tx.Nonce() > nonce })
+		l.untrack(invalids)
 	}
-	return true, nil
+	l.publish()
+	return true, invalids
+}
+
+// EvictOlderThan removes all transactions from the list that were added before
+// the given cutoff time, returning them for any post-removal maintenance. In
+// strict mode, all transactions above the lowest evicted nonce are invalidated,
+// removed and returned too. Unless arrivals are tracked (see TrackArrivals),
+// nothing is evicted.
+func (l *txList) EvictOlderThan(cutoff time.Time) types.Transactions {
+	lowest, stale := uint64(math.MaxUint64), false
+	for nonce, arrival := range l.arrivals {
+		if arrival.Before(cutoff) {
+			stale = true
+			if nonce < lowest {
+				lowest = nonce
+			}
+		}
+	}
+	if !stale {
+		return nil
+	}
+	var evicted types.Transactions
+	if l.strict {
+		evicted = l.txs.Filter(func(tx *types.Transaction) bool { return tx.Nonce() >= lowest })
+	} else {
+		evicted = l.txs.Filter(func(tx *types.Transaction) bool { return l.arrivals[tx.Nonce()].Before(cutoff) })
+	}
+	l.untrack(evicted)
+	l.publish()
+	return evicted
+}
+
+// Gaps returns the nonces missing from the list between start and the highest
+// nonce in the list, in increasing order. Transactions below start are ignored.
+// For a contiguous list beginning at start, no gaps are returned.
+func (l *txList) Gaps(start uint64) []uint64 {
+	var gaps []uint64
+
+	next := start
+	for _, tx := range l.txs.flatten() {
+		nonce := tx.Nonce()
+		if nonce < next {
+			continue
+		}
+		for ; next < nonce; next++ {
+			gaps = append(gaps, next)
+		}
+		next = nonce + 1
+	}
+	return gaps
+}
+
+// EvictionCost returns the number of transactions that Remove would drop from
+// the list if the one with the given nonce was evicted: the transaction itself,
+// plus in strict mode all the transactions with higher nonces it invalidates.
+// Zero is returned if no transaction with the given nonce exists.
+func (l *txList) EvictionCost(nonce uint64) int {
+	if !l.txs.Has(nonce) {
+		return 0
+	}
+	if !l.strict {
+		return 1
+	}
+	cost := 0
+	for n := range l.txs.items {
+		if n >= nonce {
+			cost++
+		}
+	}
+	return cost
 }
 
 // Ready retrieves a sequentially increasing list of transactions starting at the
@@ -387,7 +1121,36 @@ func (l *txList) Remove(tx *types.Transaction) (bool, types.Transactions) {
 // prevent getting into and invalid state. This is not something that should ever
 // happen but better to be self correcting than failing!
 func (l *txList) Ready(start uint64) types.Transactions {
-	return l.txs.Ready(start)
+	return l.ReadyN(start, l.txs.Len())
+}
+
+// ReadyN retrieves at most max sequentially increasing transactions starting at
+// the provided nonce that are ready for processing, removing them from the list.
+func (l *txList) ReadyN(start uint64, max int) types.Transactions {
+	ready := l.txs.ReadyN(start, max)
+	if len(ready) > 0 {
+		l.untrack(ready)
+		l.publish()
+	}
+	return ready
+}
+
+// ReadyCount returns the number of transactions Ready would return for the given
+// start nonce, without removing them. Just like Ready, the counted run begins at
+// the lowest nonce in the list if there are transactions below start.
+func (l *txList) ReadyCount(start uint64) int {
+	index := l.txs.index
+	if index.Len() == 0 || (*index)[0] > start {
+		return 0
+	}
+	count, _ := l.txs.LongestRun((*index)[0])
+	return count
+}
+
+// LastElement returns the transaction with the highest nonce in the list without
+// removing it, or nil if the list is empty.
+func (l *txList) LastElement() *types.Transaction {
+	return l.txs.LastElement()
 }
 
 // Len returns the length of the transaction list.
@@ -407,24 +1170,89 @@ func (l *txList) Flatten() types.Transactions {
 	return l.txs.Flatten()
 }
 
+// rlpTxList is the RLP encoding of a transaction list, used to persist it. The
+// nonce index and the caps are derived data rebuilt on decoding.
+type rlpTxList struct {
+	Strict bool
+	Txs    types.Transactions
+}
+
+// EncodeRLP serializes the list's strictness and its nonce-sorted transactions.
+func (l *txList) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, &rlpTxList{Strict: l.strict, Txs: l.Flatten()})
+}
+
+// DecodeRLP restores a list encoded via EncodeRLP, replacing the contents of l
+// and rebuilding the nonce index, caps and totals. The arrival times of the
+// transactions are not persisted, if tracked they are reset to the time of
+// decoding.
+func (l *txList) DecodeRLP(s *rlp.Stream) error {
+	var dec rlpTxList
+	if err := s.Decode(&dec); err != nil {
+		return err
+	}
+	l.strict = dec.Strict
+	l.txs = newTxSortedMap()
+	l.costcap, l.gascap = new(big.Int), new(big.Int)
+	l.totalcost, l.totalgas = new(big.Int), 0
+	if l.clock != nil {
+		l.arrivals = make(map[uint64]time.Time, len(dec.Txs))
+	}
+
+	for _, tx := range dec.Txs {
+		if l.txs.Has(tx.Nonce()) {
+			return errDuplicateNonce
+		}
+		l.txs.Put(tx)
+		l.track(tx)
+		if cost := tx.Cost(); l.costcap.Cmp(cost) < 0 {
+			l.costcap = cost
+		}
+		if gas := tx.Gas(); l.gascap.Cmp(gas) < 0 {
+			l.gascap = gas
+		}
+	}
+	l.publish()
+	return nil
+}
+
 // priceHeap is a heap.Interface implementation over transactions for retrieving
-// price-sorted transactions to discard when the pool fills up.
-type priceHeap []*types.Transaction
+// price-sorted transactions to discard when the pool fills up. Transactions are
+// ordered by the effective tip they pay on top of the base fee. The position of
+// each transaction is tracked to allow removing arbitrary ones from the heap.
+type priceHeap struct {
+	list    []*types.Transaction
+	index   map[common.Hash]int // Position of each transaction within list
+	baseFee *big.Int            // Base fee to compute the effective tips with (nil = none)
+}
+
+func newPriceHeap() *priceHeap {
+	return &priceHeap{index: make(map[common.Hash]int)}
+}
+
+func (h *priceHeap) Len() int { return len(h.list) }
+
+func (h *priceHeap) Less(i, j int) bool {
+	return effectiveTip(h.list[i], h.baseFee).Cmp(effectiveTip(h.list[j], h.baseFee)) < 0
+}
 
-func (h priceHeap) Len() int           { return len(h) }
-func (h priceHeap) Less(i, j int) bool { return h[i].GasPrice().Cmp(h[j].GasPrice()) < 0 }
-func (h priceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *priceHeap) Swap(i, j int) {
+	h.list[i], h.list[j] = h.list[j], h.list[i]
+	h.index[h.list[i].Hash()], h.index[h.list[j].Hash()] = i, j
+}
 
 func (h *priceHeap) Push(x interface{}) {
-	*h = append(*h, x.(*types.Transaction))
+	tx := x.(*types.Transaction)
+	h.index[tx.Hash()] = len(h.list)
+	h.list = append(h.list, tx)
 }
 
 func (h *priceHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
+	n := len(h.list)
+	tx := h.list[n-1]
+	h.list = h.list[:n-1]
+	delete(h.index, tx.Hash())
+	return tx
 }
 
 // txPricedList is a price-sorted heap to allow operating on transactions pool
@@ -432,66 +1260,151 @@ func (h *priceHeap) Pop() interface{} {
 // txPricedList 是基于价格排序的堆，允许按照价格递增的方式处理交易。
 type txPricedList struct {
 	// 这是一个指针，指向了所有交易的 map
-	all    *map[common.Hash]*types.Transaction // Pointer to the map of all transactions
-	items  *priceHeap                          // Heap of prices of all the stored transactions
-	stales int                                 // Number of stale price points to (re-heap trigger)
+	all   *map[common.Hash]*types.Transaction // Pointer to the map of all transactions
+	items *priceHeap                          // Heap of prices of all the stored transactions
+
+	evicted      []evictedTx   // Recently discarded transactions given a second chance
+	evictedLimit int           // Maximum number of evicted transactions to hold on to
+	window       time.Duration // Time window within which evicted transactions may be reinstated
+
+	stales      int     // Number of stale price points reported via Removed (re-heap trigger)
+	reheapRatio float64 // Ratio of stale price points to all of them that triggers a re-heap
+}
+
+// defaultReheapRatio is the default ratio of stale entries in the price heap at
+// which Removed rebuilds it.
+const defaultReheapRatio = 0.25
+
+// pricedListOption is a configuration option for newTxPricedList.
+type pricedListOption func(*txPricedList)
+
+// withReheapRatio sets the ratio of stale entries reported via Removed to all
+// entries in the price heap at which the heap is rebuilt. A low ratio rebuilds
+// often, each time scanning the entire heap, but keeps few dead entries around
+// to be skipped over by the queries. A high ratio amortizes the rebuilds over
+// more removals, at the cost of carrying more dead entries. The ratio needs to
+// be in (0, 1], otherwise the default is kept.
+func withReheapRatio(ratio float64) pricedListOption {
+	return func(l *txPricedList) {
+		if ratio <= 0 || ratio > 1 {
+			log.Warn("Sanitizing invalid price heap re-heap ratio", "provided", ratio, "updated", defaultReheapRatio)
+			return
+		}
+		l.reheapRatio = ratio
+	}
+}
+
+// secondChanceWindow is the default time window within which transactions
+// discarded with a second chance may be reinstated into the pool.
+const secondChanceWindow = time.Minute
+
+// secondChanceLimit is the default maximum number of transactions discarded with
+// a second chance that are held on to. Beyond it the oldest evictions are forgotten.
+const secondChanceLimit = 1024
+
+// evictedTx is a transaction discarded from the priced list, held for a while in
+// case the pool frees up room for it again.
+type evictedTx struct {
+	tx   *types.Transaction
+	time time.Time // Time of the eviction
 }
 
 // newTxPricedList creates a new price-sorted transaction heap.
-func newTxPricedList(all *map[common.Hash]*types.Transaction) *txPricedList {
-	return &txPricedList{
-		all:   all,
-		items: new(priceHeap),
+func newTxPricedList(all *map[common.Hash]*types.Transaction, opts ...pricedListOption) *txPricedList {
+	l := &txPricedList{
+		all:          all,
+		items:        newPriceHeap(),
+		evictedLimit: secondChanceLimit,
+		window:       secondChanceWindow,
+		reheapRatio:  defaultReheapRatio,
+	}
+	for _, opt := range opts {
+		opt(l)
 	}
+	return l
 }
 
-// Put inserts a new transaction into the heap.
+// Put inserts a new transaction into the heap. Transactions already tracked are
+// ignored.
 func (l *txPricedList) Put(tx *types.Transaction) {
+	if _, ok := l.items.index[tx.Hash()]; ok {
+		return
+	}
 	heap.Push(l.items, tx)
 }
 
+// SetBaseFee updates the base fee the effective tips of the transactions are
+// computed with, re-heaping the transactions according to the new ordering.
+func (l *txPricedList) SetBaseFee(baseFee *big.Int) {
+	l.items.baseFee = baseFee
+	heap.Init(l.items)
+}
+
+// Remove deletes a transaction dropped from the pool from the heap, keeping the
+// heap exactly sized to the live transactions. Removing a transaction not in the
+// heap (e.g. one already popped by Cap or Discard) is a noop.
+func (l *txPricedList) Remove(tx *types.Transaction) {
+	if i, ok := l.items.index[tx.Hash()]; ok {
+		heap.Remove(l.items, i)
+	}
+}
+
 // Removed notifies the prices transaction list that an old transaction dropped
-// from the pool. The list will just keep a counter of stale objects and update
-// the heap if a large enough ratio of transactions go stale.
-// Removed 用来通知 txPricedList 有一个老的交易被删除.
-// txPricedList 使用一个计数器来决定何时更新堆信息
+// from the pool. The list just keeps a counter of stale objects and updates the
+// heap if a large enough ratio of transactions go stale.
+// Removed 用来通知 txPricedList 有一个老的交易被删除. txPricedList 使用 stales
+// 来计数，如果 stales 的比例超过 reheapRatio 就重建堆。
+//
+// Deprecated: Removed needs to scan the entire heap every now and then and leaves
+// stale entries around until it does, use Remove instead.
 func (l *txPricedList) Removed() {
-	// Bump the stale counter, but exit if still too low (< 25%)
+	// Bump the stale counter, but exit if still too low (< reheapRatio)
 	l.stales++
-	if l.stales <= len(*l.items)/4 {
+	if float64(l.stales) <= l.reheapRatio*float64(l.items.Len()) {
 		return
 	}
 	// Seems we've reached a critical number of stale transactions, reheap
-	reheap := make(priceHeap, 0, len(*l.all))
+	reheap := newPriceHeap()
+	reheap.baseFee = l.items.baseFee
+	for _, tx := range l.items.list {
+		if _, ok := (*l.all)[tx.Hash()]; ok {
+			reheap.index[tx.Hash()] = len(reheap.list)
+			reheap.list = append(reheap.list, tx)
+		}
+	}
+	heap.Init(reheap)
+
+	l.items, l.stales = reheap, 0
+}
 
-	l.stales, l.items = 0, &reheap
-	for _, tx := range *l.all {
-		*l.items = append(*l.items, tx)
+// dropStale accounts for a stale transaction popped off the heap.
+func (l *txPricedList) dropStale() {
+	if l.stales > 0 {
+		l.stales--
 	}
-	heap.Init(l.items)
 }
 
-// Cap finds all the transactions below the given price threshold, drops them
-// from the priced list and returs them for further removal from the entire pool.
+// Cap finds all the transactions whose effective tip is below the given price
+// threshold, drops them from the priced list and returs them for further removal
+// from the entire pool.
 func (l *txPricedList) Cap(threshold *big.Int, local *accountSet) types.Transactions {
 	drop := make(types.Transactions, 0, 128) // Remote underpriced transactions to drop
 	save := make(types.Transactions, 0, 64)  // Local underpriced transactions to keep
 
-	for len(*l.items) > 0 {
+	for l.items.Len() > 0 {
 		// Discard stale transactions if found during cleanup
 		tx := heap.Pop(l.items).(*types.Transaction)
 		if _, ok := (*l.all)[tx.Hash()]; !ok {
-			// 如果发现一个已经删除的,那么更新 states 计数器
-			l.stales--
+			l.dropStale()
 			continue
 		}
 		// Stop the discards if we've reached the threshold
 		// 如果价格不小于阈值, 那么退出
-		if tx.GasPrice().Cmp(threshold) >= 0 {
+		if effectiveTip(tx, l.items.baseFee).Cmp(threshold) >= 0 {
 			save = append(save, tx)
 			break
 		}
-		// Non stale transaction found, discard unless local
+		// Below the threshold, discard unless local
 		// 本地的交易不会删除
 		if local.containsTx(tx) {
 			save = append(save, tx)
@@ -505,30 +1418,123 @@ func (l *txPricedList) Cap(threshold *big.Int, local *accountSet) types.Transact
 	return drop
 }
 
-// Underpriced checks whether a transaction is cheaper than (or as cheap as) the
-// lowest priced transaction currently being tracked.
+// CountBelow returns the number of transactions Cap would drop for the given
+// threshold, i.e. the remote transactions still in the pool with an effective tip
+// below it, without modifying the heap.
+func (l *txPricedList) CountBelow(threshold *big.Int, local *accountSet) int {
+	count := 0
+	for _, tx := range l.items.list {
+		if effectiveTip(tx, l.items.baseFee).Cmp(threshold) >= 0 || local.containsTx(tx) {
+			continue
+		}
+		if _, ok := (*l.all)[tx.Hash()]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+// Underpriced checks whether a transaction's effective tip is lower than (or as
+// low as) that of the lowest priced transaction currently being tracked.
 func (l *txPricedList) Underpriced(tx *types.Transaction, local *accountSet) bool {
 	// Local transactions cannot be underpriced
 	if local.containsTx(tx) {
 		return false
 	}
-	// Discard stale price points if found at the heap start
-	for len(*l.items) > 0 {
-		head := []*types.Transaction(*l.items)[0]
-		if _, ok := (*l.all)[head.Hash()]; !ok {
-			l.stales--
-			heap.Pop(l.items)
-			continue
-		}
-		break
-	}
 	// Check if the transaction is underpriced or not
-	if len(*l.items) == 0 {
+	l.discardStales()
+	if l.items.Len() == 0 {
 		log.Error("Pricing query for empty pool") // This cannot happen, print to catch programming errors
 		return false
 	}
-	cheapest := []*types.Transaction(*l.items)[0]
-	return cheapest.GasPrice().Cmp(tx.GasPrice()) >= 0
+	cheapest := l.items.list[0]
+	return effectiveTip(cheapest, l.items.baseFee).Cmp(effectiveTip(tx, l.items.baseFee)) >= 0
+}
+
+// UnderpricedBatch checks a batch of transactions just like Underpriced, returning
+// the results in the same order. The stale heap entries are cleaned up and the
+// cheapest tip is computed only once for the entire batch.
+func (l *txPricedList) UnderpricedBatch(txs types.Transactions, local *accountSet) []bool {
+	underpriced := make([]bool, len(txs))
+
+	l.discardStales()
+	if l.items.Len() == 0 {
+		log.Error("Pricing query for empty pool") // This cannot happen, print to catch programming errors
+		return underpriced
+	}
+	cheapest := effectiveTip(l.items.list[0], l.items.baseFee)
+	for i, tx := range txs {
+		// Local transactions cannot be underpriced
+		if !local.containsTx(tx) {
+			underpriced[i] = cheapest.Cmp(effectiveTip(tx, l.items.baseFee)) >= 0
+		}
+	}
+	return underpriced
+}
+
+// Peek returns the cheapest remote transaction still in the pool without removing
+// it, or nil if there is none. Local transactions are skipped, since they are
+// never discarded to make room for others.
+func (l *txPricedList) Peek(local *accountSet) *types.Transaction {
+	save := make(types.Transactions, 0, 64) // Local transactions to put back
+
+	var cheapest *types.Transaction
+	for l.discardStales(); l.items.Len() > 0; l.discardStales() {
+		tx := l.items.list[0]
+		if !local.containsTx(tx) {
+			cheapest = tx
+			break
+		}
+		save = append(save, heap.Pop(l.items).(*types.Transaction))
+	}
+	for _, tx := range save {
+		heap.Push(l.items, tx)
+	}
+	return cheapest
+}
+
+// discardStales pops transactions off the top of the heap that are no longer in
+// the pool. These are only left behind if the pool dropped them without calling
+// Remove, reporting them via Removed instead.
+func (l *txPricedList) discardStales() {
+	for l.items.Len() > 0 {
+		if _, ok := (*l.all)[l.items.list[0].Hash()]; ok {
+			return
+		}
+		heap.Pop(l.items)
+		l.dropStale()
+	}
+}
+
+// PriceToBeat returns the minimum effective tip (gas price minus the base fee,
+// as used by Underpriced and Discard) needed to rank above the transaction at
+// the given position in the tip ordering (0 being the cheapest), i.e. its tip
+// plus one wei. Negative ranks are treated as 0. If rank is beyond the number of
+// transactions, the tip to beat is that of the most expensive one (or 1 wei for
+// an empty list).
+func (l *txPricedList) PriceToBeat(rank int) *big.Int {
+	if l.items.Len() == 0 {
+		return big.NewInt(1)
+	}
+	// Sort the tips of the live transactions in ascending order
+	tips := make([]*big.Int, 0, l.items.Len())
+	for _, tx := range l.items.list {
+		if _, ok := (*l.all)[tx.Hash()]; ok {
+			tips = append(tips, effectiveTip(tx, l.items.baseFee))
+		}
+	}
+	if len(tips) == 0 {
+		return big.NewInt(1)
+	}
+	sort.Slice(tips, func(i, j int) bool { return tips[i].Cmp(tips[j]) < 0 })
+
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(tips) {
+		rank = len(tips) - 1
+	}
+	return new(big.Int).Add(tips[rank], common.Big1)
 }
 
 // Discard finds a number of most underpriced transactions, removes them from the
@@ -537,14 +1543,14 @@ func (l *txPricedList) Discard(count int, local *accountSet) types.Transactions
 	drop := make(types.Transactions, 0, count) // Remote underpriced transactions to drop
 	save := make(types.Transactions, 0, 64)    // Local underpriced transactions to keep
 
-	for len(*l.items) > 0 && count > 0 {
-		// Discard stale transactions if found during cleanup
+	for l.items.Len() > 0 && count > 0 {
+		// If we don't have the transaction anymore, skip it
 		tx := heap.Pop(l.items).(*types.Transaction)
 		if _, ok := (*l.all)[tx.Hash()]; !ok {
-			l.stales--
+			l.dropStale()
 			continue
 		}
-		// Non stale transaction found, discard unless local
+		// Discard the cheapest transaction unless local
 		if local.containsTx(tx) {
 			save = append(save, tx)
 		} else {
@@ -557,3 +1563,196 @@ func (l *txPricedList) Discard(count int, local *accountSet) types.Transactions
 	}
 	return drop
 }
+
+// tipHead is the next includable transaction of an account along with its
+// effective miner tip and the remaining nonce-sorted transactions behind it.
+type tipHead struct {
+	acc  common.Address
+	tx   *types.Transaction
+	tip  *big.Int
+	rest types.Transactions
+}
+
+// tipHeap is a heap.Interface implementation over account heads for retrieving
+// transactions in descending effective tip order. Equal tips are broken by the
+// account address to keep the ordering deterministic.
+type tipHeap []*tipHead
+
+func (h tipHeap) Len() int      { return len(h) }
+func (h tipHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h tipHeap) Less(i, j int) bool {
+	if cmp := h[i].tip.Cmp(h[j].tip); cmp != 0 {
+		return cmp > 0
+	}
+	return bytes.Compare(h[i].acc[:], h[j].acc[:]) < 0
+}
+
+func (h *tipHeap) Push(x interface{}) {
+	*h = append(*h, x.(*tipHead))
+}
+
+func (h *tipHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// effectiveTip returns the part of the transaction's gas price left to the miner
+// after paying the base fee. A negative tip means the transaction cannot cover
+// the base fee.
+func effectiveTip(tx *types.Transaction, baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return tx.GasPrice()
+	}
+	return new(big.Int).Sub(tx.GasPrice(), baseFee)
+}
+
+// ReorderUnderMarket returns the order in which the given pending transactions
+// would be included into a block if the network charged the given base fee. The
+// transactions are ordered by descending effective tip while honouring account
+// nonces. Since a transaction unable to pay the base fee stalls its account, it
+// and all subsequent transactions of the same account are left out.
+//
+// The input map is not modified, its per account lists need not be sorted.
+func ReorderUnderMarket(txs map[common.Address]types.Transactions, baseFee *big.Int) types.Transactions {
+	// Gather the nonce-sorted head transaction of each account
+	heads := make(tipHeap, 0, len(txs))
+	count := 0
+	for acc, accTxs := range txs {
+		if len(accTxs) == 0 {
+			continue
+		}
+		sorted := make(types.Transactions, len(accTxs))
+		copy(sorted, accTxs)
+		sort.Sort(types.TxByNonce(sorted))
+
+		if tip := effectiveTip(sorted[0], baseFee); tip.Sign() >= 0 {
+			heads = append(heads, &tipHead{acc: acc, tx: sorted[0], tip: tip, rest: sorted[1:]})
+		}
+		count += len(sorted)
+	}
+	heap.Init(&heads)
+
+	// Repeatedly include the best paying head, replacing it with its successor
+	order := make(types.Transactions, 0, count)
+	for len(heads) > 0 {
+		head := heads[0]
+		order = append(order, head.tx)
+
+		if len(head.rest) > 0 {
+			if tip := effectiveTip(head.rest[0], baseFee); tip.Sign() >= 0 {
+				head.tx, head.tip, head.rest = head.rest[0], tip, head.rest[1:]
+				heap.Fix(&heads, 0)
+				continue
+			}
+		}
+		heap.Pop(&heads)
+	}
+	return order
+}
+
+// StreamForBlock returns an iterator yielding the transactions of the given
+// account lists in the order a block would include them: by descending gas
+// price while honouring account nonces. Every yielded transaction has its gas
+// consumed from the given pool. A transaction not fitting into the remaining
+// gas would stall its account, so it and all subsequent transactions of the
+// same account are skipped. The iterator returns false once exhausted.
+//
+// The lists are flattened when the stream is created, later modifications of
+// them are not reflected by the iterator.
+func StreamForBlock(lists map[common.Address]*txList, gp *GasPool) func() (*types.Transaction, bool) {
+	heads := make(tipHeap, 0, len(lists))
+	for acc, list := range lists {
+		if txs := list.Flatten(); len(txs) > 0 {
+			heads = append(heads, &tipHead{acc: acc, tx: txs[0], tip: txs[0].GasPrice(), rest: txs[1:]})
+		}
+	}
+	heap.Init(&heads)
+
+	return func() (*types.Transaction, bool) {
+		for len(heads) > 0 {
+			head := heads[0]
+			if err := gp.SubGas(head.tx.Gas()); err != nil {
+				heap.Pop(&heads)
+				continue
+			}
+			tx := head.tx
+			if len(head.rest) > 0 {
+				head.tx, head.tip, head.rest = head.rest[0], head.rest[0].GasPrice(), head.rest[1:]
+				heap.Fix(&heads, 0)
+			} else {
+				heap.Pop(&heads)
+			}
+			return tx, true
+		}
+		return nil, false
+	}
+}
+
+// DiscardWithSecondChance discards the same transactions as Discard, but holds on
+// to the dropped ones for a while, so they can be reinstated via Reinstate if the
+// pool has room again within the second chance window. At most evictedLimit
+// transactions are held on to, the oldest evictions being forgotten first.
+func (l *txPricedList) DiscardWithSecondChance(count int, local *accountSet) types.Transactions {
+	drop := l.Discard(count, local)
+
+	now := time.Now()
+	l.expireEvicted(now)
+	for _, tx := range drop {
+		l.evicted = append(l.evicted, evictedTx{tx: tx, time: now})
+	}
+	if overflow := len(l.evicted) - l.evictedLimit; overflow > 0 {
+		l.evicted = append(l.evicted[:0], l.evicted[overflow:]...)
+	}
+	return drop
+}
+
+// Reinstate returns at most room of the transactions discarded with a second
+// chance within the last window, the most expensive ones first, and forgets
+// about them. The rest are kept for later calls. The caller is responsible for
+// adding the returned ones back into the pool (and thus the priced list).
+func (l *txPricedList) Reinstate(room int) types.Transactions {
+	l.expireEvicted(time.Now())
+	if room <= 0 || len(l.evicted) == 0 {
+		return nil
+	}
+	// Order the evictions by descending tip, keeping older ones first on ties
+	order := make([]int, len(l.evicted))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return effectiveTip(l.evicted[order[i]].tx, l.items.baseFee).Cmp(effectiveTip(l.evicted[order[j]].tx, l.items.baseFee)) > 0
+	})
+	if room > len(order) {
+		room = len(order)
+	}
+	txs := make(types.Transactions, room)
+	taken := make(map[int]struct{}, room)
+	for i, idx := range order[:room] {
+		txs[i] = l.evicted[idx].tx
+		taken[idx] = struct{}{}
+	}
+	// Retain the remaining evictions in time order
+	kept := l.evicted[:0]
+	for i, evicted := range l.evicted {
+		if _, ok := taken[i]; !ok {
+			kept = append(kept, evicted)
+		}
+	}
+	l.evicted = kept
+	return txs
+}
+
+// expireEvicted drops all the evicted transactions whose second chance window
+// elapsed by the given time.
+func (l *txPricedList) expireEvicted(now time.Time) {
+	// Evictions are appended in time order, so find the first one still valid
+	i := 0
+	for i < len(l.evicted) && now.Sub(l.evicted[i].time) > l.window {
+		i++
+	}
+	l.evicted = l.evicted[i:]
+}
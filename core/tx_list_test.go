@@ -17,12 +17,18 @@
 package core
 
 import (
+	"fmt"
 	"math/big"
 	"math/rand"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 // Tests that transactions can be added to strict lists and list contents and
@@ -50,3 +56,1676 @@ func TestStrictTxListAdd(t *testing.T) {
 		}
 	}
 }
+
+// Tests that capping a gapped list keeps the executable prefix, dropping the
+// cheapest gapped transactions instead.
+func TestTxListCapPreservingExecutable(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	// Nonces 0-2 are executable, 4-7 are gapped with varying prices
+	list := newTxList(false)
+	for nonce, price := range map[uint64]int64{0: 1, 1: 1, 2: 1, 4: 5, 5: 2, 6: 9, 7: 3} {
+		list.Add(pricedTransaction(nonce, new(big.Int), big.NewInt(price), key), DefaultTxPoolConfig.PriceBump)
+	}
+	drops := list.CapPreservingExecutable(5)
+	if len(drops) != 2 {
+		t.Fatalf("dropped transaction count mismatch: have %d, want %d", len(drops), 2)
+	}
+	for _, nonce := range []uint64{0, 1, 2, 4, 6} {
+		if list.txs.Get(nonce) == nil {
+			t.Errorf("transaction with nonce %d dropped", nonce)
+		}
+	}
+	for _, nonce := range []uint64{5, 7} {
+		if list.txs.Get(nonce) != nil {
+			t.Errorf("transaction with nonce %d retained", nonce)
+		}
+	}
+	// Capping below the executable prefix should truncate it from the top
+	if drops = list.CapPreservingExecutable(2); len(drops) != 3 {
+		t.Fatalf("dropped transaction count mismatch: have %d, want %d", len(drops), 3)
+	}
+	if list.txs.Get(0) == nil || list.txs.Get(1) == nil || list.Len() != 2 {
+		t.Errorf("executable prefix not retained after truncation")
+	}
+}
+
+// Tests that the minimum required balance is the highest cost within the
+// executable prefix, ignoring any gapped transactions.
+func TestTxListMinBalanceRequired(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	list := newTxList(false)
+	if have := list.MinBalanceRequired(); have.Sign() != 0 {
+		t.Fatalf("empty list balance mismatch: have %v, want 0", have)
+	}
+	// Costs are 100 + gas*price: 1100, 2100, 1600, and a gapped 100100
+	list.Add(pricedTransaction(0, big.NewInt(1000), big.NewInt(1), key), DefaultTxPoolConfig.PriceBump)
+	list.Add(pricedTransaction(1, big.NewInt(1000), big.NewInt(2), key), DefaultTxPoolConfig.PriceBump)
+	list.Add(pricedTransaction(2, big.NewInt(500), big.NewInt(3), key), DefaultTxPoolConfig.PriceBump)
+	list.Add(pricedTransaction(4, big.NewInt(100000), big.NewInt(1), key), DefaultTxPoolConfig.PriceBump)
+
+	if have, want := list.MinBalanceRequired(), big.NewInt(2100); have.Cmp(want) != 0 {
+		t.Fatalf("balance mismatch: have %v, want %v", have, want)
+	}
+	// Make sure the balance indeed retains all executable transactions
+	removed, invalids := list.Filter(big.NewInt(2100), big.NewInt(1000))
+	if len(removed) != 1 || removed[0].Nonce() != 4 || len(invalids) != 0 {
+		t.Errorf("unexpected filtering: removed %v, invalids %v", removed, invalids)
+	}
+}
+
+// Tests that tagged transactions can be filtered out by tag, and that tags are
+// cleaned up together with the transactions they belong to.
+func TestTxSortedMapTags(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	txs := make(types.Transactions, 6)
+	for i := 0; i < len(txs); i++ {
+		txs[i] = transaction(uint64(i), new(big.Int), key)
+	}
+	m := newTxSortedMap()
+	for i, tx := range txs {
+		switch i % 3 {
+		case 0:
+			m.PutTagged(tx, "rpc")
+		case 1:
+			m.PutTagged(tx, "p2p")
+		default:
+			m.Put(tx)
+		}
+	}
+	// Forwarding past the first transaction should drop its tag too
+	m.Forward(1)
+	if _, ok := m.tags[0]; ok {
+		t.Errorf("tag of forwarded transaction retained")
+	}
+	removed := m.FilterByTag("rpc")
+	if len(removed) != 1 || removed[0] != txs[3] {
+		t.Fatalf("filtered transactions mismatch: have %v, want [%v]", removed, txs[3])
+	}
+	// Overwriting a tagged transaction with an untagged one clears the tag
+	m.Put(txs[4])
+	if removed = m.FilterByTag("p2p"); len(removed) != 1 || removed[0] != txs[1] {
+		t.Fatalf("filtered transactions mismatch: have %v, want [%v]", removed, txs[1])
+	}
+	if m.Len() != 3 || len(m.tags) != 0 {
+		t.Errorf("map state mismatch: have %d txs and %d tags, want 3 and 0", m.Len(), len(m.tags))
+	}
+}
+
+// Tests that the average gas price of a list is weighted by the gas limits.
+func TestTxListGasWeightedAvgPrice(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	list := newTxList(false)
+	if have := list.GasWeightedAvgPrice(); have.Sign() != 0 {
+		t.Fatalf("empty list price mismatch: have %v, want 0", have)
+	}
+	// (1000*10 + 3000*30 + 6000*5) / 10000 = 13
+	list.Add(pricedTransaction(0, big.NewInt(1000), big.NewInt(10), key), DefaultTxPoolConfig.PriceBump)
+	list.Add(pricedTransaction(1, big.NewInt(3000), big.NewInt(30), key), DefaultTxPoolConfig.PriceBump)
+	list.Add(pricedTransaction(3, big.NewInt(6000), big.NewInt(5), key), DefaultTxPoolConfig.PriceBump)
+
+	if have, want := list.GasWeightedAvgPrice(), big.NewInt(13); have.Cmp(want) != 0 {
+		t.Errorf("average price mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that the memory estimate of a map tracks the size of the contained
+// transactions' data.
+func TestTxSortedMapApproxMemoryBytes(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	m := newTxSortedMap()
+	if size := m.ApproxMemoryBytes(); size != 0 {
+		t.Fatalf("empty map size mismatch: have %d, want 0", size)
+	}
+	for i := 0; i < 10; i++ {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), common.Address{}, big.NewInt(100), big.NewInt(100000), big.NewInt(1), make([]byte, 1024)), types.HomesteadSigner{}, key)
+		m.Put(tx)
+	}
+	m.Flatten() // populate the cache too
+
+	if size := m.ApproxMemoryBytes(); size < 10*1024 || size > 10*(1024+1024) {
+		t.Errorf("estimated size out of range: have %d, want within [%d, %d]", size, 10*1024, 10*(1024+1024))
+	}
+}
+
+// Tests that transactions are ordered by effective tip while honouring nonces,
+// and that accounts unable to pay the base fee are stalled from that point on.
+func TestReorderUnderMarket(t *testing.T) {
+	keyA, _ := crypto.GenerateKey()
+	keyB, _ := crypto.GenerateKey()
+
+	a0 := pricedTransaction(0, big.NewInt(100000), big.NewInt(20), keyA)
+	a1 := pricedTransaction(1, big.NewInt(100000), big.NewInt(100), keyA)
+	b0 := pricedTransaction(0, big.NewInt(100000), big.NewInt(50), keyB)
+	b1 := pricedTransaction(1, big.NewInt(100000), big.NewInt(10), keyB)
+
+	txs := map[common.Address]types.Transactions{
+		crypto.PubkeyToAddress(keyA.PublicKey): {a1, a0},
+		crypto.PubkeyToAddress(keyB.PublicKey): {b0, b1},
+	}
+	tests := []struct {
+		baseFee *big.Int
+		order   types.Transactions
+	}{
+		{big.NewInt(0), types.Transactions{b0, a0, a1, b1}},
+		{big.NewInt(15), types.Transactions{b0, a0, a1}},
+		{big.NewInt(30), types.Transactions{b0}},
+		{big.NewInt(60), types.Transactions{}},
+	}
+	for i, tt := range tests {
+		order := ReorderUnderMarket(txs, tt.baseFee)
+		if len(order) != len(tt.order) {
+			t.Errorf("test %d: order length mismatch: have %d, want %d", i, len(order), len(tt.order))
+			continue
+		}
+		for j, tx := range order {
+			if tx != tt.order[j] {
+				t.Errorf("test %d, tx %d: transaction mismatch: have %x, want %x", i, j, tx.Hash(), tt.order[j].Hash())
+			}
+		}
+	}
+	if txs[crypto.PubkeyToAddress(keyA.PublicKey)][0] != a1 {
+		t.Errorf("input transaction list modified")
+	}
+}
+
+// Tests that transactions discarded with a second chance can be reinstated
+// within the window, the most expensive first and no more than there is room
+// for, but are forgotten once it elapses or too many are held.
+func TestTxPricedListSecondChance(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	local := newAccountSet(types.HomesteadSigner{})
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all)
+	for i := 0; i < 4; i++ {
+		tx := pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(int64(i+1)), key)
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	// Discard the two cheapest transactions and reinstate them
+	drop := priced.DiscardWithSecondChance(2, local)
+	if len(drop) != 2 || drop[0].GasPrice().Int64() != 1 || drop[1].GasPrice().Int64() != 2 {
+		t.Fatalf("discarded transactions mismatch: have %v", drop)
+	}
+	for _, tx := range drop {
+		delete(all, tx.Hash())
+	}
+	reinstated := priced.Reinstate(1)
+	if len(reinstated) != 1 || reinstated[0] != drop[1] {
+		t.Fatalf("reinstated transactions mismatch: have %v, want [%v]", reinstated, drop[1])
+	}
+	if rest := priced.Reinstate(0); len(rest) != 0 {
+		t.Fatalf("transactions reinstated without room: %v", rest)
+	}
+	rest := priced.Reinstate(2)
+	if len(rest) != 1 || rest[0] != drop[0] {
+		t.Fatalf("remaining reinstated transactions mismatch: have %v, want [%v]", rest, drop[0])
+	}
+	if again := priced.Reinstate(2); len(again) != 0 {
+		t.Fatalf("transactions reinstated twice: %v", again)
+	}
+	for _, tx := range append(reinstated, rest...) {
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	// Discard again, but let the window elapse before reinstating
+	drop = priced.DiscardWithSecondChance(1, local)
+	if len(drop) != 1 {
+		t.Fatalf("discarded transaction count mismatch: have %d, want 1", len(drop))
+	}
+	for i := range priced.evicted {
+		priced.evicted[i].time = priced.evicted[i].time.Add(-2 * secondChanceWindow)
+	}
+	if reinstated := priced.Reinstate(4); len(reinstated) != 0 {
+		t.Fatalf("expired transactions reinstated: %v", reinstated)
+	}
+	for _, tx := range drop {
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	// Discard more than the limit, only the latest evictions should be held
+	priced.evictedLimit = 2
+
+	drop = priced.DiscardWithSecondChance(3, local)
+	if len(drop) != 3 {
+		t.Fatalf("discarded transaction count mismatch: have %d, want 3", len(drop))
+	}
+	reinstated = priced.Reinstate(4)
+	if len(reinstated) != 2 || reinstated[0] != drop[2] || reinstated[1] != drop[1] {
+		t.Fatalf("capped reinstated transactions mismatch: have %v, want [%v %v]", reinstated, drop[2], drop[1])
+	}
+}
+
+// Tests that the highest nonce transaction is tracked across insertions,
+// overwrites and removals.
+func TestTxSortedMapLastElement(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	m := newTxSortedMap()
+	if last := m.LastElement(); last != nil {
+		t.Fatalf("empty map last element: have %v, want nil", last)
+	}
+	txs := make(types.Transactions, 10)
+	for i := range txs {
+		txs[i] = transaction(uint64(i), big.NewInt(100000), key)
+	}
+	// Insert out of order and check the maximum is tracked
+	for _, i := range []int{3, 7, 5, 0, 9, 1} {
+		m.Put(txs[i])
+	}
+	if last := m.LastElement(); last != txs[9] {
+		t.Fatalf("last element mismatch after insert: have %v, want %v", last, txs[9])
+	}
+	// Overwrite the maximum and check the replacement is returned
+	replacement := pricedTransaction(9, big.NewInt(100000), big.NewInt(2), key)
+	m.Put(replacement)
+	if last := m.LastElement(); last != replacement {
+		t.Fatalf("last element mismatch after overwrite: have %v, want %v", last, replacement)
+	}
+	// Cap away the top of the map, the next highest should be reported
+	m.Cap(4)
+	if last := m.LastElement(); last != txs[5] {
+		t.Fatalf("last element mismatch after cap: have %v, want %v", last, txs[5])
+	}
+	// Forward past a lower nonce, the maximum should be unaffected
+	m.Forward(2)
+	if last := m.LastElement(); last != txs[5] {
+		t.Fatalf("last element mismatch after forward: have %v, want %v", last, txs[5])
+	}
+	// Remove the maximum and check the fallback lookup
+	m.Remove(5)
+	if last := m.LastElement(); last != txs[3] {
+		t.Fatalf("last element mismatch after remove: have %v, want %v", last, txs[3])
+	}
+	// Forward past everything, the map should be empty
+	m.Forward(10)
+	if last := m.LastElement(); last != nil {
+		t.Fatalf("last element mismatch after full forward: have %v, want nil", last)
+	}
+	// A list should forward to its map
+	list := newTxList(false)
+	list.Add(txs[2], DefaultTxPoolConfig.PriceBump)
+	list.Add(txs[6], DefaultTxPoolConfig.PriceBump)
+	if last := list.LastElement(); last != txs[6] {
+		t.Fatalf("list last element mismatch: have %v, want %v", last, txs[6])
+	}
+}
+
+// Tests that the price to beat is derived from the effective tips of the tracked
+// transactions, and is capped at the most expensive one.
+func TestTxPricedListPriceToBeat(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all)
+	if price := priced.PriceToBeat(0); price.Int64() != 1 {
+		t.Fatalf("empty list price to beat mismatch: have %v, want 1", price)
+	}
+	for i, price := range []int64{40, 10, 30, 20, 50} {
+		tx := pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(price), key)
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	// Drop the 30 wei transaction from the pool
+	for hash, tx := range all {
+		if tx.GasPrice().Int64() == 30 {
+			delete(all, hash)
+			priced.Remove(tx)
+		}
+	}
+
+	for rank, want := range []int64{11, 21, 41, 51, 51, 51} {
+		if price := priced.PriceToBeat(rank); price.Int64() != want {
+			t.Errorf("rank %d: price to beat mismatch: have %v, want %d", rank, price, want)
+		}
+	}
+	// Negative ranks are clamped to the cheapest transaction
+	if price := priced.PriceToBeat(-1); price.Int64() != 11 {
+		t.Errorf("negative rank price to beat mismatch: have %v, want 11", price)
+	}
+	// With a base fee, the tips on top of it are to be beaten
+	priced.SetBaseFee(big.NewInt(5))
+	for rank, want := range []int64{6, 16, 36, 46} {
+		if price := priced.PriceToBeat(rank); price.Int64() != want {
+			t.Errorf("rank %d: tip to beat mismatch: have %v, want %d", rank, price, want)
+		}
+	}
+}
+
+// Tests that transactions are removed from the price heap right away, keeping
+// the position index in sync, and that the deprecated Removed still works.
+func TestTxPricedListRemove(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all)
+
+	txs := make(types.Transactions, 64)
+	for i := range txs {
+		txs[i] = pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(rand.Int63n(1000)+1), key)
+		all[txs[i].Hash()] = txs[i]
+		priced.Put(txs[i])
+	}
+	priced.Put(txs[0]) // duplicate insertions should be ignored
+
+	// Remove every third transaction and check the heap invariants
+	for i := 0; i < len(txs); i += 3 {
+		delete(all, txs[i].Hash())
+		priced.Remove(txs[i])
+		priced.Remove(txs[i]) // double removal should be a noop
+	}
+	verify := func() {
+		if priced.items.Len() != len(all) {
+			t.Fatalf("heap size mismatch: have %d, want %d", priced.items.Len(), len(all))
+		}
+		for i, tx := range priced.items.list {
+			if idx, ok := priced.items.index[tx.Hash()]; !ok || idx != i {
+				t.Fatalf("transaction %x index mismatch: have %d (%v), want %d", tx.Hash(), idx, ok, i)
+			}
+			if _, ok := all[tx.Hash()]; !ok {
+				t.Fatalf("removed transaction %x still tracked", tx.Hash())
+			}
+			if i > 0 && priced.items.Less(i, (i-1)/2) {
+				t.Fatalf("heap invariant violated at %d", i)
+			}
+		}
+	}
+	verify()
+
+	// Drop some more from the pool only and reconcile via the deprecated method,
+	// which leaves stale entries around up to the re-heap ratio
+	for i := 1; i < len(txs); i += 3 {
+		delete(all, txs[i].Hash())
+		priced.Removed()
+	}
+	stales := 0
+	for _, tx := range priced.items.list {
+		if _, ok := all[tx.Hash()]; !ok {
+			stales++
+		}
+	}
+	if stales != priced.stales || priced.items.Len()-stales != len(all) {
+		t.Fatalf("stale accounting mismatch: have %d stale of %d, counted %d, want %d live", stales, priced.items.Len(), priced.stales, len(all))
+	}
+	if float64(stales) > defaultReheapRatio*float64(priced.items.Len()) {
+		t.Fatalf("stale entries above re-heap ratio: %d of %d", stales, priced.items.Len())
+	}
+	// Discarding everything should skip over all the stale entries
+	if drops := priced.Discard(len(txs), newAccountSet(types.HomesteadSigner{})); len(drops) != len(all) {
+		t.Fatalf("discarded count mismatch: have %d, want %d", len(drops), len(all))
+	}
+	if priced.items.Len() != 0 || priced.stales != 0 {
+		t.Fatalf("heap not emptied: %d entries, %d stales", priced.items.Len(), priced.stales)
+	}
+}
+
+// Tests that the deprecated stale notifications rebuild the heap exactly once the
+// configured ratio of entries went stale, and that invalid ratios are rejected.
+func TestTxPricedListReheapRatio(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all, withReheapRatio(0.1))
+
+	txs := make(types.Transactions, 100)
+	for i := range txs {
+		txs[i] = pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(int64(i+1)), key)
+		all[txs[i].Hash()] = txs[i]
+		priced.Put(txs[i])
+	}
+	// Dropping up to 10% of the transactions should not trigger a re-heap
+	for i := 0; i < 10; i++ {
+		delete(all, txs[i].Hash())
+		priced.Removed()
+	}
+	if priced.items.Len() != 100 || priced.stales != 10 {
+		t.Fatalf("premature re-heap: have %d entries, %d stales, want 100, 10", priced.items.Len(), priced.stales)
+	}
+	delete(all, txs[10].Hash())
+	priced.Removed()
+	if priced.items.Len() != 89 || priced.stales != 0 {
+		t.Fatalf("re-heap mismatch: have %d entries, %d stales, want 89, 0", priced.items.Len(), priced.stales)
+	}
+	if have := priced.items.list[0]; have != txs[11] {
+		t.Fatalf("cheapest transaction mismatch after re-heap: have price %v, want %v", have.GasPrice(), txs[11].GasPrice())
+	}
+	for _, ratio := range []float64{-1, 0, 1.5} {
+		if l := newTxPricedList(&all, withReheapRatio(ratio)); l.reheapRatio != defaultReheapRatio {
+			t.Errorf("ratio %v: accepted invalid ratio, have %v, want %v", ratio, l.reheapRatio, defaultReheapRatio)
+		}
+	}
+}
+
+// Tests that peeking the cheapest transaction skips over (and gets rid of) heap
+// entries dropped from the pool, as well as local transactions.
+func TestTxPricedListPeek(t *testing.T) {
+	remote, _ := crypto.GenerateKey()
+	owner, _ := crypto.GenerateKey()
+
+	local := newAccountSet(types.HomesteadSigner{})
+	local.add(crypto.PubkeyToAddress(owner.PublicKey))
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all)
+	if tx := priced.Peek(local); tx != nil {
+		t.Fatalf("empty list peek mismatch: have %x, want nil", tx.Hash())
+	}
+	// Interleave remote transactions priced 1..8 with local ones priced 1..4
+	remotes := make(types.Transactions, 8)
+	for i := range remotes {
+		remotes[i] = pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(int64(i+1)), remote)
+		all[remotes[i].Hash()] = remotes[i]
+		priced.Put(remotes[i])
+	}
+	for i := 0; i < 4; i++ {
+		tx := pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(int64(i+1)), owner)
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	// Drop every other remote from the pool without telling the priced list
+	for i := 0; i < len(remotes); i += 2 {
+		delete(all, remotes[i].Hash())
+	}
+	if tx := priced.Peek(local); tx != remotes[1] {
+		t.Fatalf("peek mismatch: have price %v, want %v", tx.GasPrice(), remotes[1].GasPrice())
+	}
+	// The stale head must be gone, with everything else left in the heap
+	if priced.items.Len() != 4+8-1 {
+		t.Errorf("heap size mismatch: have %d, want %d", priced.items.Len(), 4+8-1)
+	}
+	if tx := priced.Peek(local); tx != remotes[1] {
+		t.Errorf("repeated peek mismatch: have price %v, want %v", tx.GasPrice(), remotes[1].GasPrice())
+	}
+	if tx := priced.Peek(newAccountSet(types.HomesteadSigner{})); tx.GasPrice().Int64() != 1 || !local.containsTx(tx) {
+		t.Errorf("peek without locals mismatch: have price %v, want local priced 1", tx.GasPrice())
+	}
+}
+
+// Tests that counting the transactions below a price threshold matches the number
+// of transactions capping at the same threshold drops, without modifying the heap.
+func TestTxPricedListCountBelow(t *testing.T) {
+	remote, _ := crypto.GenerateKey()
+	owner, _ := crypto.GenerateKey()
+
+	local := newAccountSet(types.HomesteadSigner{})
+	local.add(crypto.PubkeyToAddress(owner.PublicKey))
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all)
+	for i := 0; i < 64; i++ {
+		key := remote
+		if i%4 == 0 {
+			key = owner
+		}
+		tx := pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(rand.Int63n(100)+1), key)
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	for _, threshold := range []int64{1, 10, 50, 101} {
+		count := priced.CountBelow(big.NewInt(threshold), local)
+		if priced.items.Len() != 64 {
+			t.Fatalf("threshold %d: heap modified: have %d transactions, want 64", threshold, priced.items.Len())
+		}
+		// Cap a copy of the list to compare against what would actually be dropped
+		capped := newTxPricedList(&all)
+		for _, tx := range priced.items.list {
+			capped.Put(tx)
+		}
+		if drops := capped.Cap(big.NewInt(threshold), local); len(drops) != count {
+			t.Errorf("threshold %d: count mismatch: have %d, cap dropped %d", threshold, count, len(drops))
+		}
+	}
+}
+
+// Tests that checking a batch of transactions for being underpriced gives the same
+// results as checking them one by one.
+func TestTxPricedListUnderpricedBatch(t *testing.T) {
+	remote, _ := crypto.GenerateKey()
+	owner, _ := crypto.GenerateKey()
+
+	local := newAccountSet(types.HomesteadSigner{})
+	local.add(crypto.PubkeyToAddress(owner.PublicKey))
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all)
+	for i := 0; i < 16; i++ {
+		tx := pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(int64(10+i)), remote)
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	// Leave a stale entry at the top of the heap, making 11 the cheapest live price
+	delete(all, priced.items.list[0].Hash())
+	priced.Removed()
+
+	var batch types.Transactions
+	for i, price := range []int64{1, 10, 11, 12, 50, 5, 11, 100} {
+		key := remote
+		if i%2 == 1 {
+			key = owner
+		}
+		batch = append(batch, pricedTransaction(uint64(100+i), big.NewInt(100000), big.NewInt(price), key))
+	}
+	results := priced.UnderpricedBatch(batch, local)
+	if len(results) != len(batch) {
+		t.Fatalf("result count mismatch: have %d, want %d", len(results), len(batch))
+	}
+	for i, tx := range batch {
+		if want := priced.Underpriced(tx, local); results[i] != want {
+			t.Errorf("transaction %d: result mismatch: have %v, want %v", i, results[i], want)
+		}
+	}
+	if !results[0] || !results[2] || results[4] || results[1] {
+		t.Errorf("unexpected results: %v", results)
+	}
+}
+
+// Benchmarks the churn of a full priced list, where each step drops a tracked
+// transaction from the pool and inserts a new one, checking whether it's
+// underpriced. The Removed variants measure the deprecated notification, which
+// needs to scan the entire heap.
+func BenchmarkPricedListChurnRemove100(b *testing.B)    { benchmarkPricedListChurn(b, 100, false) }
+func BenchmarkPricedListChurnRemove1000(b *testing.B)   { benchmarkPricedListChurn(b, 1000, false) }
+func BenchmarkPricedListChurnRemove10000(b *testing.B)  { benchmarkPricedListChurn(b, 10000, false) }
+func BenchmarkPricedListChurnRemoved100(b *testing.B)   { benchmarkPricedListChurn(b, 100, true) }
+func BenchmarkPricedListChurnRemoved1000(b *testing.B)  { benchmarkPricedListChurn(b, 1000, true) }
+func BenchmarkPricedListChurnRemoved10000(b *testing.B) { benchmarkPricedListChurn(b, 10000, true) }
+
+// Benchmarks the same churn through the deprecated notification, re-heaping at
+// different ratios of stale entries.
+func BenchmarkPricedListChurnReheap1pct(b *testing.B) {
+	benchmarkPricedListChurn(b, 10000, true, withReheapRatio(0.01))
+}
+func BenchmarkPricedListChurnReheap25pct(b *testing.B) {
+	benchmarkPricedListChurn(b, 10000, true, withReheapRatio(0.25))
+}
+func BenchmarkPricedListChurnReheap100pct(b *testing.B) {
+	benchmarkPricedListChurn(b, 10000, true, withReheapRatio(1))
+}
+
+func benchmarkPricedListChurn(b *testing.B, size int, notify bool, opts ...pricedListOption) {
+	// Create twice as many transactions as the list holds to cycle through
+	txs := make(types.Transactions, 2*size)
+	for i := range txs {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{}, big.NewInt(0), big.NewInt(100000), big.NewInt(rand.Int63n(1000)+1), nil)
+	}
+	local := newAccountSet(types.HomesteadSigner{})
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all, opts...)
+	for _, tx := range txs[:size] {
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	// Benchmark replacing the oldest transaction with a new one
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		drop, add := txs[i%len(txs)], txs[(i+size)%len(txs)]
+
+		delete(all, drop.Hash())
+		if notify {
+			priced.Removed()
+		} else {
+			priced.Remove(drop)
+		}
+		priced.Underpriced(add, local)
+
+		all[add.Hash()] = add
+		priced.Put(add)
+	}
+}
+
+// Tests that merging maps combines their contents in nonce order, resolving
+// nonce collisions in favour of whichever side the callback picks.
+func TestTxSortedMapMerge(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	var (
+		cheap  = pricedTransaction(2, big.NewInt(100000), big.NewInt(1), key)
+		pricey = pricedTransaction(2, big.NewInt(100000), big.NewInt(2), key)
+	)
+	resolvers := map[string]func(existing, incoming *types.Transaction) *types.Transaction{
+		"existing": func(existing, incoming *types.Transaction) *types.Transaction { return existing },
+		"incoming": func(existing, incoming *types.Transaction) *types.Transaction { return incoming },
+	}
+	for side, resolve := range resolvers {
+		m, other := newTxSortedMap(), newTxSortedMap()
+		for _, nonce := range []uint64{0, 4} {
+			m.Put(transaction(nonce, big.NewInt(100000), key))
+		}
+		m.Put(cheap)
+		for _, nonce := range []uint64{1, 3, 5} {
+			other.Put(transaction(nonce, big.NewInt(100000), key))
+		}
+		other.PutTagged(pricey, "remote")
+		m.Flatten() // populate the cache to check its invalidation
+
+		m.Merge(other, resolve)
+
+		txs := m.Flatten()
+		if len(txs) != 6 {
+			t.Fatalf("%s: merged length mismatch: have %d, want 6", side, len(txs))
+		}
+		for i, tx := range txs {
+			if tx.Nonce() != uint64(i) {
+				t.Errorf("%s: transaction %d: nonce mismatch: have %d, want %d", side, i, tx.Nonce(), i)
+			}
+		}
+		want, tagged := cheap, 0
+		if side == "incoming" {
+			want, tagged = pricey, 1
+		}
+		if m.Get(2) != want {
+			t.Errorf("%s: conflict resolution mismatch: have price %v, want %v", side, m.Get(2).GasPrice(), want.GasPrice())
+		}
+		if have := len(m.FilterByTag("remote")); have != tagged {
+			t.Errorf("%s: tagged transaction count mismatch: have %d, want %d", side, have, tagged)
+		}
+		if last := m.LastElement(); last == nil || last.Nonce() != 5 {
+			t.Errorf("%s: last element mismatch: have %v, want nonce 5", side, last)
+		}
+		if m.Len() != 6-tagged || m.index.Len() != 6-tagged {
+			t.Errorf("%s: size mismatch after tag filtering: have %d items, %d indices, want %d", side, m.Len(), m.index.Len(), 6-tagged)
+		}
+	}
+}
+
+// Benchmarks folding one 10K entry map into another, either with a single
+// Merge or by inserting the transactions one by one.
+func BenchmarkTxSortedMapMerge10000(b *testing.B)   { benchmarkTxSortedMapMerge(b, 10000, true) }
+func BenchmarkTxSortedMapPutLoop10000(b *testing.B) { benchmarkTxSortedMapMerge(b, 10000, false) }
+
+func benchmarkTxSortedMapMerge(b *testing.B, size int, merge bool) {
+	// Create interleaving transactions for the two maps
+	txs := make(types.Transactions, 2*size)
+	for i := range txs {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{}, big.NewInt(0), big.NewInt(100000), big.NewInt(1), nil)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m, other := newTxSortedMap(), newTxSortedMap()
+		for j := 0; j < size; j++ {
+			m.Put(txs[2*j])
+			other.Put(txs[2*j+1])
+		}
+		b.StartTimer()
+
+		if merge {
+			m.Merge(other, nil)
+		} else {
+			for _, tx := range other.items {
+				m.Put(tx)
+			}
+		}
+	}
+}
+
+// Tests that the priced list orders, caps and rejects transactions by their
+// effective tip under the configured base fee.
+func TestTxPricedListBaseFee(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	local := newAccountSet(types.HomesteadSigner{})
+
+	all := make(map[common.Hash]*types.Transaction)
+	priced := newTxPricedList(&all)
+	for i, price := range []int64{30, 10, 50, 20, 40} {
+		tx := pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(price), key)
+		all[tx.Hash()] = tx
+		priced.Put(tx)
+	}
+	tests := []struct {
+		baseFee     *big.Int
+		threshold   int64 // Effective tip below which Cap drops transactions
+		drops       int   // Number of transactions dropped by Cap
+		underpriced int64 // Highest gas price deemed underpriced
+	}{
+		{nil, 15, 1, 20},            // price 10 dropped, cheapest price 20
+		{big.NewInt(5), 16, 2, 30},  // tips 5 and 15 dropped, cheapest tip 25
+		{big.NewInt(25), 10, 3, 40}, // tips -15, -5 and 5 dropped, cheapest tip 15
+	}
+	for i, tt := range tests {
+		priced.SetBaseFee(tt.baseFee)
+
+		// Verify the heap head is the lowest effective tip
+		if head := priced.items.list[0]; head.GasPrice().Int64() != 10 {
+			t.Fatalf("test %d: cheapest transaction mismatch: have %v, want 10", i, head.GasPrice())
+		}
+		drops := priced.Cap(big.NewInt(tt.threshold), local)
+		if len(drops) != tt.drops {
+			t.Errorf("test %d: dropped transaction count mismatch: have %d, want %d", i, len(drops), tt.drops)
+		}
+		// Check underpricing against the new cheapest, then reinsert the drops
+		underpriced := pricedTransaction(0, big.NewInt(100000), big.NewInt(tt.underpriced), key)
+		if !priced.Underpriced(underpriced, local) {
+			t.Errorf("test %d: transaction priced %d not underpriced", i, tt.underpriced)
+		}
+		overpriced := pricedTransaction(0, big.NewInt(100000), big.NewInt(tt.underpriced+1), key)
+		if priced.Underpriced(overpriced, local) {
+			t.Errorf("test %d: transaction priced %d underpriced", i, tt.underpriced+1)
+		}
+		for _, tx := range drops {
+			priced.Put(tx)
+		}
+	}
+}
+
+// Tests that retrieving a limited number of ready transactions leaves the rest
+// of the map intact and consistently sorted.
+func TestTxSortedMapReadyN(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	m := newTxSortedMap()
+	for _, nonce := range []uint64{0, 1, 2, 3, 4, 6, 7} {
+		m.Put(transaction(nonce, big.NewInt(100000), key))
+	}
+	m.Flatten() // populate the cache to check it's maintained
+
+	if ready := m.ReadyN(0, 0); ready != nil || m.Len() != 7 {
+		t.Fatalf("zero limit mismatch: have %d ready, %d left, want 0 ready, 7 left", len(ready), m.Len())
+	}
+	check := func(txs types.Transactions, nonces ...uint64) {
+		if len(txs) != len(nonces) {
+			t.Fatalf("transaction count mismatch: have %d, want %d", len(txs), len(nonces))
+		}
+		for i, tx := range txs {
+			if tx.Nonce() != nonces[i] {
+				t.Fatalf("transaction %d: nonce mismatch: have %d, want %d", i, tx.Nonce(), nonces[i])
+			}
+		}
+	}
+	check(m.ReadyN(0, 2), 0, 1)
+	check(m.Flatten(), 2, 3, 4, 6, 7)
+
+	// A limit above the available transactions should stop at the gap like Ready
+	check(m.ReadyN(2, 100), 2, 3, 4)
+	check(m.Flatten(), 6, 7)
+
+	// The list should forward to its map
+	list := newTxList(false)
+	for _, nonce := range []uint64{5, 6, 7} {
+		list.Add(transaction(nonce, big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+	}
+	check(list.ReadyN(5, 2), 5, 6)
+	check(list.Flatten(), 7)
+}
+
+// Tests that ranging over a map visits the transactions in nonce order and
+// terminates early when requested, leaving the map untouched.
+func TestTxSortedMapRange(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	m := newTxSortedMap()
+	for _, i := range rand.Perm(10) {
+		m.Put(transaction(uint64(i), big.NewInt(int64(100000+i*1000)), key))
+	}
+	// Range until the first transaction above a gas limit
+	var visited []uint64
+	m.Range(func(tx *types.Transaction) bool {
+		visited = append(visited, tx.Nonce())
+		return tx.Gas().Cmp(big.NewInt(104000)) <= 0
+	})
+	if len(visited) != 6 {
+		t.Fatalf("visited transaction count mismatch: have %d, want 6", len(visited))
+	}
+	for i, nonce := range visited {
+		if nonce != uint64(i) {
+			t.Fatalf("visit %d: nonce mismatch: have %d, want %d", i, nonce, i)
+		}
+	}
+	// A full iteration should visit everything, reusing the cache
+	count := 0
+	m.Range(func(tx *types.Transaction) bool {
+		count++
+		return true
+	})
+	if count != m.Len() || count != 10 {
+		t.Fatalf("full range count mismatch: have %d, want %d", count, m.Len())
+	}
+}
+
+// Tests that positional lookups follow the nonce order, and keep doing so after
+// the map is modified.
+func TestTxSortedMapAt(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	m := newTxSortedMap()
+	for _, nonce := range rand.Perm(16) {
+		m.Put(transaction(uint64(2*nonce), big.NewInt(100000), key))
+	}
+	check := func(step string, want int) {
+		for i := 0; i < want; i++ {
+			tx := m.At(i)
+			if tx == nil {
+				t.Fatalf("%s: index %d: transaction missing", step, i)
+			}
+			if i > 0 && tx.Nonce() <= m.At(i-1).Nonce() {
+				t.Errorf("%s: index %d: nonce %d not above previous %d", step, i, tx.Nonce(), m.At(i-1).Nonce())
+			}
+		}
+		for _, index := range []int{-1, want} {
+			if tx := m.At(index); tx != nil {
+				t.Errorf("%s: out of range index %d: have nonce %d, want nil", step, index, tx.Nonce())
+			}
+		}
+	}
+	check("initial", 16)
+
+	// Insert a transaction into a gap in front of the cached order
+	m.Put(transaction(1, big.NewInt(100000), key))
+	check("insert", 17)
+	if tx := m.At(1); tx.Nonce() != 1 {
+		t.Errorf("inserted transaction position mismatch: have nonce %d at index 1, want 1", tx.Nonce())
+	}
+	m.Remove(0)
+	check("remove", 16)
+	if tx := m.At(0); tx.Nonce() != 1 {
+		t.Errorf("first transaction mismatch after removal: have nonce %d, want 1", tx.Nonce())
+	}
+}
+
+// Tests that the longest contiguous run is reported without modifying the map.
+func TestTxSortedMapLongestRun(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	m := newTxSortedMap()
+	for _, nonce := range []uint64{3, 4, 5, 7, 8} {
+		m.Put(transaction(nonce, big.NewInt(100000), key))
+	}
+	tests := []struct {
+		start  uint64
+		length int
+		end    uint64
+	}{
+		{3, 3, 6},
+		{4, 2, 6},
+		{6, 0, 6},
+		{7, 2, 9},
+		{0, 0, 0},
+	}
+	for i, tt := range tests {
+		if length, end := m.LongestRun(tt.start); length != tt.length || end != tt.end {
+			t.Errorf("test %d: run mismatch: have (%d, %d), want (%d, %d)", i, length, end, tt.length, tt.end)
+		}
+	}
+	if m.Len() != 5 {
+		t.Errorf("map modified: have %d transactions, want 5", m.Len())
+	}
+}
+
+// Tests that presence checks report stored nonces, and stop doing so once the
+// transactions are removed.
+func TestTxSortedMapHas(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	m := newTxSortedMap()
+	for _, nonce := range []uint64{1, 2, 4} {
+		m.Put(transaction(nonce, big.NewInt(100000), key))
+	}
+	for nonce, want := range map[uint64]bool{0: false, 1: true, 2: true, 3: false, 4: true, 5: false} {
+		if have := m.Has(nonce); have != want {
+			t.Errorf("nonce %d: presence mismatch: have %v, want %v", nonce, have, want)
+		}
+	}
+	m.Remove(2)
+	m.Forward(2)
+	for _, nonce := range []uint64{1, 2} {
+		if m.Has(nonce) {
+			t.Errorf("nonce %d: present after removal", nonce)
+		}
+	}
+	if !m.Has(4) {
+		t.Errorf("nonce 4: missing after unrelated removals")
+	}
+}
+
+// Tests that capping by price retains the highest priced transactions regardless
+// of their nonces, keeping the map's index consistent.
+func TestTxSortedMapCapByPrice(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	m := newTxSortedMap()
+	prices := []int64{5, 1, 9, 3, 7, 3, 8, 2}
+	for i, price := range prices {
+		m.Put(pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(price), key))
+	}
+	if drops := m.CapByPrice(len(prices)); drops != nil {
+		t.Fatalf("dropped %d transactions below the limit", len(drops))
+	}
+	drops := m.CapByPrice(4)
+	if len(drops) != 4 {
+		t.Fatalf("dropped count mismatch: have %d, want 4", len(drops))
+	}
+	for _, tx := range drops {
+		if price := tx.GasPrice().Int64(); price > 3 {
+			t.Errorf("dropped transaction priced %d above the retained ones", price)
+		}
+	}
+	// The retained ones must be the 4 most expensive, still sorted by nonce
+	want := []uint64{0, 2, 4, 6}
+
+	txs := m.Flatten()
+	if len(txs) != len(want) {
+		t.Fatalf("retained count mismatch: have %d, want %d", len(txs), len(want))
+	}
+	for i, tx := range txs {
+		if tx.Nonce() != want[i] {
+			t.Errorf("retained transaction %d: nonce mismatch: have %d, want %d", i, tx.Nonce(), want[i])
+		}
+	}
+	// The rebuilt nonce index must be consistent with the remaining items
+	if first := m.Forward(1); len(first) != 1 || first[0].Nonce() != 0 {
+		t.Errorf("forward mismatch: have %d transactions, want nonce 0", len(first))
+	}
+	if last := m.LastElement(); last == nil || last.Nonce() != 6 {
+		t.Errorf("last element mismatch: have %v, want nonce 6", last)
+	}
+}
+
+// Tests that rejected insertions report whether the transaction was already
+// known or an underpriced replacement.
+func TestTxListAddWithReason(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	list := newTxList(false)
+	orig := pricedTransaction(0, big.NewInt(100000), big.NewInt(1), key)
+	if inserted, old, err := list.AddWithReason(orig, 10); !inserted || old != nil || err != nil {
+		t.Fatalf("initial insert mismatch: have (%v, %v, %v), want (true, nil, nil)", inserted, old, err)
+	}
+	tests := []struct {
+		tx       *types.Transaction
+		inserted bool
+		err      error
+	}{
+		{orig, false, ErrAlreadyKnown},
+		// A 10% bump on 1 wei rounds down to 1 wei, the price must still grow
+		{pricedTransaction(0, big.NewInt(200000), big.NewInt(1), key), false, ErrReplaceUnderpriced},
+		{pricedTransaction(0, big.NewInt(100000), big.NewInt(2), key), true, nil},
+		// The same price with different contents is an underpriced replacement too
+		{pricedTransaction(0, big.NewInt(200000), big.NewInt(2), key), false, ErrReplaceUnderpriced},
+		{pricedTransaction(0, big.NewInt(100000), big.NewInt(3), key), true, nil},
+	}
+	for i, tt := range tests {
+		inserted, _, err := list.AddWithReason(tt.tx, 10)
+		if inserted != tt.inserted || err != tt.err {
+			t.Errorf("test %d: result mismatch: have (%v, %v), want (%v, %v)", i, inserted, err, tt.inserted, tt.err)
+		}
+	}
+}
+
+// Tests that replacements are accepted exactly from fractional percent price
+// bumps on, even when the bump rounds away at Wei-level prices.
+func TestTxListAddBps(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		bumpBps  uint64
+		oldPrice int64
+		newPrice int64
+		inserted bool
+	}{
+		{50, 1000, 1004, false},
+		{50, 1000, 1005, true},
+		{1, 10000, 10000, false},
+		{1, 10000, 10001, true},
+		{1, 20000, 20001, false},
+		{1, 20000, 20002, true},
+		// The bump on 100 wei rounds down to zero, but the price must still grow
+		{1, 100, 100, false},
+		{1, 100, 101, true},
+	}
+	for i, tt := range tests {
+		list := newTxList(false)
+		list.AddBps(pricedTransaction(0, big.NewInt(100000), big.NewInt(tt.oldPrice), key), tt.bumpBps)
+
+		if inserted, _ := list.AddBps(pricedTransaction(0, big.NewInt(100000), big.NewInt(tt.newPrice), key), tt.bumpBps); inserted != tt.inserted {
+			t.Errorf("test %d: replacement mismatch: have %v, want %v", i, inserted, tt.inserted)
+		}
+	}
+}
+
+// Tests that transactions priced below the minimum gas price of a list are
+// rejected, even as replacements, while the ones at or above it are accepted.
+func TestTxListMinGasPrice(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	list := newTxList(false)
+	list.Add(pricedTransaction(0, big.NewInt(100000), big.NewInt(1), key), DefaultTxPoolConfig.PriceBump)
+	list.SetMinGasPrice(big.NewInt(10))
+
+	tests := []struct {
+		nonce    uint64
+		price    int64
+		inserted bool
+		err      error
+	}{
+		{1, 9, false, ErrUnderpriced},
+		{1, 10, true, nil},
+		{2, 11, true, nil},
+		{0, 5, false, ErrUnderpriced}, // still a valid replacement without the floor
+		{0, 10, true, nil},
+	}
+	for i, tt := range tests {
+		inserted, _, err := list.AddWithReason(pricedTransaction(tt.nonce, big.NewInt(100000), big.NewInt(tt.price), key), DefaultTxPoolConfig.PriceBump)
+		if inserted != tt.inserted || err != tt.err {
+			t.Errorf("test %d: result mismatch: have (%v, %v), want (%v, %v)", i, inserted, err, tt.inserted, tt.err)
+		}
+	}
+	list.SetMinGasPrice(nil)
+	if inserted, _ := list.Add(pricedTransaction(3, big.NewInt(100000), big.NewInt(1), key), DefaultTxPoolConfig.PriceBump); !inserted {
+		t.Errorf("transaction rejected with the floor disabled")
+	}
+}
+
+// Tests that read snapshots can be used concurrently with list modifications and
+// that readers never observe a partially updated list.
+func TestTxListReadSnapshot(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	txs := make(types.Transactions, 256)
+	for i := 0; i < len(txs); i++ {
+		txs[i] = transaction(uint64(i), big.NewInt(100000), key)
+	}
+	list := newTxList(true)
+	list.EnableSnapshots()
+
+	var (
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+		errc = make(chan error, 4)
+	)
+	for i := 0; i < cap(errc); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				view := list.ReadSnapshot()
+				flat := view.Flatten()
+				if len(flat) != view.Len() {
+					errc <- fmt.Errorf("length mismatch: flattened %d, reported %d", len(flat), view.Len())
+					return
+				}
+				for j, tx := range flat {
+					if j > 0 && tx.Nonce() != flat[j-1].Nonce()+1 {
+						errc <- fmt.Errorf("nonce gap: %d after %d", tx.Nonce(), flat[j-1].Nonce())
+						return
+					}
+					if view.Get(tx.Nonce()) != tx {
+						errc <- fmt.Errorf("lookup mismatch for nonce %d", tx.Nonce())
+						return
+					}
+				}
+			}
+		}()
+	}
+	// Keep growing the list at the top and shrinking it at the bottom
+	for i, tx := range txs {
+		list.Add(tx, DefaultTxPoolConfig.PriceBump)
+		if i%8 == 7 {
+			list.Forward(uint64(i - 4))
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	select {
+	case err := <-errc:
+		t.Fatal(err)
+	default:
+	}
+	if view := list.ReadSnapshot(); view.Len() != list.Len() {
+		t.Fatalf("final snapshot length mismatch: have %d, want %d", view.Len(), list.Len())
+	}
+}
+
+// Tests that read snapshots are only published once enabled, and that earlier
+// views are left untouched by subsequent modifications.
+func TestTxListReadSnapshotEnable(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	list := newTxList(true)
+	for i := 0; i < 4; i++ {
+		list.Add(transaction(uint64(i), big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+		if list.snapshot.Load() != nil {
+			t.Fatalf("snapshot published while disabled after %d insertions", i+1)
+		}
+	}
+	if view := list.ReadSnapshot(); view.Len() != 0 {
+		t.Fatalf("disabled snapshot length mismatch: have %d, want 0", view.Len())
+	}
+	list.EnableSnapshots()
+
+	view := list.ReadSnapshot()
+	if view.Len() != 4 {
+		t.Fatalf("snapshot length mismatch: have %d, want %d", view.Len(), 4)
+	}
+	if again := list.ReadSnapshot(); again != view {
+		t.Errorf("snapshot republished without modifications")
+	}
+	list.Forward(2)
+	if view.Len() != 4 || view.Get(0) == nil {
+		t.Errorf("earlier view modified: have %d transactions", view.Len())
+	}
+	if view := list.ReadSnapshot(); view.Len() != 2 || view.Get(0) != nil || view.Get(2) == nil {
+		t.Errorf("new snapshot mismatch: have %v", view.Flatten())
+	}
+	// Clones inherit the publishing of snapshots
+	if view := list.Clone().ReadSnapshot(); view.Len() != 2 {
+		t.Errorf("clone snapshot length mismatch: have %d, want 2", view.Len())
+	}
+}
+
+// Tests that the eviction cost of a transaction accounts for the transactions a
+// removal would invalidate in strict mode, but only for the removed one otherwise.
+func TestTxListEvictionCost(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	for _, strict := range []bool{false, true} {
+		list := newTxList(strict)
+		for i := 0; i < 10; i++ {
+			list.Add(transaction(uint64(i), big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+		}
+		want := map[uint64]int{0: 1, 6: 1, 9: 1, 10: 0}
+		if strict {
+			want = map[uint64]int{0: 10, 6: 4, 9: 1, 10: 0}
+		}
+		for nonce, cost := range want {
+			if have := list.EvictionCost(nonce); have != cost {
+				t.Errorf("strict %v, nonce %d: eviction cost mismatch: have %d, want %d", strict, nonce, have, cost)
+			}
+		}
+		// The cost must match what the removal actually drops
+		_, invalids := list.Remove(list.txs.Get(6))
+		if have := 1 + len(invalids); have != want[6] {
+			t.Errorf("strict %v: removal drop count mismatch: have %d, want %d", strict, have, want[6])
+		}
+	}
+}
+
+// Tests that the nonce gaps of a list are reported between the start nonce and
+// the highest nonce in the list.
+func TestTxListGaps(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		nonces []uint64
+		start  uint64
+		gaps   []uint64
+	}{
+		{nil, 0, nil},
+		{[]uint64{0, 1, 2, 3}, 0, nil},
+		{[]uint64{3, 4, 5}, 3, nil},
+		{[]uint64{0, 1, 3, 4}, 0, []uint64{2}},
+		{[]uint64{3, 4, 7}, 1, []uint64{1, 2, 5, 6}},
+		{[]uint64{0, 1, 4, 5}, 3, []uint64{3}},
+	}
+	for i, tt := range tests {
+		list := newTxList(false)
+		for _, nonce := range tt.nonces {
+			list.Add(transaction(nonce, big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+		}
+		gaps := list.Gaps(tt.start)
+		if len(gaps) != len(tt.gaps) {
+			t.Errorf("test %d: gaps mismatch: have %v, want %v", i, gaps, tt.gaps)
+			continue
+		}
+		for j := range gaps {
+			if gaps[j] != tt.gaps[j] {
+				t.Errorf("test %d: gaps mismatch: have %v, want %v", i, gaps, tt.gaps)
+				break
+			}
+		}
+	}
+}
+
+// Tests that the number of ready transactions is reported without retrieving them,
+// matching what Ready would actually return.
+func TestTxListReadyCount(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		nonces []uint64
+		start  uint64
+		count  int
+	}{
+		{nil, 0, 0},
+		{[]uint64{0, 1, 2, 3}, 0, 4},
+		{[]uint64{0, 1, 3, 4}, 0, 2},
+		{[]uint64{1, 2, 3}, 0, 0},
+		{[]uint64{2, 3, 4, 6}, 2, 3},
+		// Transactions below the start nonce are counted from the lowest one
+		{[]uint64{1, 2, 3, 4}, 3, 4},
+		{[]uint64{1, 2, 5, 6}, 5, 2},
+	}
+	for i, tt := range tests {
+		list := newTxList(false)
+		for _, nonce := range tt.nonces {
+			list.Add(transaction(nonce, big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+		}
+		list.Flatten()
+		cache := list.txs.cache
+
+		if count := list.ReadyCount(tt.start); count != tt.count {
+			t.Errorf("test %d: ready count mismatch: have %d, want %d", i, count, tt.count)
+		}
+		if list.Len() != len(tt.nonces) || len(list.txs.cache) != len(cache) {
+			t.Errorf("test %d: list modified", i)
+		}
+		if ready := list.Ready(tt.start); len(ready) != tt.count {
+			t.Errorf("test %d: ready mismatch: have %d, want %d", i, len(ready), tt.count)
+		}
+	}
+}
+
+// Tests that forwarding a list reports the contiguous prefix of the removed
+// transactions separately from gapped leftovers.
+func TestTxListForwardReport(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		nonces     []uint64
+		threshold  uint64
+		removed    int
+		contiguous int
+	}{
+		{nil, 5, 0, 0},
+		{[]uint64{3, 4, 5}, 3, 0, 0},
+		{[]uint64{0, 1, 2, 3}, 3, 3, 3},
+		{[]uint64{0, 1, 3, 4, 6}, 5, 4, 2},
+		{[]uint64{2, 5, 6, 7}, 7, 3, 1},
+		{[]uint64{4, 5, 6, 7}, 10, 4, 4},
+	}
+	for i, tt := range tests {
+		list := newTxList(false)
+		for _, nonce := range tt.nonces {
+			list.Add(transaction(nonce, big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+		}
+		removed, contiguous := list.ForwardReport(tt.threshold)
+		if len(removed) != tt.removed || contiguous != tt.contiguous {
+			t.Errorf("test %d: report mismatch: have (%d, %d), want (%d, %d)", i, len(removed), contiguous, tt.removed, tt.contiguous)
+		}
+		if list.Len() != len(tt.nonces)-tt.removed {
+			t.Errorf("test %d: remaining count mismatch: have %d, want %d", i, list.Len(), len(tt.nonces)-tt.removed)
+		}
+	}
+}
+
+// Tests that the running cost and gas totals of a list match the sums over its
+// contents through insertions, replacements and all kinds of removals, including
+// the cascading strict-mode invalidations.
+func TestTxListTotals(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	verify := func(step string, list *txList) {
+		cost, gas := new(big.Int), uint64(0)
+		for _, tx := range list.Flatten() {
+			cost.Add(cost, tx.Cost())
+			gas += tx.Gas().Uint64()
+		}
+		if list.TotalCost().Cmp(cost) != 0 {
+			t.Errorf("%s: total cost mismatch: have %v, want %v", step, list.TotalCost(), cost)
+		}
+		if list.TotalGas() != gas {
+			t.Errorf("%s: total gas mismatch: have %d, want %d", step, list.TotalGas(), gas)
+		}
+	}
+	for _, strict := range []bool{false, true} {
+		list := newTxList(strict)
+		for i := 0; i < 16; i++ {
+			list.Add(pricedTransaction(uint64(i), big.NewInt(int64(100000+i*1000)), big.NewInt(int64(1+i)), key), DefaultTxPoolConfig.PriceBump)
+		}
+		verify("add", list)
+
+		list.Add(pricedTransaction(3, big.NewInt(250000), big.NewInt(100), key), DefaultTxPoolConfig.PriceBump)
+		verify("replace", list)
+
+		list.Forward(2)
+		verify("forward", list)
+
+		list.Filter(big.NewInt(2000000), big.NewInt(112000))
+		verify("filter", list)
+
+		list.Remove(list.Flatten()[len(list.Flatten())/2])
+		verify("remove", list)
+
+		list.Ready(2)
+		verify("ready", list)
+
+		for i := 32; i < 40; i++ {
+			list.Add(pricedTransaction(uint64(i), big.NewInt(100000), big.NewInt(1), key), DefaultTxPoolConfig.PriceBump)
+		}
+		list.Cap(4)
+		verify("cap", list)
+
+		list.Remove(list.Flatten()[0])
+		verify("remove first", list)
+	}
+}
+
+// Tests that block streaming yields transactions by price while honouring the
+// account nonces, and that an account stalled by a transaction not fitting the
+// remaining gas is skipped entirely.
+func TestStreamForBlock(t *testing.T) {
+	key1, _ := crypto.GenerateKey()
+	key2, _ := crypto.GenerateKey()
+
+	list1, list2 := newTxList(true), newTxList(true)
+	txs1 := types.Transactions{
+		pricedTransaction(0, big.NewInt(100000), big.NewInt(3), key1),
+		pricedTransaction(1, big.NewInt(100000), big.NewInt(1), key1),
+	}
+	txs2 := types.Transactions{
+		pricedTransaction(0, big.NewInt(100000), big.NewInt(2), key2),
+		pricedTransaction(1, big.NewInt(500000), big.NewInt(2), key2),
+		pricedTransaction(2, big.NewInt(21000), big.NewInt(5), key2),
+	}
+	for _, tx := range txs1 {
+		list1.Add(tx, DefaultTxPoolConfig.PriceBump)
+	}
+	for _, tx := range txs2 {
+		list2.Add(tx, DefaultTxPoolConfig.PriceBump)
+	}
+	lists := map[common.Address]*txList{
+		crypto.PubkeyToAddress(key1.PublicKey): list1,
+		crypto.PubkeyToAddress(key2.PublicKey): list2,
+	}
+	gp := new(GasPool).AddGas(big.NewInt(350000))
+	next := StreamForBlock(lists, gp)
+
+	var streamed types.Transactions
+	for tx, ok := next(); ok; tx, ok = next() {
+		streamed = append(streamed, tx)
+	}
+	want := types.Transactions{txs1[0], txs2[0], txs1[1]}
+	if len(streamed) != len(want) {
+		t.Fatalf("streamed transaction count mismatch: have %d, want %d", len(streamed), len(want))
+	}
+	for i, tx := range streamed {
+		if tx != want[i] {
+			t.Errorf("transaction %d: mismatch: have nonce %d price %v, want nonce %d price %v", i, tx.Nonce(), tx.GasPrice(), want[i].Nonce(), want[i].GasPrice())
+		}
+	}
+	if left := (*big.Int)(gp).Uint64(); left != 50000 {
+		t.Errorf("remaining gas mismatch: have %d, want %d", left, 50000)
+	}
+	if _, ok := next(); ok {
+		t.Errorf("exhausted stream yielded a transaction")
+	}
+}
+
+// Tests that modifying a cloned list leaves the original one untouched.
+func TestTxListClone(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	list := newTxList(true)
+	for i := 0; i < 8; i++ {
+		list.Add(transaction(uint64(i), big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+	}
+	orig := list.Flatten()
+	cost, gas := list.TotalCost(), list.TotalGas()
+
+	clone := list.Clone()
+	clone.Add(pricedTransaction(2, big.NewInt(100000), big.NewInt(10), key), DefaultTxPoolConfig.PriceBump)
+	clone.Add(transaction(8, big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+	clone.Remove(orig[5])
+	clone.Forward(1)
+	clone.Filter(big.NewInt(0), big.NewInt(0))
+
+	if !clone.Empty() {
+		t.Fatalf("clone not emptied: %d transactions left", clone.Len())
+	}
+	txs := list.Flatten()
+	if len(txs) != len(orig) {
+		t.Fatalf("original length changed: have %d, want %d", len(txs), len(orig))
+	}
+	for i, tx := range txs {
+		if tx != orig[i] {
+			t.Errorf("transaction %d: original modified", i)
+		}
+	}
+	if list.TotalCost().Cmp(cost) != 0 || list.TotalGas() != gas {
+		t.Errorf("original totals changed: have (%v, %d), want (%v, %d)", list.TotalCost(), list.TotalGas(), cost, gas)
+	}
+	if list.costcap.Sign() == 0 || list.gascap.Sign() == 0 {
+		t.Errorf("original caps reset: cost %v, gas %v", list.costcap, list.gascap)
+	}
+	if ready := list.Ready(0); len(ready) != len(orig) {
+		t.Errorf("original ready count mismatch: have %d, want %d", len(ready), len(orig))
+	}
+}
+
+// Tests that filtering returns both the removed and the strict-mode invalidated
+// transactions in ascending nonce order.
+func TestTxListFilterSorted(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	sorted := func(txs types.Transactions) bool {
+		for i := 1; i < len(txs); i++ {
+			if txs[i].Nonce() <= txs[i-1].Nonce() {
+				return false
+			}
+		}
+		return true
+	}
+	list := newTxList(true)
+	for i := 0; i < 64; i++ {
+		// Make every third transaction too expensive for the filter
+		gas := big.NewInt(100000)
+		if i%3 == 2 {
+			gas = big.NewInt(200000)
+		}
+		list.Add(transaction(uint64(i), gas, key), DefaultTxPoolConfig.PriceBump)
+	}
+	// Nonce 2 is the lowest removed one, invalidating all others above it
+	removed, invalids := list.Filter(big.NewInt(1000000), big.NewInt(150000))
+	if len(removed) != 21 || !sorted(removed) {
+		t.Errorf("removed transactions mismatch: have %d, sorted %v, want 21 sorted", len(removed), sorted(removed))
+	}
+	if len(invalids) != 41 || !sorted(invalids) {
+		t.Errorf("invalidated transactions mismatch: have %d, sorted %v, want 41 sorted", len(invalids), sorted(invalids))
+	}
+}
+
+// Tests that transactions are evicted based on their arrival times, cascading to
+// the higher nonces in strict mode, and that the arrival times are maintained
+// throughout replacements and other removals.
+func TestTxListEvictOlderThan(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	base := time.Unix(1500000000, 0)
+	arrivals := []time.Duration{0, time.Minute, 5 * time.Minute, 2 * time.Minute, 6 * time.Minute, 7 * time.Minute, 8 * time.Minute}
+
+	for _, strict := range []bool{false, true} {
+		now := base
+		list := newTxList(strict)
+		list.TrackArrivals(func() time.Time { return now })
+
+		for i, arrival := range arrivals {
+			now = base.Add(arrival)
+			list.Add(transaction(uint64(i), big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+		}
+		// Replace nonce 1 later on, which must not renew its arrival time
+		now = base.Add(10 * time.Minute)
+		if inserted, _ := list.Add(pricedTransaction(1, big.NewInt(100000), big.NewInt(2), key), DefaultTxPoolConfig.PriceBump); !inserted {
+			t.Fatalf("strict %v: replacement rejected", strict)
+		}
+		// Drop some transactions from both ends via other means
+		list.Forward(1)
+		list.Cap(5)
+		for _, nonce := range []uint64{0, 6} {
+			if _, ok := list.arrivals[nonce]; ok {
+				t.Errorf("strict %v: arrival of removed nonce %d retained", strict, nonce)
+			}
+		}
+		if evicted := list.EvictOlderThan(base); len(evicted) != 0 {
+			t.Errorf("strict %v: evicted %d transactions before the first arrival", strict, len(evicted))
+		}
+		// Evict everything older than 3 minutes: nonces 1 and 3
+		evicted := list.EvictOlderThan(base.Add(3 * time.Minute))
+
+		want := []uint64{1, 3}
+		if strict {
+			want = []uint64{1, 2, 3, 4, 5}
+		}
+		if len(evicted) != len(want) {
+			t.Fatalf("strict %v: evicted count mismatch: have %d, want %d", strict, len(evicted), len(want))
+		}
+		for i, tx := range evicted {
+			if tx.Nonce() != want[i] {
+				t.Errorf("strict %v: eviction %d: nonce mismatch: have %d, want %d", strict, i, tx.Nonce(), want[i])
+			}
+		}
+		if len(list.arrivals) != list.Len() {
+			t.Errorf("strict %v: arrival count mismatch: have %d, want %d", strict, len(list.arrivals), list.Len())
+		}
+	}
+}
+
+// Tests that lists don't track arrival times unless asked to, evicting nothing,
+// and that enabling tracking accounts the transactions already in the list.
+func TestTxListTrackArrivals(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	list := newTxList(true)
+	for i := 0; i < 3; i++ {
+		list.Add(transaction(uint64(i), big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+	}
+	if list.arrivals != nil {
+		t.Fatalf("arrivals tracked without being enabled")
+	}
+	if evicted := list.EvictOlderThan(time.Now().Add(time.Hour)); len(evicted) != 0 {
+		t.Fatalf("evicted %d transactions without tracking arrivals", len(evicted))
+	}
+	now := time.Unix(1500000000, 0)
+	list.TrackArrivals(func() time.Time { return now })
+
+	now = now.Add(time.Minute)
+	list.Add(transaction(3, big.NewInt(100000), key), DefaultTxPoolConfig.PriceBump)
+
+	if evicted := list.EvictOlderThan(now); len(evicted) != 4 {
+		t.Errorf("evicted count mismatch: have %d, want 4", len(evicted))
+	}
+}
+
+// Tests that transaction lists survive an RLP round trip, with all derived data
+// rebuilt on decoding.
+func TestTxListRLP(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		strict bool
+		nonces []uint64
+	}{
+		{false, nil},
+		{true, []uint64{0, 1, 2, 3}},
+		{true, []uint64{0, 1, 4, 7, 8}},
+		{false, []uint64{9, 3, 5}},
+	}
+	for i, tt := range tests {
+		list := newTxList(tt.strict)
+		for j, nonce := range tt.nonces {
+			list.Add(pricedTransaction(nonce, big.NewInt(int64(100000+j)), big.NewInt(int64(j+1)), key), DefaultTxPoolConfig.PriceBump)
+		}
+		blob, err := rlp.EncodeToBytes(list)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode list: %v", i, err)
+		}
+		dec := new(txList)
+		if err := rlp.DecodeBytes(blob, dec); err != nil {
+			t.Fatalf("test %d: failed to decode list: %v", i, err)
+		}
+		if dec.strict != list.strict {
+			t.Errorf("test %d: strictness mismatch: have %v, want %v", i, dec.strict, list.strict)
+		}
+		have, want := dec.Flatten(), list.Flatten()
+		if len(have) != len(want) {
+			t.Fatalf("test %d: length mismatch: have %d, want %d", i, len(have), len(want))
+		}
+		for j := range have {
+			if have[j].Hash() != want[j].Hash() {
+				t.Errorf("test %d: transaction %d mismatch", i, j)
+			}
+		}
+		if dec.costcap.Cmp(list.costcap) != 0 || dec.gascap.Cmp(list.gascap) != 0 {
+			t.Errorf("test %d: caps mismatch: have (%v, %v), want (%v, %v)", i, dec.costcap, dec.gascap, list.costcap, list.gascap)
+		}
+		if dec.TotalCost().Cmp(list.TotalCost()) != 0 || dec.TotalGas() != list.TotalGas() {
+			t.Errorf("test %d: totals mismatch", i)
+		}
+		if dec.EnableSnapshots(); dec.ReadSnapshot().Len() != len(want) {
+			t.Errorf("test %d: snapshot length mismatch: have %d, want %d", i, dec.ReadSnapshot().Len(), len(want))
+		}
+		// The rebuilt index must support the regular operations
+		if ready := dec.Ready(0); len(ready) != list.ReadyCount(0) {
+			t.Errorf("test %d: ready count mismatch: have %d, want %d", i, len(ready), list.ReadyCount(0))
+		}
+	}
+}
+
+// Tests that decoding a transaction list with duplicate nonces is rejected.
+func TestTxListRLPDuplicateNonce(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	blob, _ := rlp.EncodeToBytes(&rlpTxList{Txs: types.Transactions{
+		pricedTransaction(0, big.NewInt(100000), big.NewInt(1), key),
+		pricedTransaction(0, big.NewInt(100000), big.NewInt(2), key),
+	}})
+	if err := rlp.DecodeBytes(blob, new(txList)); err != errDuplicateNonce {
+		t.Fatalf("decode error mismatch: have %v, want %v", err, errDuplicateNonce)
+	}
+}
+
+// Tests that the concurrency safe sorted map can be used from many goroutines at
+// once. It's meant to be run with the race detector enabled.
+func TestSyncSortedMapConcurrency(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	txs := make(types.Transactions, 256)
+	for i := range txs {
+		txs[i] = transaction(uint64(i), big.NewInt(100000), key)
+	}
+	m := NewSyncSortedMap()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j, tx := range txs {
+				switch (id + j) % 8 {
+				case 0:
+					m.Forward(tx.Nonce() / 2)
+				case 1:
+					m.Filter(func(tx *types.Transaction) bool { return tx.Nonce()%7 == 0 })
+				case 2:
+					m.Cap(128)
+				case 3:
+					m.Remove(tx.Nonce())
+				case 4:
+					m.Ready(tx.Nonce())
+				default:
+					m.Put(tx)
+				}
+				m.Get(tx.Nonce())
+				m.Has(tx.Nonce())
+				if flat := m.Flatten(); !sort.IsSorted(types.TxByNonce(flat)) {
+					t.Errorf("worker %d: flattened transactions not sorted", id)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if flat := m.Flatten(); len(flat) != m.Len() {
+		t.Fatalf("length mismatch: flattened %d, reported %d", len(flat), m.Len())
+	}
+}
@@ -58,6 +58,10 @@ var (
 	// with a different one without the required price bump.
 	ErrReplaceUnderpriced = errors.New("replacement transaction underpriced")
 
+	// ErrAlreadyKnown is returned if a transaction is attempted to be replaced
+	// with the exact same one.
+	ErrAlreadyKnown = errors.New("already known")
+
 	// ErrInsufficientFunds is returned if the total cost of executing a transaction
 	// is higher than the balance of the user's account.
 	ErrInsufficientFunds = errors.New("insufficient funds for gas * price + value")
@@ -285,7 +289,7 @@ func (pool *TxPool) loop() {
 	defer pool.wg.Done()
 
 	// Start the stats reporting and transaction eviction tickers
-	var prevPending, prevQueued, prevStales int
+	var prevPending, prevQueued int
 
 	report := time.NewTicker(statsReportInterval)
 	defer report.Stop()
@@ -325,12 +329,11 @@ func (pool *TxPool) loop() {
 		case <-report.C:
 			pool.mu.RLock()
 			pending, queued := pool.stats()
-			stales := pool.priced.stales
 			pool.mu.RUnlock()
 
-			if pending != prevPending || queued != prevQueued || stales != prevStales {
-				log.Debug("Transaction pool status report", "executable", pending, "queued", queued, "stales", stales)
-				prevPending, prevQueued, prevStales = pending, queued, stales
+			if pending != prevPending || queued != prevQueued {
+				log.Debug("Transaction pool status report", "executable", pending, "queued", queued)
+				prevPending, prevQueued = pending, queued
 			}
 
 		// Handle inactive account transaction eviction
@@ -692,7 +695,7 @@ func (pool *TxPool) add(tx *types.Transaction, local bool) (bool, error) {
 		// New transaction is better, replace old one
 		if old != nil {
 			delete(pool.all, old.Hash())
-			pool.priced.Removed()
+			pool.priced.Remove(old)
 			pendingReplaceCounter.Inc(1)
 		}
 		pool.all[tx.Hash()] = tx
@@ -742,7 +745,7 @@ func (pool *TxPool) enqueueTx(hash common.Hash, tx *types.Transaction) (bool, er
 	// Discard any previous transaction and mark this
 	if old != nil {
 		delete(pool.all, old.Hash())
-		pool.priced.Removed()
+		pool.priced.Remove(old)
 		queuedReplaceCounter.Inc(1)
 	}
 	pool.all[hash] = tx
@@ -777,7 +780,7 @@ func (pool *TxPool) promoteTx(addr common.Address, hash common.Hash, tx *types.T
 		// 如果不能替换, 已经存在一个老的交易了, 删除
 		// An older transaction was better, discard this
 		delete(pool.all, hash)
-		pool.priced.Removed()
+		pool.priced.Remove(tx)
 
 		pendingDiscardCounter.Inc(1)
 		return
@@ -785,7 +788,7 @@ func (pool *TxPool) promoteTx(addr common.Address, hash common.Hash, tx *types.T
 	// Otherwise discard any previous transaction and mark this
 	if old != nil {
 		delete(pool.all, old.Hash())
-		pool.priced.Removed()
+		pool.priced.Remove(old)
 
 		pendingReplaceCounter.Inc(1)
 	}
@@ -929,7 +932,7 @@ func (pool *TxPool) removeTx(hash common.Hash) {
 
 	// Remove it from the list of known transactions
 	delete(pool.all, hash)
-	pool.priced.Removed()
+	pool.priced.Remove(tx)
 
 	// Remove the transaction from the pending lists and reset the account nonce
 	// 把交易从 pending 删除，并把因为这个交易的删除而变得无效的交易放到 future queue
@@ -988,7 +991,7 @@ func (pool *TxPool) promoteExecutables(accounts []common.Address) {
 			hash := tx.Hash()
 			log.Trace("Removed old queued transaction", "hash", hash)
 			delete(pool.all, hash)
-			pool.priced.Removed()
+			pool.priced.Remove(tx)
 		}
 		// Drop all transactions that are too costly (low balance or out of gas)
 		// 删除所有余额不足的交易
@@ -997,7 +1000,7 @@ func (pool *TxPool) promoteExecutables(accounts []common.Address) {
 			hash := tx.Hash()
 			log.Trace("Removed unpayable queued transaction", "hash", hash)
 			delete(pool.all, hash)
-			pool.priced.Removed()
+			pool.priced.Remove(tx)
 			queuedNofundsCounter.Inc(1)
 		}
 		// Gather all executable transactions and promote them
@@ -1013,7 +1016,7 @@ func (pool *TxPool) promoteExecutables(accounts []common.Address) {
 			for _, tx := range list.Cap(int(pool.config.AccountQueue)) {
 				hash := tx.Hash()
 				delete(pool.all, hash)
-				pool.priced.Removed()
+				pool.priced.Remove(tx)
 				queuedRateLimitCounter.Inc(1)
 				log.Trace("Removed cap-exceeding queued transaction", "hash", hash)
 			}
@@ -1072,7 +1075,7 @@ func (pool *TxPool) promoteExecutables(accounts []common.Address) {
 							// Drop the transaction from the global pools too
 							hash := tx.Hash()
 							delete(pool.all, hash)
-							pool.priced.Removed()
+							pool.priced.Remove(tx)
 
 							// Update the account nonce to the dropped transaction
 							if nonce := tx.Nonce(); pool.pendingState.GetNonce(offenders[i]) > nonce {
@@ -1096,7 +1099,7 @@ func (pool *TxPool) promoteExecutables(accounts []common.Address) {
 						// Drop the transaction from the global pools too
 						hash := tx.Hash()
 						delete(pool.all, hash)
-						pool.priced.Removed()
+						pool.priced.Remove(tx)
 
 						// Update the account nonce to the dropped transaction
 						if nonce := tx.Nonce(); pool.pendingState.GetNonce(addr) > nonce {
@@ -1170,7 +1173,7 @@ func (pool *TxPool) demoteUnexecutables() {
 			hash := tx.Hash()
 			log.Trace("Removed old pending transaction", "hash", hash)
 			delete(pool.all, hash)
-			pool.priced.Removed()
+			pool.priced.Remove(tx)
 		}
 		// Drop all transactions that are too costly (low balance or out of gas), and queue any invalids back for later
 		// 删除所有的太昂贵的交易。 用户的 balance 可能不够用。或者是 out of gas
@@ -1179,7 +1182,7 @@ func (pool *TxPool) demoteUnexecutables() {
 			hash := tx.Hash()
 			log.Trace("Removed unpayable pending transaction", "hash", hash)
 			delete(pool.all, hash)
-			pool.priced.Removed()
+			pool.priced.Remove(tx)
 			pendingNofundsCounter.Inc(1)
 		}
 		for _, tx := range invalids {
@@ -98,7 +98,7 @@ func validateTxPoolInternals(pool *TxPool) error {
 	if total := len(pool.all); total != pending+queued {
 		return fmt.Errorf("total transaction count %d != %d pending + %d queued", total, pending, queued)
 	}
-	if priced := pool.priced.items.Len() - pool.priced.stales; priced != pending+queued {
+	if priced := pool.priced.items.Len(); priced != pending+queued {
 		return fmt.Errorf("total priced transaction count %d != %d pending + %d queued", priced, pending, queued)
 	}
 	// Ensure the next nonce to assign is the correct one
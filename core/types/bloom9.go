@@ -63,6 +63,14 @@ func (b *Bloom) Add(d *big.Int) {
 	b.SetBytes(bin.Bytes())
 }
 
+// Or merges the given filter into b, so that b tests true for everything added
+// to either of them.
+func (b *Bloom) Or(x Bloom) {
+	for i := range b {
+		b[i] |= x[i]
+	}
+}
+
 // Big converts b to a big integer.
 func (b Bloom) Big() *big.Int {
 	return new(big.Int).SetBytes(b[:])
@@ -50,6 +50,22 @@ func TestBloom(t *testing.T) {
 	}
 }
 
+func TestBloomOr(t *testing.T) {
+	var a, b Bloom
+	a.Add(new(big.Int).SetBytes([]byte("test")))
+	b.Add(new(big.Int).SetBytes([]byte("hallo")))
+
+	a.Or(b)
+	for _, data := range []string{"test", "hallo"} {
+		if !a.TestBytes([]byte(data)) {
+			t.Error("expected", data, "to test true")
+		}
+	}
+	if a.TestBytes([]byte("lo")) {
+		t.Error("did not expect lo to test true")
+	}
+}
+
 /*
 import (
 	"testing"
@@ -246,6 +246,8 @@ func (tx *Transaction) AsMessage(s Signer) (Message, error) {
 		data:       tx.data.Payload,
 		checkNonce: true,
 	}
+	// Legacy transactions bid their gas price both as fee and as tip cap
+	msg.gasFeeCap, msg.gasTipCap = msg.price, msg.price
 
 	var err error
 	msg.from, err = Sender(s, tx)
@@ -459,6 +461,7 @@ type Message struct {
 	from                    common.Address
 	nonce                   uint64
 	amount, price, gasLimit *big.Int
+	gasFeeCap, gasTipCap    *big.Int
 	data                    []byte
 	checkNonce              bool
 }
@@ -471,14 +474,34 @@ func NewMessage(from common.Address, to *common.Address, nonce uint64, amount, g
 		amount:     amount,
 		price:      price,
 		gasLimit:   gasLimit,
+		gasFeeCap:  price,
+		gasTipCap:  price,
 		data:       data,
 		checkNonce: checkNonce,
 	}
 }
 
+// NewDynamicFeeMessage creates a message paying for gas according to the fee
+// market: at most gasFeeCap per gas in total, of which at most gasTipCap goes to
+// the miner on top of the base fee. The gas price of the message is its fee cap.
+func NewDynamicFeeMessage(from common.Address, to *common.Address, nonce uint64, amount, gasLimit, gasFeeCap, gasTipCap *big.Int, data []byte, checkNonce bool) Message {
+	msg := NewMessage(from, to, nonce, amount, gasLimit, gasFeeCap, data, checkNonce)
+	msg.gasTipCap = gasTipCap
+	return msg
+}
+
+// NewCallMessage creates a message for simulating a call, e.g. for eth_call.
+// Call messages don't belong to the sender's transaction sequence: their nonce
+// is zero and isn't checked against the state.
+func NewCallMessage(from common.Address, to *common.Address, gas *big.Int, gasPrice, value *big.Int, data []byte) Message {
+	return NewMessage(from, to, 0, value, gas, gasPrice, data, false)
+}
+
 func (m Message) From() common.Address { return m.from }
 func (m Message) To() *common.Address  { return m.to }
 func (m Message) GasPrice() *big.Int   { return m.price }
+func (m Message) GasFeeCap() *big.Int  { return m.gasFeeCap }
+func (m Message) GasTipCap() *big.Int  { return m.gasTipCap }
 func (m Message) Value() *big.Int      { return m.amount }
 func (m Message) Gas() *big.Int        { return m.gasLimit }
 func (m Message) Nonce() uint64        { return m.nonce }
@@ -17,7 +17,9 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"math/big"
 	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -32,11 +34,6 @@ type Config struct {
 	// Debug enabled debugging Interpreter options
 	// Debug 启用调试 Interpreter 选项
 	Debug bool
-	// EnableJit enabled the JIT VM
-	// EnableJit 启用 JIT VM
-	EnableJit bool
-	// ForceJit forces the JIT VM
-	ForceJit bool
 	// Tracer is the op code logger
 	Tracer Tracer
 	// NoRecursion disabled Interpreter call, callcode,
@@ -50,8 +47,56 @@ type Config struct {
 	// may be left uninitialised and will be set to the default
 	// table.
 	JumpTable [256]operation
+	// CaptureCallStack enables recording the chain of contract
+	// addresses leading to the deepest failing call.
+	CaptureCallStack bool
+	// Breakpoints are the program counters at which a debugged
+	// execution pauses until resumed via Interpreter.Resume.
+	Breakpoints map[uint64]bool
+	// SingleStep pauses a debugged execution before every
+	// instruction, as if each of them was a breakpoint.
+	SingleStep bool
+	// OpStats enables accumulating the number of executions
+	// and the gas consumed per opcode.
+	OpStats bool
+	// MaxReturnDataSize caps the size of the data an operation may
+	// return, 0 meaning unlimited.
+	MaxReturnDataSize uint64
+	// IntPool is the integer pool to use instead of allocating
+	// a new one, allowing interpreters running one after the
+	// other to reuse it. It must not be shared by concurrently
+	// running interpreters.
+	IntPool *IntPool
+	// GasAnalysis enables computing the gas cost of every
+	// operation without charging it, accumulating the costs
+	// reported by Interpreter.MeteredGas instead.
+	GasAnalysis bool
+	// ForbiddenOps are the opcodes which abort the execution
+	// when encountered, regardless of the chain rules.
+	ForbiddenOps [256]bool
 }
 
+// OpStat is the number of times an opcode was executed and the total gas its
+// executions consumed.
+type OpStat struct {
+	Count uint64
+	Gas   uint64
+}
+
+// MeteredOp is the gas an operation executed in gas analysis mode would have
+// cost. The cost of calls excludes the gas forwarded to the callee, whose
+// operations are metered themselves.
+type MeteredOp struct {
+	Pc    uint64 // Program counter of the operation
+	Op    OpCode // Opcode of the operation
+	Depth int    // Call depth the operation executed at
+	Cost  uint64 // Gas the operation would have cost
+}
+
+// ctxCheckInterval is the number of instructions executed between two checks
+// of the context of an execution started by RunCtx.
+const ctxCheckInterval = 256
+
 // Interpreter is used to run Ethereum based contracts and will utilise the
 // passed evmironment to query external sources for state information.
 // The Interpreter will run the byte code VM or JIT VM based on the passed
@@ -63,11 +108,25 @@ type Interpreter struct {
 	cfg      Config
 	// 标识了很多操作的 Gas 价格
 	gasTable params.GasTable
-	intPool  *intPool
+	intPool  *IntPool
 
 	readOnly   bool   // Whether to throw on stateful modifications
 	// 最后一个函数的返回值
 	returnData []byte // Last CALL's return data for subsequent reuse
+
+	callStack     []common.Address // Addresses of the currently executing contracts, by depth
+	lastCallStack []common.Address // Call stack of the deepest failing call since the top-level Run
+
+	resume chan struct{} // Channel resuming an execution paused at a breakpoint
+
+	opStats [256]OpStat // Per opcode statistics since the top-level Run
+
+	ctx context.Context // Context cancelling the current execution (nil if run without)
+
+	maxMemSize    uint64      // Largest memory of any frame since the top-level Run
+	maxStackDepth int         // Deepest stack of any frame since the top-level Run
+	meteredGas    uint64      // Gas the operations since the top-level Run would have cost
+	meteredOps    []MeteredOp // Cost of each operation since the top-level Run, in execution order
 }
 
 // NewInterpreter returns a new instance of the Interpreter.
@@ -87,11 +146,16 @@ func NewInterpreter(evm *EVM, cfg Config) *Interpreter {
 		}
 	}
 
+	intPool := cfg.IntPool
+	if intPool == nil {
+		intPool = newIntPool()
+	}
 	return &Interpreter{
 		evm:      evm,
 		cfg:      cfg,
 		gasTable: evm.ChainConfig().GasTable(evm.BlockNumber),
-		intPool:  newIntPool(),
+		intPool:  intPool,
+		resume:   make(chan struct{}),
 	}
 }
 
@@ -114,6 +178,180 @@ func (in *Interpreter) enforceRestrictions(op OpCode, operation operation, stack
 	return nil
 }
 
+// captureCallStack pushes the contract onto the tracked call stack, resetting
+// the last failing stack when a new top-level execution starts.
+func (in *Interpreter) captureCallStack(contract *Contract) {
+	if in.evm.depth == 1 {
+		in.callStack, in.lastCallStack = in.callStack[:0], nil
+	}
+	in.callStack = append(in.callStack, contract.Address())
+}
+
+// releaseCallStack pops the current contract off the tracked call stack. If the
+// execution failed deeper than any previous failure, the stack is saved first.
+func (in *Interpreter) releaseCallStack(err error) {
+	if err != nil && len(in.callStack) > len(in.lastCallStack) {
+		in.lastCallStack = append([]common.Address{}, in.callStack...)
+	}
+	in.callStack = in.callStack[:len(in.callStack)-1]
+}
+
+// LastCallStack returns the contract addresses along the call chain of the
+// deepest call that failed (reverted or errored) during the last top-level
+// execution, outermost first. It requires Config.CaptureCallStack to be set.
+func (in *Interpreter) LastCallStack() []common.Address {
+	return in.lastCallStack
+}
+
+// OverrideOp replaces the operation executed for the given opcode by this
+// interpreter, e.g. to customise its behaviour or gas cost. The operation needs
+// execute and gas functions, and consistent stack bounds. The instruction set
+// of other interpreters isn't affected.
+func (in *Interpreter) OverrideOp(op OpCode, spec Operation) error {
+	switch {
+	case spec.Execute == nil:
+		return fmt.Errorf("vm: %v override without execute function", op)
+	case spec.Gas == nil:
+		return fmt.Errorf("vm: %v override without gas function", op)
+	case spec.MinStack < 0 || spec.MaxStack < spec.MinStack:
+		return fmt.Errorf("vm: %v override with invalid stack bounds [%d, %d]", op, spec.MinStack, spec.MaxStack)
+	}
+	minStack, maxStack := spec.MinStack, spec.MaxStack
+	in.cfg.JumpTable[op] = operation{
+		execute: spec.Execute,
+		gasCost: spec.Gas,
+		validateStack: func(stack *Stack) error {
+			if err := stack.require(minStack); err != nil {
+				return err
+			}
+			if stack.len() > maxStack {
+				return fmt.Errorf("stack limit reached %d (%d)", stack.len(), params.StackLimit)
+			}
+			return nil
+		},
+		memorySize: spec.MemorySize,
+		halts:      spec.Halts,
+		jumps:      spec.Jumps,
+		writes:     spec.Writes,
+		valid:      true,
+		reverts:    spec.Reverts,
+		returns:    spec.Returns,
+	}
+	return nil
+}
+
+// breakpoint reports whether a debugged execution should pause at pc.
+func (in *Interpreter) breakpoint(pc uint64) bool {
+	return in.cfg.SingleStep || in.cfg.Breakpoints[pc]
+}
+
+// Resume continues an execution paused at a breakpoint, blocking until the
+// paused execution picks up the signal. It must only be called while the
+// execution is paused, i.e. after the tracer was notified of the breakpoint.
+// A paused execution is also released by cancelling the EVM or the context it
+// runs with, failing the execution.
+func (in *Interpreter) Resume() {
+	in.resume <- struct{}{}
+}
+
+// awaitResume blocks an execution paused at a breakpoint until it is resumed,
+// failing if the EVM is cancelled or the context of the execution is done in
+// the meantime.
+func (in *Interpreter) awaitResume() error {
+	var done <-chan struct{}
+	if in.ctx != nil {
+		done = in.ctx.Done()
+	}
+	select {
+	case <-in.resume:
+		return nil
+	case <-in.evm.aborted:
+		return ErrExecutionAborted
+	case <-done:
+		return fmt.Errorf("evm: execution cancelled: %w", in.ctx.Err())
+	}
+}
+
+// OpStats returns the execution count and gas consumed per opcode during the
+// last top-level execution. It requires Config.OpStats to be set.
+func (in *Interpreter) OpStats() [256]OpStat {
+	return in.opStats
+}
+
+// MaxMemorySize returns the largest memory size, in bytes, any call frame of the
+// last top-level execution reached.
+func (in *Interpreter) MaxMemorySize() uint64 {
+	return in.maxMemSize
+}
+
+// MaxStackDepth returns the largest number of items the stack of any call frame
+// of the last top-level execution held.
+func (in *Interpreter) MaxStackDepth() int {
+	return in.maxStackDepth
+}
+
+// MeteredGas returns the gas the operations of the last top-level execution
+// would have cost, as accumulated when running with Config.GasAnalysis.
+func (in *Interpreter) MeteredGas() uint64 {
+	return in.meteredGas
+}
+
+// MeteredOps returns the cost of each operation of the last top-level execution
+// run with Config.GasAnalysis, in execution order, adding up to MeteredGas.
+func (in *Interpreter) MeteredOps() []MeteredOp {
+	return in.meteredOps
+}
+
+// RunCtx runs the contract's code just like Run, but aborts the execution once
+// the given context is cancelled, returning an error wrapping the cause. The
+// context is checked every few instructions, in nested calls too.
+func (in *Interpreter) RunCtx(ctx context.Context, snapshot int, contract *Contract, input []byte) ([]byte, error) {
+	parent := in.ctx
+	in.ctx = ctx
+	defer func() { in.ctx = parent }()
+
+	return in.Run(snapshot, contract, input)
+}
+
+// RunReadOnly runs the contract's code just like Run, but prohibits any state
+// modification. The code is scanned for state-modifying opcodes before it's
+// executed, failing with errReadOnlyViolation if it contains any. Writes which
+// can't be detected up front (e.g. calls transferring value) are rejected by
+// the regular read-only enforcement during execution.
+func (in *Interpreter) RunReadOnly(snapshot int, contract *Contract, input []byte) ([]byte, error) {
+	for pc := uint64(0); pc < uint64(len(contract.Code)); pc++ {
+		op := OpCode(contract.Code[pc])
+		if in.cfg.JumpTable[op].writes {
+			return nil, errReadOnlyViolation
+		}
+		if op >= PUSH1 && op <= PUSH32 {
+			pc += uint64(op - PUSH1 + 1)
+		}
+	}
+	if !in.readOnly {
+		in.readOnly = true
+		defer func() { in.readOnly = false }()
+	}
+	return in.Run(snapshot, contract, input)
+}
+
+// RunWithGas runs the contract's code with exactly the given amount of gas and
+// reports how much of it was consumed, allowing callers to search for the gas
+// boundary at which an execution stops running out of gas.
+//
+// Unlike a regular call, a failing run isn't charged all the gas, gasUsed only
+// covers the operations executed up to the failure. The state changes of every
+// run are reverted, successful or not, so consecutive runs start from the same
+// state.
+func (in *Interpreter) RunWithGas(contract *Contract, input []byte, gas uint64) (ret []byte, gasUsed uint64, err error) {
+	snapshot := in.evm.StateDB.Snapshot()
+	defer in.evm.StateDB.RevertToSnapshot(snapshot)
+
+	contract.Gas = gas
+	ret, err = in.Run(snapshot, contract, input)
+	return ret, gas - contract.Gas, err
+}
+
 // Run loops and evaluates the contract's code with the given input data and returns
 // the return byte-slice and an error if one occurred.
 // 用给定的输入参数循环执行合约的代码，并返回返回的字节片段，如果发生错误则返回错误。
@@ -122,10 +360,67 @@ func (in *Interpreter) enforceRestrictions(op OpCode, operation operation, stack
 // should be handled to reduce complexity and errors further down the in.
 // 重要的是要注意，解释器返回的任何错误都会消耗全部 gas。 为了减少复杂性,没有特别的错误处理流程。
 func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret []byte, err error) {
+	ret, _, err = in.run(contract, input, nil, false)
+	return ret, err
+}
+
+// ExecState is a snapshot of the state of a paused contract execution, from
+// which the execution can be resumed via RunFrom.
+type ExecState struct {
+	PC         uint64     // Program counter of the next instruction to execute
+	Stack      []*big.Int // Stack items, bottom first
+	Mem        []byte     // Memory contents
+	Gas        uint64     // Gas left
+	ReturnData []byte     // Return data of the last call
+}
+
+// RunFrom runs the contract's code starting from the given execution state, or
+// from the beginning with the contract's gas and input if state is nil. Unlike
+// Run, hitting one of Config.Breakpoints doesn't block the execution: it stops
+// before the instruction, returning a snapshot of the execution state. The
+// snapshot can be passed to RunFrom again to continue the execution, possibly
+// multiple times, as it isn't modified by the resumed execution.
+//
+// Only the frame of the contract itself is paused, breakpoints hit in calls
+// made by it behave as they do in Run.
+func (in *Interpreter) RunFrom(state *ExecState, contract *Contract) ([]byte, *ExecState, error) {
+	return in.run(contract, contract.Input, state, true)
+}
+
+// execState takes a snapshot of the state of an execution paused before the
+// instruction at pc.
+func (in *Interpreter) execState(pc uint64, stack *Stack, mem *Memory, contract *Contract) *ExecState {
+	state := &ExecState{
+		PC:         pc,
+		Stack:      make([]*big.Int, len(stack.data)),
+		Mem:        common.CopyBytes(mem.Data()),
+		Gas:        contract.Gas,
+		ReturnData: common.CopyBytes(in.returnData),
+	}
+	for i, val := range stack.data {
+		state.Stack[i] = new(big.Int).Set(val)
+	}
+	return state
+}
+
+// run implements Run and RunFrom, optionally seeding the execution with a saved
+// state and pausing it at breakpoints.
+func (in *Interpreter) run(contract *Contract, input []byte, from *ExecState, pausable bool) (ret []byte, paused *ExecState, err error) {
 	// Increment the call depth which is restricted to 1024
 	in.evm.depth++
 	defer func() { in.evm.depth-- }()
 
+	if in.cfg.CaptureCallStack {
+		in.captureCallStack(contract)
+		defer func() { in.releaseCallStack(err) }()
+	}
+	if in.evm.depth == 1 {
+		in.maxMemSize, in.maxStackDepth, in.meteredGas, in.meteredOps = 0, 0, 0, nil
+		if in.cfg.OpStats {
+			in.opStats = [256]OpStat{}
+		}
+	}
+
 	// Reset the previous call's return data. It's unimportant to preserve the old buffer
 	// as every returning call will return new data anyway.
 	// 重置前一次调用的返回数据。 保留旧缓冲区并不重要，因为每次返回调用都会返回新数据。
@@ -133,7 +428,7 @@ func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret
 
 	// Don't bother with the execution if there's no code.
 	if len(contract.Code) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	codehash := contract.CodeHash // codehash is used when doing jump dest caching
@@ -158,9 +453,32 @@ func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret
 		pcCopy    uint64       // needed for the deferred Tracer
 		gasCopy   uint64       // for Tracer to log gas remaining before execution
 		logged    bool         // deferred Tracer should ignore already logged steps
+		steps     uint64       // instructions executed, to throttle context checks
 	)
 	contract.Input = input
 
+	// Restore the state of a resumed execution. The instruction it was paused
+	// at must not pause it again.
+	resumed := from != nil
+	if resumed {
+		pc, contract.Gas = from.PC, from.Gas
+		for _, val := range from.Stack {
+			stack.push(new(big.Int).Set(val))
+		}
+		// account for the memory expansion cost already paid
+		if _, err := memoryGasCost(mem, uint64(len(from.Mem))); err != nil {
+			return nil, nil, err
+		}
+		mem.Resize(uint64(len(from.Mem)))
+		mem.Set(0, uint64(len(from.Mem)), from.Mem)
+		in.returnData = common.CopyBytes(from.ReturnData)
+	}
+
+	var storageTracer StorageTracer
+	if in.cfg.Debug {
+		storageTracer, _ = in.cfg.Tracer.(StorageTracer)
+	}
+
 	defer func() {
 		if err != nil && !logged && in.cfg.Debug {
 			in.cfg.Tracer.CaptureState(in.evm, pcCopy, op, gasCopy, cost, mem, stackCopy, contract, in.evm.depth, err)
@@ -174,9 +492,22 @@ func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret
 	// 解释器的主要循环， 直到遇到 STOP，RETURN，SELFDESTRUCT 指令被执行，
 	// 或者是遇到任意错误，或者说 done 标志被父 context 设置。
 	for atomic.LoadInt32(&in.evm.abort) == 0 {
+		if in.ctx != nil {
+			if steps%ctxCheckInterval == 0 {
+				if err := in.ctx.Err(); err != nil {
+					return nil, nil, fmt.Errorf("evm: execution cancelled: %w", err)
+				}
+			}
+			steps++
+		}
 		// Get the memory location of pc
 		op = contract.GetOp(pc)
 
+		if pausable && !resumed && in.breakpoint(pc) {
+			return nil, in.execState(pc, stack, mem, contract), nil
+		}
+		resumed = false
+
 		if in.cfg.Debug {
 			logged = false
 			pcCopy = pc
@@ -185,6 +516,16 @@ func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret
 			for _, val := range stack.data {
 				stackCopy.push(val)
 			}
+			// Pause before executing the instruction if requested, letting the
+			// tracer inspect the state until the execution is resumed
+			if !pausable && in.breakpoint(pc) {
+				if err := in.cfg.Tracer.CaptureBreakpoint(in.evm, pc, op, contract.Gas, mem, stack, contract, in.evm.depth); err != nil {
+					return nil, nil, err
+				}
+				if err := in.awaitResume(); err != nil {
+					return nil, nil, err
+				}
+			}
 		}
 
 		// Get the operation from the jump table matching the opcode and validate the
@@ -193,17 +534,21 @@ func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret
 		operation := in.cfg.JumpTable[op]
 		// 检查指令是否非法
 		if !operation.valid {
-			return nil, fmt.Errorf("invalid opcode 0x%x", int(op))
+			return nil, nil, fmt.Errorf("invalid opcode 0x%x", int(op))
+		}
+		// 检查指令是否被配置禁止
+		if in.cfg.ForbiddenOps[op] {
+			return nil, nil, errForbiddenOpcode
 		}
 		// 检查是否有足够的堆栈空间。 包括入栈和出栈
 		if err := operation.validateStack(stack); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		// If the operation is valid, enforce and write restrictions
 		// 这里检查了只读模式下面不能执行 writes 指令
 		// staticCall 的情况下会设置为 readonly 模式
 		if err := in.enforceRestrictions(op, operation, stack); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		var memorySize uint64
@@ -213,27 +558,50 @@ func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret
 		if operation.memorySize != nil {
 			memSize, overflow := bigUint64(operation.memorySize(stack))
 			if overflow {
-				return nil, errGasUintOverflow
+				return nil, nil, errGasUintOverflow
 			}
 			// memory is expanded in words of 32 bytes. Gas
 			// is also calculated in words.
 			if memorySize, overflow = math.SafeMul(toWordSize(memSize), 32); overflow {
-				return nil, errGasUintOverflow
+				return nil, nil, errGasUintOverflow
 			}
 		}
 		// 这个参数在本地模拟执行的时候比较有用，可以不消耗或者检查 GAS 执行交易并得到返回结果
-		if !in.cfg.DisableGasMetering {
+		if in.cfg.GasAnalysis {
+			// compute the cost for the record, but never charge it. The gas
+			// forwarded by calls (left on the stack by their gas functions) is
+			// excluded, the callee's operations are metered themselves. Nor is
+			// it deducted, so calls don't refund their unused gas either.
+			cost, err = operation.gasCost(in.gasTable, in.evm, contract, stack, mem, memorySize)
+			if err != nil {
+				return nil, nil, ErrOutOfGas
+			}
+			metered := cost
+			switch op {
+			case CALL, CALLCODE, DELEGATECALL, STATICCALL:
+				metered -= stack.peek().Uint64()
+			}
+			in.meteredGas += metered
+			in.meteredOps = append(in.meteredOps, MeteredOp{Pc: pc, Op: op, Depth: in.evm.depth, Cost: metered})
+		} else if !in.cfg.DisableGasMetering {
 			// consume the gas and return an error if not enough gas is available.
 			// cost is explicitly set so that the capture state defer method cas get the proper cost
 			// 计算 gas 的 Cost 并使用，如果不够，就返回 OutOfGas 错误。
 			cost, err = operation.gasCost(in.gasTable, in.evm, contract, stack, mem, memorySize)
 			if err != nil || !contract.UseGas(cost) {
-				return nil, ErrOutOfGas
+				return nil, nil, ErrOutOfGas
 			}
 		}
 		// 扩大内存范围
 		if memorySize > 0 {
 			mem.Resize(memorySize)
+			if size := uint64(mem.Len()); size > in.maxMemSize {
+				in.maxMemSize = size
+			}
+		}
+		if in.cfg.OpStats {
+			in.opStats[op].Count++
+			in.opStats[op].Gas += cost
 		}
 
 		if in.cfg.Debug {
@@ -241,6 +609,17 @@ func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret
 			logged = true
 		}
 
+		// note the storage slot accessed by the operation for the tracer, the
+		// value read by SLOAD is only known after the execution
+		var slot, value common.Hash
+		storageAccess := storageTracer != nil && (op == SLOAD || op == SSTORE)
+		if storageAccess {
+			slot = common.BigToHash(stack.peek())
+			if op == SSTORE {
+				value = common.BigToHash(stack.Back(1))
+			}
+		}
+
 		// execute the operation
 		res, err := operation.execute(&pc, in.evm, contract, mem, stack)
 		// verifyPool is a build flag. Pool verification makes sure the integrity
@@ -248,23 +627,35 @@ func (in *Interpreter) Run(snapshot int, contract *Contract, input []byte) (ret
 		if verifyPool {
 			verifyIntegerPool(in.intPool)
 		}
+		if storageAccess && err == nil {
+			if op == SLOAD {
+				value = common.BigToHash(stack.peek())
+			}
+			storageTracer.CaptureStorageAccess(in.evm, contract.Address(), slot, value, op == SSTORE)
+		}
+		if err == nil && in.cfg.MaxReturnDataSize > 0 && uint64(len(res)) > in.cfg.MaxReturnDataSize {
+			return nil, nil, errReturnDataOutOfBounds
+		}
 		// if the operation clears the return data (e.g. it has returning data)
 		// set the last return to the result of the operation.
 		// 如果有返回值，那么就设置返回值。 注意只有最后一个返回有效果。
 		if operation.returns {
 			in.returnData = res
 		}
+		if depth := stack.len(); depth > in.maxStackDepth {
+			in.maxStackDepth = depth
+		}
 
 		switch {
 		case err != nil:
-			return nil, err
+			return nil, nil, err
 		case operation.reverts:
-			return res, errExecutionReverted
+			return res, nil, ErrExecutionReverted
 		case operation.halts:
-			return res, nil
+			return res, nil, nil
 		case !operation.jumps:
 			pc++
 		}
 	}
-	return nil, nil
+	return nil, nil, nil
 }
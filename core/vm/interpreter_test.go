@@ -0,0 +1,674 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var (
+	interpreterTestCaller = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	interpreterTestTarget = common.HexToAddress("0x2000000000000000000000000000000000000002")
+	interpreterTestCallee = common.HexToAddress("0x3000000000000000000000000000000000000003")
+)
+
+// newInterpreterTestEVM creates an EVM operating on a fresh in-memory state
+// database, with the given contract codes deployed.
+func newInterpreterTestEVM(cfg Config, codes map[common.Address][]byte) *EVM {
+	db, _ := ethdb.NewMemDatabase()
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	for addr, code := range codes {
+		statedb.SetCode(addr, code)
+	}
+	context := Context{
+		CanTransfer: func(db StateDB, addr common.Address, amount *big.Int) bool {
+			return db.GetBalance(addr).Cmp(amount) >= 0
+		},
+		Transfer: func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+			db.SubBalance(sender, amount)
+			db.AddBalance(recipient, amount)
+		},
+		GetHash:     func(uint64) common.Hash { return common.Hash{} },
+		BlockNumber: new(big.Int),
+		Time:        new(big.Int),
+		Difficulty:  new(big.Int),
+		GasLimit:    new(big.Int),
+		GasPrice:    new(big.Int),
+	}
+	return NewEVM(context, statedb, params.TestChainConfig, cfg)
+}
+
+// callCode returns bytecode calling the given address with all remaining gas,
+// no value and no input or output, leaving the call result on the stack.
+func callCode(addr common.Address) []byte {
+	code := []byte{
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0,
+		byte(PUSH20),
+	}
+	code = append(code, addr.Bytes()...)
+	return append(code, byte(GAS), byte(CALL))
+}
+
+// Tests that the call stack leading to the deepest failure is captured, even if
+// the failure was swallowed by the calling contract.
+func TestInterpreterCaptureCallStack(t *testing.T) {
+	evm := newInterpreterTestEVM(Config{CaptureCallStack: true}, map[common.Address][]byte{
+		interpreterTestTarget: append(callCode(interpreterTestCallee), byte(STOP)),
+		interpreterTestCallee: {byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)},
+	})
+	if _, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	stack := evm.Interpreter().LastCallStack()
+	if len(stack) != 2 || stack[0] != interpreterTestTarget || stack[1] != interpreterTestCallee {
+		t.Fatalf("call stack mismatch: have %x, want [%x %x]", stack, interpreterTestTarget, interpreterTestCallee)
+	}
+	// A new top-level execution should reset the previously captured stack
+	if _, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestCallee, nil, 100000, new(big.Int)); err != ErrExecutionReverted {
+		t.Fatalf("revert error mismatch: have %v, want %v", err, ErrExecutionReverted)
+	}
+	if stack = evm.Interpreter().LastCallStack(); len(stack) != 1 || stack[0] != interpreterTestCallee {
+		t.Fatalf("call stack mismatch: have %x, want [%x]", stack, interpreterTestCallee)
+	}
+}
+
+// Tests that running with a forced amount of gas reports the gas consumed and
+// can be used to find the exact out-of-gas boundary of an execution, every run
+// starting from the same state.
+func TestInterpreterRunWithGas(t *testing.T) {
+	evm := newInterpreterTestEVM(Config{}, nil)
+
+	// PUSH1 1, PUSH1 2, ADD, PUSH1 0, MSTORE, STOP: 5 * GasFastestStep + 1 word of memory
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 2, byte(ADD), byte(PUSH1), 0, byte(MSTORE), byte(STOP)}
+
+	// SSTORE(0, 1) would cost less on a second run if the first one's write was kept
+	store := NewContract(AccountRef(interpreterTestCaller), AccountRef(interpreterTestTarget), new(big.Int), 0)
+	store.SetCallCode(&interpreterTestTarget, common.Hash{}, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(STOP)})
+	for i := 0; i < 2; i++ {
+		if _, used, err := evm.Interpreter().RunWithGas(store, nil, 100000); err != nil || used != 2*GasFastestStep+params.SstoreSetGas {
+			t.Fatalf("store run %d: have %d used, err %v, want %d used", i, used, err, 2*GasFastestStep+params.SstoreSetGas)
+		}
+		if value := evm.StateDB.GetState(interpreterTestTarget, common.Hash{}); value != (common.Hash{}) {
+			t.Fatalf("store run %d: state change kept: have %x", i, value)
+		}
+	}
+	newContract := func() *Contract {
+		contract := NewContract(AccountRef(interpreterTestCaller), AccountRef(interpreterTestTarget), new(big.Int), 0)
+		contract.SetCallCode(&interpreterTestTarget, common.Hash{}, code)
+		return contract
+	}
+	_, used, err := evm.Interpreter().RunWithGas(newContract(), nil, 100000)
+	if err != nil {
+		t.Fatalf("failed to run with ample gas: %v", err)
+	}
+	if want := 5*GasFastestStep + params.MemoryGas; used != want {
+		t.Fatalf("gas used mismatch: have %d, want %d", used, want)
+	}
+	// Binary search the minimum gas allowing the execution to succeed
+	lo, hi := uint64(0), uint64(100000)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if _, _, err := evm.Interpreter().RunWithGas(newContract(), nil, mid); err == nil {
+			hi = mid
+		} else if err != ErrOutOfGas {
+			t.Fatalf("unexpected error with %d gas: %v", mid, err)
+		} else {
+			lo = mid + 1
+		}
+	}
+	if lo != used {
+		t.Fatalf("gas threshold mismatch: have %d, want %d", lo, used)
+	}
+	if _, failUsed, err := evm.Interpreter().RunWithGas(newContract(), nil, used-1); err != ErrOutOfGas || failUsed >= used {
+		t.Fatalf("run below threshold mismatch: have %d used, err %v, want less than %d used, err %v", failUsed, err, used, ErrOutOfGas)
+	}
+}
+
+// breakpointTracer is a Tracer reporting the program counter and a copy of the
+// stack of every breakpoint hit.
+type breakpointTracer struct {
+	hits chan breakpointHit
+}
+
+type breakpointHit struct {
+	pc    uint64
+	op    OpCode
+	stack []*big.Int
+}
+
+func (t *breakpointTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	return nil
+}
+
+func (t *breakpointTracer) CaptureBreakpoint(env *EVM, pc uint64, op OpCode, gas uint64, memory *Memory, stack *Stack, contract *Contract, depth int) error {
+	hit := breakpointHit{pc: pc, op: op}
+	for _, val := range stack.Data() {
+		hit.stack = append(hit.stack, new(big.Int).Set(val))
+	}
+	t.hits <- hit
+	return nil
+}
+
+func (t *breakpointTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	return nil
+}
+
+// Tests that a debugged execution pauses at the configured breakpoints, exposing
+// the state before the instruction, and runs to completion once resumed.
+func TestInterpreterBreakpoints(t *testing.T) {
+	// PUSH1 2, PUSH1 3, ADD, PUSH1 0, MSTORE, STOP
+	code := []byte{byte(PUSH1), 2, byte(PUSH1), 3, byte(ADD), byte(PUSH1), 0, byte(MSTORE), byte(STOP)}
+
+	run := func(cfg Config) ([]breakpointHit, error) {
+		tracer := &breakpointTracer{hits: make(chan breakpointHit)}
+		cfg.Debug, cfg.Tracer = true, tracer
+		evm := newInterpreterTestEVM(cfg, map[common.Address][]byte{interpreterTestTarget: code})
+
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int))
+			errc <- err
+		}()
+		var hits []breakpointHit
+		for {
+			select {
+			case hit := <-tracer.hits:
+				hits = append(hits, hit)
+				evm.Interpreter().Resume()
+			case err := <-errc:
+				return hits, err
+			case <-time.After(time.Second):
+				return hits, errors.New("execution stuck")
+			}
+		}
+	}
+	hits, err := run(Config{Breakpoints: map[uint64]bool{4: true}})
+	if err != nil {
+		t.Fatalf("failed to run to completion: %v", err)
+	}
+	if len(hits) != 1 || hits[0].pc != 4 || hits[0].op != ADD {
+		t.Fatalf("breakpoint hits mismatch: have %v, want ADD at pc 4", hits)
+	}
+	if stack := hits[0].stack; len(stack) != 2 || stack[0].Int64() != 2 || stack[1].Int64() != 3 {
+		t.Fatalf("stack at breakpoint mismatch: have %v, want [2 3]", stack)
+	}
+	// Single stepping should pause before each of the instructions
+	hits, err = run(Config{SingleStep: true})
+	if err != nil {
+		t.Fatalf("failed to single step to completion: %v", err)
+	}
+	want := []uint64{0, 2, 4, 5, 7, 8}
+	if len(hits) != len(want) {
+		t.Fatalf("single step count mismatch: have %d, want %d", len(hits), len(want))
+	}
+	for i, hit := range hits {
+		if hit.pc != want[i] {
+			t.Errorf("step %d: pc mismatch: have %d, want %d", i, hit.pc, want[i])
+		}
+	}
+}
+
+// Tests that an execution paused at a breakpoint is released with an error if
+// the EVM or the context of the execution is cancelled instead of resuming it.
+func TestInterpreterBreakpointAbort(t *testing.T) {
+	// PUSH1 2, PUSH1 3, ADD, STOP
+	code := []byte{byte(PUSH1), 2, byte(PUSH1), 3, byte(ADD), byte(STOP)}
+
+	run := func(abort func(evm *EVM, cancel context.CancelFunc), want error) {
+		tracer := &breakpointTracer{hits: make(chan breakpointHit)}
+		evm := newInterpreterTestEVM(Config{Debug: true, Tracer: tracer, Breakpoints: map[uint64]bool{4: true}}, nil)
+
+		contract := NewContract(AccountRef(interpreterTestCaller), AccountRef(interpreterTestTarget), new(big.Int), 100000)
+		contract.SetCallCode(&interpreterTestTarget, common.Hash{}, code)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := evm.Interpreter().RunCtx(ctx, evm.StateDB.Snapshot(), contract, nil)
+			errc <- err
+		}()
+		select {
+		case <-tracer.hits:
+			abort(evm, cancel)
+		case <-time.After(time.Second):
+			t.Fatalf("breakpoint not hit")
+		}
+		select {
+		case err := <-errc:
+			if !errors.Is(err, want) {
+				t.Errorf("error mismatch: have %v, want %v", err, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("paused execution not released")
+		}
+	}
+	run(func(evm *EVM, cancel context.CancelFunc) { evm.Cancel() }, ErrExecutionAborted)
+	run(func(evm *EVM, cancel context.CancelFunc) { cancel() }, context.Canceled)
+}
+
+// Tests that the per opcode statistics count every execution of an opcode along
+// with the gas consumed by them.
+func TestInterpreterOpStats(t *testing.T) {
+	// Count down from 3 in a loop, jumping over an invalid opcode to enter it
+	code := []byte{
+		byte(PUSH1), 3, byte(PUSH1), 6, byte(JUMP), 0xfe,
+		byte(JUMPDEST), byte(PUSH1), 1, byte(SWAP1), byte(SUB), byte(DUP1), byte(PUSH1), 6, byte(JUMPI),
+		byte(STOP),
+	}
+	evm := newInterpreterTestEVM(Config{OpStats: true}, map[common.Address][]byte{interpreterTestTarget: code})
+	if _, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	stats := evm.Interpreter().OpStats()
+
+	tests := []struct {
+		op    OpCode
+		count uint64
+		gas   uint64
+	}{
+		{PUSH1, 8, 8 * GasFastestStep},
+		{JUMP, 1, GasMidStep},
+		{JUMPI, 3, 3 * GasSlowStep},
+		{JUMPDEST, 3, 3 * params.JumpdestGas},
+		{SUB, 3, 3 * GasFastestStep},
+		{STOP, 1, 0},
+		{ADD, 0, 0},
+	}
+	for _, tt := range tests {
+		if have := stats[tt.op]; have.Count != tt.count || have.Gas != tt.gas {
+			t.Errorf("%v stats mismatch: have %+v, want {Count:%d Gas:%d}", tt.op, have, tt.count, tt.gas)
+		}
+	}
+	// Statistics are only collected when enabled
+	evm = newInterpreterTestEVM(Config{}, map[common.Address][]byte{interpreterTestTarget: code})
+	if _, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	if stats := evm.Interpreter().OpStats(); stats != ([256]OpStat{}) {
+		t.Errorf("statistics collected while disabled")
+	}
+}
+
+// Tests that an execution started with a context is aborted once the context is
+// cancelled, reporting the cancellation as the cause.
+func TestInterpreterRunCtx(t *testing.T) {
+	evm := newInterpreterTestEVM(Config{}, nil)
+
+	// JUMPDEST, PUSH1 0, JUMP: loop forever
+	code := []byte{byte(JUMPDEST), byte(PUSH1), 0, byte(JUMP)}
+	contract := NewContract(AccountRef(interpreterTestCaller), AccountRef(interpreterTestTarget), new(big.Int), math.MaxUint64)
+	contract.SetCallCode(&interpreterTestTarget, common.Hash{}, code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := evm.Interpreter().RunCtx(ctx, evm.StateDB.Snapshot(), contract, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("error mismatch: have %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("execution not cancelled")
+	}
+}
+
+// Tests that the peak memory size and stack depth of an execution are tracked
+// across its call frames, and reset for every top-level execution.
+func TestInterpreterPeakUsage(t *testing.T) {
+	evm := newInterpreterTestEVM(Config{}, map[common.Address][]byte{
+		// Call the callee (7 stack items), then drop the result
+		interpreterTestTarget: append(callCode(interpreterTestCallee), byte(POP), byte(STOP)),
+		// MSTORE(0x400, 1): grow the memory to 0x420 bytes
+		interpreterTestCallee: {byte(PUSH1), 1, byte(PUSH2), 0x04, 0x00, byte(MSTORE), byte(STOP)},
+		// PUSH1 1, STOP
+		interpreterTestCaller: {byte(PUSH1), 1, byte(STOP)},
+	})
+	if _, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	if size := evm.Interpreter().MaxMemorySize(); size != 0x420 {
+		t.Errorf("peak memory size mismatch: have %d, want %d", size, 0x420)
+	}
+	if depth := evm.Interpreter().MaxStackDepth(); depth != 7 {
+		t.Errorf("peak stack depth mismatch: have %d, want %d", depth, 7)
+	}
+	// A new execution should only report its own usage
+	if _, _, err := evm.Call(AccountRef(interpreterTestTarget), interpreterTestCaller, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	if size, depth := evm.Interpreter().MaxMemorySize(), evm.Interpreter().MaxStackDepth(); size != 0 || depth != 1 {
+		t.Errorf("peak usage mismatch: have memory %d, stack %d, want memory 0, stack 1", size, depth)
+	}
+}
+
+// Tests that an opcode can be overridden with a custom operation, and that
+// incomplete operations or ones with inconsistent stack bounds are rejected.
+func TestInterpreterOverrideOp(t *testing.T) {
+	// ADD(2^256-1, 1), returning the result
+	code := []byte{byte(PUSH32)}
+	code = append(code, bytes.Repeat([]byte{0xff}, 32)...)
+	code = append(code, byte(PUSH1), 1, byte(ADD), byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN))
+
+	evm := newInterpreterTestEVM(Config{}, map[common.Address][]byte{interpreterTestTarget: code})
+	ret, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int))
+	if err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	if !bytes.Equal(ret, make([]byte, 32)) {
+		t.Fatalf("default ADD result mismatch: have %x, want zero", ret)
+	}
+	// Replace ADD with a saturating variant and execute again
+	maxWord := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	saturatingAdd := func(pc *uint64, evm *EVM, contract *Contract, memory *Memory, stack *Stack) ([]byte, error) {
+		x, y := stack.Pop(), stack.Pop()
+		if x.Add(x, y).Cmp(maxWord) > 0 {
+			x.Set(maxWord)
+		}
+		stack.Push(x)
+		return nil, nil
+	}
+	gas := func(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, memory *Memory, memorySize uint64) (uint64, error) {
+		return GasFastestStep, nil
+	}
+	for i, invalid := range []Operation{
+		{Execute: saturatingAdd, MinStack: 2, MaxStack: int(params.StackLimit) + 1},
+		{Gas: gas, MinStack: 2, MaxStack: int(params.StackLimit) + 1},
+		{Execute: saturatingAdd, Gas: gas, MinStack: -1, MaxStack: int(params.StackLimit)},
+		{Execute: saturatingAdd, Gas: gas, MinStack: 2, MaxStack: 1},
+	} {
+		if err := evm.Interpreter().OverrideOp(ADD, invalid); err == nil {
+			t.Fatalf("invalid operation %d accepted", i)
+		}
+	}
+	err = evm.Interpreter().OverrideOp(ADD, Operation{
+		Execute:  saturatingAdd,
+		Gas:      gas,
+		MinStack: 2,
+		MaxStack: int(params.StackLimit) + 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to override ADD: %v", err)
+	}
+	ret, _, err = evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int))
+	if err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	if !bytes.Equal(ret, maxWord.Bytes()) {
+		t.Errorf("saturating ADD result mismatch: have %x, want %x", ret, maxWord.Bytes())
+	}
+}
+
+// Tests that operations returning more data than the configured limit abort
+// the execution.
+func TestInterpreterMaxReturnDataSize(t *testing.T) {
+	tests := []struct {
+		size uint64
+		err  error
+	}{
+		{size: 64, err: nil},
+		{size: 65, err: errReturnDataOutOfBounds},
+	}
+	for i, tt := range tests {
+		// RETURN(0, size)
+		code := []byte{byte(PUSH1), byte(tt.size), byte(PUSH1), 0, byte(RETURN)}
+		evm := newInterpreterTestEVM(Config{MaxReturnDataSize: 64}, map[common.Address][]byte{interpreterTestTarget: code})
+
+		ret, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int))
+		if err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if err == nil && uint64(len(ret)) != tt.size {
+			t.Errorf("test %d: return size mismatch: have %d, want %d", i, len(ret), tt.size)
+		}
+	}
+}
+
+// Tests that read-only executions reject state-modifying code before running
+// it, but execute view code normally.
+func TestInterpreterRunReadOnly(t *testing.T) {
+	tests := []struct {
+		code []byte
+		ret  []byte
+		err  error
+	}{
+		// SSTORE(0, 1)
+		{code: []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(STOP)}, err: errReadOnlyViolation},
+		// MSTORE8(0, SSTORE), RETURN(0, 1): SSTORE is only push data
+		{code: []byte{byte(PUSH1), byte(SSTORE), byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(RETURN)}, ret: []byte{byte(SSTORE)}},
+	}
+	for i, tt := range tests {
+		evm := newInterpreterTestEVM(Config{}, nil)
+		contract := NewContract(AccountRef(interpreterTestCaller), AccountRef(interpreterTestTarget), new(big.Int), 100000)
+		contract.SetCallCode(&interpreterTestTarget, common.Hash{}, tt.code)
+
+		ret, err := evm.Interpreter().RunReadOnly(evm.StateDB.Snapshot(), contract, nil)
+		if err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if !bytes.Equal(ret, tt.ret) {
+			t.Errorf("test %d: return mismatch: have %x, want %x", i, ret, tt.ret)
+		}
+		if evm.Interpreter().readOnly {
+			t.Errorf("test %d: read-only mode not reset", i)
+		}
+	}
+}
+
+// benchmarkIntPool runs 1000 sequential call simulations per iteration, each
+// on a new EVM configured with the given integer pool.
+func benchmarkIntPool(b *testing.B, pool *IntPool) {
+	// ADD(1, 2) and MUL with the result a few times, then STOP
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 2}
+	for i := 0; i < 8; i++ {
+		code = append(code, byte(DUP1), byte(ADD), byte(DUP1), byte(MUL))
+	}
+	code = append(code, byte(STOP))
+	base := newInterpreterTestEVM(Config{}, map[common.Address][]byte{interpreterTestTarget: code})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			evm := NewEVM(base.Context, base.StateDB, params.TestChainConfig, Config{IntPool: pool})
+			if _, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int)); err != nil {
+				b.Fatalf("failed to execute call: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkIntPoolFresh(b *testing.B)  { benchmarkIntPool(b, nil) }
+func BenchmarkIntPoolShared(b *testing.B) { benchmarkIntPool(b, NewIntPool(0)) }
+
+// Tests that gas analysis executions complete regardless of the available gas,
+// metering what each operation would have cost without charging anything.
+func TestInterpreterGasAnalysis(t *testing.T) {
+	codes := map[common.Address][]byte{
+		// Call the callee (5*PUSH1, PUSH20, GAS, CALL: 15+3+2+700), POP (2)
+		interpreterTestTarget: append(callCode(interpreterTestCallee), byte(POP), byte(STOP)),
+		// MSTORE(0, 1): 3+3+3+3 for the memory word
+		interpreterTestCallee: {byte(PUSH1), 1, byte(PUSH1), 0, byte(MSTORE), byte(STOP)},
+	}
+	for _, gas := range []uint64{0, 1, 100000} {
+		evm := newInterpreterTestEVM(Config{GasAnalysis: true}, codes)
+		_, left, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, gas, new(big.Int))
+		if err != nil {
+			t.Fatalf("gas %d: failed to execute call: %v", gas, err)
+		}
+		if left != gas {
+			t.Errorf("gas %d: leftover gas mismatch: have %d, want %d", gas, left, gas)
+		}
+		if metered := evm.Interpreter().MeteredGas(); metered != 734 {
+			t.Errorf("gas %d: metered gas mismatch: have %d, want %d", gas, metered, 734)
+		}
+		// 10 operations of the caller, 4 of the callee, the call's cost excluding
+		// the callee's operations
+		ops, sum := evm.Interpreter().MeteredOps(), uint64(0)
+		if len(ops) != 14 {
+			t.Fatalf("gas %d: metered operation count mismatch: have %d, want 14", gas, len(ops))
+		}
+		for _, op := range ops {
+			sum += op.Cost
+		}
+		if sum != 734 {
+			t.Errorf("gas %d: metered operations sum mismatch: have %d, want 734", gas, sum)
+		}
+		if call := ops[7]; call.Op != CALL || call.Depth != 1 || call.Cost != 700 {
+			t.Errorf("gas %d: call metering mismatch: have %v at depth %d costing %d, want CALL at depth 1 costing 700", gas, call.Op, call.Depth, call.Cost)
+		}
+		if store := ops[10]; store.Op != MSTORE || store.Depth != 2 || store.Cost != 6 {
+			t.Errorf("gas %d: store metering mismatch: have %v at depth %d costing %d, want MSTORE at depth 2 costing 6", gas, store.Op, store.Depth, store.Cost)
+		}
+	}
+}
+
+// Tests that executions abort at the first forbidden opcode.
+func TestInterpreterForbiddenOps(t *testing.T) {
+	var forbidden [256]bool
+	forbidden[SELFDESTRUCT], forbidden[CALL] = true, true
+
+	logger := NewStructLogger(nil)
+	evm := newInterpreterTestEVM(Config{Debug: true, Tracer: logger, ForbiddenOps: forbidden}, map[common.Address][]byte{
+		// PUSH1 0, POP, SELFDESTRUCT(0)
+		interpreterTestTarget: {byte(PUSH1), 0, byte(POP), byte(PUSH1), 0, byte(SELFDESTRUCT)},
+	})
+	_, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int))
+	if err != errForbiddenOpcode {
+		t.Fatalf("error mismatch: have %v, want %v", err, errForbiddenOpcode)
+	}
+	logs := logger.StructLogs()
+	if len(logs) == 0 {
+		t.Fatalf("no steps traced")
+	}
+	if last := logs[len(logs)-1]; last.Pc != 5 || last.Op != SELFDESTRUCT || last.Err != errForbiddenOpcode {
+		t.Errorf("failing step mismatch: have pc %d, op %v, err %v, want pc 5, op SELFDESTRUCT, err %v", last.Pc, last.Op, last.Err, errForbiddenOpcode)
+	}
+	if evm.StateDB.HasSuicided(interpreterTestTarget) {
+		t.Errorf("forbidden opcode executed")
+	}
+}
+
+// storageTracer is a Tracer recording the storage accesses of an execution.
+type storageTracer struct {
+	*StructLogger
+	accesses []storageAccess
+}
+
+type storageAccess struct {
+	addr        common.Address
+	slot, value common.Hash
+	write       bool
+}
+
+func (t *storageTracer) CaptureStorageAccess(env *EVM, addr common.Address, slot, value common.Hash, write bool) {
+	t.accesses = append(t.accesses, storageAccess{addr, slot, value, write})
+}
+
+// Tests that tracers implementing StorageTracer are notified of the storage
+// slots written and read by an execution.
+func TestInterpreterCaptureStorageAccess(t *testing.T) {
+	tracer := &storageTracer{StructLogger: NewStructLogger(nil)}
+	evm := newInterpreterTestEVM(Config{Debug: true, Tracer: tracer}, map[common.Address][]byte{
+		// SSTORE(1, 0x2a), SLOAD(1), POP
+		interpreterTestTarget: {byte(PUSH1), 0x2a, byte(PUSH1), 1, byte(SSTORE), byte(PUSH1), 1, byte(SLOAD), byte(POP), byte(STOP)},
+	})
+	if _, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	slot, value := common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(0x2a))
+	want := []storageAccess{
+		{interpreterTestTarget, slot, value, true},
+		{interpreterTestTarget, slot, value, false},
+	}
+	if !reflect.DeepEqual(tracer.accesses, want) {
+		t.Errorf("storage accesses mismatch: have %+v, want %+v", tracer.accesses, want)
+	}
+}
+
+// Tests that executions paused at breakpoints by RunFrom can be resumed from
+// their snapshots, producing the same result as an uninterrupted execution.
+func TestInterpreterRunFrom(t *testing.T) {
+	// MSTORE(0, ADD(3, 2)), MSTORE(0x20, 5), RETURN(0, 0x40)
+	code := []byte{
+		byte(PUSH1), 2, byte(PUSH1), 3, byte(ADD), byte(PUSH1), 0, byte(MSTORE),
+		byte(PUSH1), 5, byte(PUSH1), 0x20, byte(MSTORE),
+		byte(PUSH1), 0x40, byte(PUSH1), 0, byte(RETURN),
+	}
+	newContract := func() *Contract {
+		contract := NewContract(AccountRef(interpreterTestCaller), AccountRef(interpreterTestTarget), new(big.Int), 100000)
+		contract.SetCallCode(&interpreterTestTarget, common.Hash{}, code)
+		return contract
+	}
+	// Run the code without interruption for reference
+	evm := newInterpreterTestEVM(Config{}, nil)
+	contract := newContract()
+	want, err := evm.Interpreter().Run(evm.StateDB.Snapshot(), contract, nil)
+	if err != nil {
+		t.Fatalf("failed to run code: %v", err)
+	}
+	wantGas := contract.Gas
+
+	// Run it again, pausing at ADD and the second MSTORE
+	evm = newInterpreterTestEVM(Config{Breakpoints: map[uint64]bool{4: true, 12: true}}, nil)
+	ret, state, err := evm.Interpreter().RunFrom(nil, newContract())
+	if err != nil || ret != nil || state == nil {
+		t.Fatalf("execution not paused: ret %x, state %v, err %v", ret, state, err)
+	}
+	if state.PC != 4 || len(state.Stack) != 2 || len(state.Mem) != 0 {
+		t.Fatalf("first pause mismatch: have pc %d, %d stack items, %d memory bytes, want pc 4, 2 items, 0 bytes", state.PC, len(state.Stack), len(state.Mem))
+	}
+	ret, state, err = evm.Interpreter().RunFrom(state, newContract())
+	if err != nil || ret != nil || state == nil {
+		t.Fatalf("execution not paused: ret %x, state %v, err %v", ret, state, err)
+	}
+	if state.PC != 12 || len(state.Stack) != 2 || len(state.Mem) != 32 {
+		t.Fatalf("second pause mismatch: have pc %d, %d stack items, %d memory bytes, want pc 12, 2 items, 32 bytes", state.PC, len(state.Stack), len(state.Mem))
+	}
+	// Resuming from the same snapshot repeatedly has to produce the same result
+	for i := 0; i < 2; i++ {
+		contract := newContract()
+		ret, final, err := evm.Interpreter().RunFrom(state, contract)
+		if err != nil || final != nil {
+			t.Fatalf("resume %d: execution not completed: state %v, err %v", i, final, err)
+		}
+		if !bytes.Equal(ret, want) {
+			t.Errorf("resume %d: output mismatch: have %x, want %x", i, ret, want)
+		}
+		if contract.Gas != wantGas {
+			t.Errorf("resume %d: gas left mismatch: have %d, want %d", i, contract.Gas, wantGas)
+		}
+	}
+}
@@ -22,24 +22,37 @@ var checkVal = big.NewInt(-42)
 
 const poolLimit = 256
 
-// intPool is a pool of big integers that
+// IntPool is a pool of big integers that
 // can be reused for all big.Int operations.
-type intPool struct {
-	pool *Stack
+//
+// A pool may be shared by interpreters running one after the other (see
+// Config.IntPool), but not by concurrently running ones.
+type IntPool struct {
+	pool  *Stack
+	limit int
+}
+
+// NewIntPool creates a pool retaining at most limit integers, 0 meaning the
+// default limit.
+func NewIntPool(limit int) *IntPool {
+	if limit <= 0 {
+		limit = poolLimit
+	}
+	return &IntPool{pool: newstack(), limit: limit}
 }
 
-func newIntPool() *intPool {
-	return &intPool{pool: newstack()}
+func newIntPool() *IntPool {
+	return NewIntPool(0)
 }
 
-func (p *intPool) get() *big.Int {
+func (p *IntPool) get() *big.Int {
 	if p.pool.len() > 0 {
 		return p.pool.pop()
 	}
 	return new(big.Int)
 }
-func (p *intPool) put(is ...*big.Int) {
-	if len(p.pool.data) > poolLimit {
+func (p *IntPool) put(is ...*big.Int) {
+	if len(p.pool.data) > p.limit {
 		return
 	}
 
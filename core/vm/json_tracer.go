@@ -0,0 +1,97 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+// jsonEnd is the final record emitted by the JSON tracer once the execution ends.
+type jsonEnd struct {
+	Output  string              `json:"output"`
+	GasUsed math.HexOrDecimal64 `json:"gasUsed"`
+	Time    time.Duration       `json:"time"`
+	Err     string              `json:"error,omitempty"`
+}
+
+// jsonTracer is a Tracer writing every execution step as a JSON encoded
+// StructLog, in the same format as the struct logs of the StructLogger.
+type jsonTracer struct {
+	encoder *json.Encoder
+	cfg     LogConfig
+}
+
+// NewJSONTracer returns a Tracer writing one JSON object per executed step to
+// the given writer, each on its own line, with the memory and storage left
+// empty. A step failing before execution (e.g. running out of gas) is written
+// with its error.
+//
+// The tracer is enabled by setting it as Config.Tracer, along with Config.Debug.
+func NewJSONTracer(w io.Writer) Tracer {
+	return NewJSONLogger(&LogConfig{DisableMemory: true, DisableStorage: true}, w)
+}
+
+// NewJSONLogger returns a Tracer writing the executed steps to the given writer
+// just like NewJSONTracer, but capturing the memory and stack as configured. The
+// storage is never captured. A nil config captures both.
+func NewJSONLogger(cfg *LogConfig, w io.Writer) Tracer {
+	t := &jsonTracer{encoder: json.NewEncoder(w)}
+	if cfg != nil {
+		t.cfg = *cfg
+	}
+	return t
+}
+
+// CaptureState writes the step about to be executed.
+func (t *jsonTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	log := StructLog{
+		Pc:         pc,
+		Op:         op,
+		Gas:        gas,
+		GasCost:    cost,
+		MemorySize: memory.Len(),
+		Depth:      depth,
+		Err:        err,
+	}
+	if !t.cfg.DisableMemory {
+		log.Memory = memory.Data()
+	}
+	if !t.cfg.DisableStack {
+		log.Stack = stack.Data()
+	}
+	return t.encoder.Encode(log)
+}
+
+// CaptureBreakpoint is called when the execution pauses at a breakpoint. The
+// JSON tracer doesn't act on breakpoints.
+func (t *jsonTracer) CaptureBreakpoint(env *EVM, pc uint64, op OpCode, gas uint64, memory *Memory, stack *Stack, contract *Contract, depth int) error {
+	return nil
+}
+
+// CaptureEnd writes the outcome of the execution.
+func (t *jsonTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	end := jsonEnd{Output: common.Bytes2Hex(output), GasUsed: math.HexOrDecimal64(gasUsed), Time: d}
+	if err != nil {
+		end.Err = err.Error()
+	}
+	return t.encoder.Encode(end)
+}
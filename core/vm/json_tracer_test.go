@@ -0,0 +1,94 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Tests that the JSON tracer emits one parseable record per executed step, in
+// execution order, including a final record for a failing opcode.
+func TestJSONTracer(t *testing.T) {
+	// PUSH1 1, PUSH1 2, ADD, INVALID
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 2, byte(ADD), 0xfe}
+
+	var buf bytes.Buffer
+	evm := newInterpreterTestEVM(Config{Debug: true, Tracer: NewJSONTracer(&buf)}, map[common.Address][]byte{interpreterTestTarget: code})
+	if _, _, err := evm.Call(AccountRef(interpreterTestCaller), interpreterTestTarget, nil, 100000, new(big.Int)); err == nil {
+		t.Fatalf("invalid opcode executed")
+	}
+	want := []struct {
+		pc    uint64
+		op    OpCode
+		stack []int64
+		err   bool
+	}{
+		{0, PUSH1, nil, false},
+		{2, PUSH1, []int64{1}, false},
+		{4, ADD, []int64{1, 2}, false},
+		{5, OpCode(0xfe), []int64{3}, true},
+	}
+	var (
+		steps []StructLog
+		errs  []bool
+	)
+	for scanner := bufio.NewScanner(&buf); scanner.Scan(); {
+		// Errors are encoded opaquely by StructLog, so only check their presence
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			t.Fatalf("failed to parse step %d %q: %v", len(steps), scanner.Text(), err)
+		}
+		errs = append(errs, string(fields["error"]) != "null")
+		delete(fields, "error")
+
+		blob, _ := json.Marshal(fields)
+		var step StructLog
+		if err := json.Unmarshal(blob, &step); err != nil {
+			t.Fatalf("failed to parse step %d %q: %v", len(steps), scanner.Text(), err)
+		}
+		if len(step.Memory) != 0 {
+			t.Errorf("step %d: memory captured: %x", len(steps), step.Memory)
+		}
+		steps = append(steps, step)
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("step count mismatch: have %d, want %d", len(steps), len(want))
+	}
+	for i, step := range steps {
+		if step.Pc != want[i].pc || step.Op != want[i].op {
+			t.Errorf("step %d: op mismatch: have %v at %d, want %v at %d", i, step.Op, step.Pc, want[i].op, want[i].pc)
+		}
+		if len(step.Stack) != len(want[i].stack) {
+			t.Errorf("step %d: stack size mismatch: have %d, want %d", i, len(step.Stack), len(want[i].stack))
+			continue
+		}
+		for j, item := range step.Stack {
+			if item.Int64() != want[i].stack[j] {
+				t.Errorf("step %d: stack item %d mismatch: have %v, want %d", i, j, item, want[i].stack[j])
+			}
+		}
+		if errs[i] != want[i].err {
+			t.Errorf("step %d: error mismatch: have error %v, want error %v", i, errs[i], want[i].err)
+		}
+	}
+}
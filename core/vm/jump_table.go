@@ -60,6 +60,28 @@ type operation struct {
 	returns bool // determines whether the operations sets the return data content
 }
 
+// Operation describes a custom operation to execute for an opcode instead of its
+// default one, see Interpreter.OverrideOp.
+type Operation struct {
+	// Execute executes the operation
+	Execute func(pc *uint64, evm *EVM, contract *Contract, memory *Memory, stack *Stack) ([]byte, error)
+	// Gas returns the gas cost of the operation, memorySize being the memory it
+	// requires in bytes
+	Gas func(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, memory *Memory, memorySize uint64) (uint64, error)
+	// MemorySize returns the memory required by the operation, nil if it doesn't
+	// use memory
+	MemorySize func(stack *Stack) *big.Int
+
+	MinStack int // Number of stack items the operation needs
+	MaxStack int // Maximum stack size before the operation for the stack limit not to be exceeded
+
+	Halts   bool // Whether the operation halts further execution
+	Jumps   bool // Whether the operation sets the program counter itself
+	Writes  bool // Whether the operation modifies the state
+	Reverts bool // Whether the operation reverts the state (implicitly halting)
+	Returns bool // Whether the operation sets the return data content
+}
+
 var (
 	frontierInstructionSet  = NewFrontierInstructionSet()
 	homesteadInstructionSet = NewHomesteadInstructionSet()
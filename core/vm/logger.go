@@ -80,14 +80,25 @@ func (s *StructLog) OpName() string {
 
 // Tracer is used to collect execution traces from an EVM transaction
 // execution. CaptureState is called for each step of the VM with the
-// current VM state.
+// current VM state. CaptureBreakpoint is called when the execution pauses
+// at a breakpoint, before the instruction at pc is executed; the execution
+// stays paused until Interpreter.Resume is called, or is aborted with the
+// returned error.
 // Note that reference types are actual VM data structures; make copies
 // if you need to retain them beyond the current call.
 type Tracer interface {
 	CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error
+	CaptureBreakpoint(env *EVM, pc uint64, op OpCode, gas uint64, memory *Memory, stack *Stack, contract *Contract, depth int) error
 	CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error
 }
 
+// StorageTracer is an optional interface a Tracer may implement to be notified
+// of the storage slots read (SLOAD) and written (SSTORE) by a debugged
+// execution, along with the value read or written.
+type StorageTracer interface {
+	CaptureStorageAccess(env *EVM, addr common.Address, slot, value common.Hash, write bool)
+}
+
 // StructLogger is an EVM state logger and implements Tracer.
 //
 // StructLogger can capture state based on the given Log configuration and also keeps
@@ -161,6 +172,12 @@ func (l *StructLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost ui
 	return nil
 }
 
+// CaptureBreakpoint is called when the execution pauses at a breakpoint. The
+// StructLogger doesn't act on breakpoints.
+func (l *StructLogger) CaptureBreakpoint(env *EVM, pc uint64, op OpCode, gas uint64, memory *Memory, stack *Stack, contract *Contract, depth int) error {
+	return nil
+}
+
 func (l *StructLogger) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
 	fmt.Printf("0x%x", output)
 	if err != nil {
@@ -174,6 +191,14 @@ func (l *StructLogger) StructLogs() []StructLog {
 	return l.logs
 }
 
+// Reset discards the captured log entries and tracked storage changes, so the
+// logger can be reused for a new execution. Previously returned logs remain
+// valid.
+func (l *StructLogger) Reset() {
+	l.logs = nil
+	l.changedValues = make(map[common.Address]Storage)
+}
+
 // WriteTrace writes a formatted trace to the given writer
 func WriteTrace(writer io.Writer, logs []StructLog) {
 	for _, log := range logs {
@@ -57,6 +57,18 @@ func (st *Stack) pop() (ret *big.Int) {
 	return
 }
 
+// Push pushes an item on top of the stack, e.g. for operations defined outside
+// of this package.
+func (st *Stack) Push(d *big.Int) {
+	st.push(d)
+}
+
+// Pop removes the top item of the stack and returns it, e.g. for operations
+// defined outside of this package.
+func (st *Stack) Pop() *big.Int {
+	return st.pop()
+}
+
 func (st *Stack) len() int {
 	return len(st.data)
 }
@@ -67,7 +79,7 @@ func (st *Stack) swap(n int) {
 }
 
 // 复制指定位置的值到堆顶
-func (st *Stack) dup(pool *intPool, n int) {
+func (st *Stack) dup(pool *IntPool, n int) {
 	st.push(pool.get().Set(st.data[st.len()-n]))
 }
 
@@ -22,6 +22,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -372,3 +373,32 @@ func (tb *tableBatch) Write() error {
 func (tb *tableBatch) ValueSize() int {
 	return tb.batch.ValueSize()
 }
+
+// CollisionBatch is a Batch wrapper recording every key that is put more than
+// once before the batch is written. The underlying batch still receives all the
+// writes, so the last value put for a key is the one stored.
+type CollisionBatch struct {
+	Batch
+	seen       map[string]struct{}
+	collisions [][]byte
+}
+
+// NewCollisionBatch returns a Batch recording the key collisions of the given one.
+func NewCollisionBatch(batch Batch) *CollisionBatch {
+	return &CollisionBatch{Batch: batch, seen: make(map[string]struct{})}
+}
+
+func (cb *CollisionBatch) Put(key, value []byte) error {
+	if _, ok := cb.seen[string(key)]; ok {
+		cb.collisions = append(cb.collisions, common.CopyBytes(key))
+	} else {
+		cb.seen[string(key)] = struct{}{}
+	}
+	return cb.Batch.Put(key, value)
+}
+
+// CollisionKeys returns the keys put into the batch more than once, in the order
+// of the colliding writes.
+func (cb *CollisionBatch) CollisionKeys() [][]byte {
+	return cb.collisions
+}
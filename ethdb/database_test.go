@@ -194,3 +194,61 @@ func testParallelPutGet(db ethdb.Database, t *testing.T) {
 	}
 	pending.Wait()
 }
+
+func TestLDB_BatchCollisions(t *testing.T) {
+	db, remove := newTestLDB()
+	defer remove()
+	testBatchCollisions(db, t)
+}
+
+func TestMemoryDB_BatchCollisions(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	testBatchCollisions(db, t)
+}
+
+func testBatchCollisions(db ethdb.Database, t *testing.T) {
+	batch := ethdb.NewCollisionBatch(db.NewBatch())
+	batch.Put([]byte("key"), []byte("first"))
+	batch.Put([]byte("other"), []byte("value"))
+	batch.Put([]byte("key"), []byte("second"))
+
+	if keys := batch.CollisionKeys(); len(keys) != 1 || !bytes.Equal(keys[0], []byte("key")) {
+		t.Fatalf("collision keys mismatch: have %q, want [\"key\"]", keys)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+	if data, err := db.Get([]byte("key")); err != nil || !bytes.Equal(data, []byte("second")) {
+		t.Fatalf("stored value mismatch: have %q (%v), want %q", data, err, "second")
+	}
+}
+
+func TestReadOnlyDatabase(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	db.Put([]byte("key"), []byte("value"))
+
+	rodb := ethdb.NewReadOnlyDatabase(db)
+	if data, err := rodb.Get([]byte("key")); err != nil || !bytes.Equal(data, []byte("value")) {
+		t.Fatalf("read mismatch: have %q (%v), want %q", data, err, "value")
+	}
+	if has, err := rodb.Has([]byte("key")); err != nil || !has {
+		t.Fatalf("has mismatch: have %v (%v), want true", has, err)
+	}
+	if err := rodb.Put([]byte("key"), []byte("other")); err != ethdb.ErrReadOnly {
+		t.Errorf("put error mismatch: have %v, want %v", err, ethdb.ErrReadOnly)
+	}
+	if err := rodb.Delete([]byte("key")); err != ethdb.ErrReadOnly {
+		t.Errorf("delete error mismatch: have %v, want %v", err, ethdb.ErrReadOnly)
+	}
+	batch := rodb.NewBatch()
+	if err := batch.Put([]byte("key"), []byte("other")); err != nil {
+		t.Errorf("batch put failed: %v", err)
+	}
+	if err := batch.Write(); err != ethdb.ErrReadOnly {
+		t.Errorf("batch write error mismatch: have %v, want %v", err, ethdb.ErrReadOnly)
+	}
+	rodb.Close()
+	if data, err := db.Get([]byte("key")); err != nil || !bytes.Equal(data, []byte("value")) {
+		t.Fatalf("underlying database modified: have %q (%v), want %q", data, err, "value")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+import "errors"
+
+// ErrReadOnly is returned by the mutating operations of a read-only database.
+var ErrReadOnly = errors.New("read-only database")
+
+// readOnlyDatabase wraps a database, passing reads through but rejecting all
+// attempts to modify it.
+type readOnlyDatabase struct {
+	db Database
+}
+
+// NewReadOnlyDatabase returns a Database exposing only the read operations of
+// the given one. Put, Delete and writing batches fail with ErrReadOnly, while
+// Close is a no-op as the underlying database is owned by someone else.
+func NewReadOnlyDatabase(db Database) Database {
+	return &readOnlyDatabase{db: db}
+}
+
+func (db *readOnlyDatabase) Put(key []byte, value []byte) error {
+	return ErrReadOnly
+}
+
+func (db *readOnlyDatabase) Get(key []byte) ([]byte, error) {
+	return db.db.Get(key)
+}
+
+func (db *readOnlyDatabase) Has(key []byte) (bool, error) {
+	return db.db.Has(key)
+}
+
+func (db *readOnlyDatabase) Delete(key []byte) error {
+	return ErrReadOnly
+}
+
+func (db *readOnlyDatabase) Close() {
+	// Do nothing; don't close the underlying DB.
+}
+
+func (db *readOnlyDatabase) NewBatch() Batch {
+	return new(readOnlyBatch)
+}
+
+// readOnlyBatch is a batch accepting writes, but failing when committed.
+type readOnlyBatch struct {
+	size int
+}
+
+func (b *readOnlyBatch) Put(key, value []byte) error {
+	b.size += len(value)
+	return nil
+}
+
+func (b *readOnlyBatch) Write() error {
+	return ErrReadOnly
+}
+
+func (b *readOnlyBatch) ValueSize() int {
+	return b.size
+}
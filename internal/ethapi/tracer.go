@@ -345,6 +345,11 @@ func (jst *JavascriptTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode,
 	return nil
 }
 
+// CaptureBreakpoint is called when the execution pauses at a breakpoint
+func (jst *JavascriptTracer) CaptureBreakpoint(env *vm.EVM, pc uint64, op vm.OpCode, gas uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int) error {
+	return nil
+}
+
 // CaptureEnd is called after the call finishes
 func (jst *JavascriptTracer) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
 	//TODO! @Arachnid please figure out of there's anything we can use this method for
@@ -53,7 +53,13 @@ const (
 	MemoryGas        uint64 = 3     // Times the address of the (highest referenced byte in memory + 1). NOTE: referencing happens on read, write and in instructions such as RETURN and CALL.
 	TxDataNonZeroGas uint64 = 68    // Per byte of data attached to a transaction that is not equal to zero. NOTE: Not payable on data of calls between transactions.
 
-	MaxCodeSize = 24576 // Maximum bytecode to permit for a contract
+	MaxCodeSize     = 24576           // Maximum bytecode to permit for a contract
+	MaxInitCodeSize = 2 * MaxCodeSize // Maximum initcode to permit in a creation transaction and create instructions (EIP-3860)
+
+	InitCodeWordGas uint64 = 2 // Once per word of the init code when creating a contract (EIP-3860)
+
+	RefundQuotient        uint64 = 2 // Maximum refund quotient; max gas refund is gasUsed / RefundQuotient
+	RefundQuotientEIP3529 uint64 = 5 // Maximum refund quotient after London (EIP-3529)
 
 	// Precompiled contract gas prices
 
@@ -23,9 +23,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"reflect"
 	"strings"
+	"time"
 )
 
 var (
@@ -62,10 +64,14 @@ type Decoder interface {
 // list. The decoded elements of the list are assigned to each public
 // field in the order given by the struct's definition. The input list
 // must contain an element for each decoded field. Decode returns an
-// error if there are too few or too many elements.
+// error if there are too few or too many elements. If extra elements
+// should be skipped instead (e.g. to accept structs extended by newer
+// versions of a protocol), decode using a Stream with IgnoreExtraFields
+// set.
 //
 // The decoding of struct fields honours certain struct tags, "tail",
-// "nil" and "-".
+// "nil", "nilString", "nilList", "distinguishNil", "optional", "size=N"
+// and "-".
 //
 // The "-" tag ignores fields.
 //
@@ -79,6 +85,24 @@ type Decoder interface {
 //         Foo *[20]byte `rlp:"nil"`
 //     }
 //
+// The "nilString" and "nilList" tags work like "nil", but fix the empty
+// value a nil pointer is encoded as to an empty string (0x80) or an empty
+// list (0xC0), regardless of the element type. Only that empty value then
+// decodes as nil.
+//
+// The "optional" tag allows a field to be missing from the input list,
+// leaving it (and all following fields) zero-valued. This is useful for
+// structs which gained trailing fields over time. Only optional fields (or
+// a final "tail" field) may follow an optional field.
+//
+// The "size=N" tag applies to byte slice and array fields, requiring the
+// input string to be exactly N bytes long. For arrays, N must match the
+// array length, which is enforced anyway.
+//
+// The "distinguishNil" tag applies to slice-typed fields and preserves the
+// difference between nil and empty slices. Nil slices are encoded as an
+// empty string (an empty list for byte slices) and decode back as nil.
+//
 // To decode into a slice, the input must be a list and the resulting
 // slice will contain the input elements in order. For byte slices,
 // the input must be an RLP string. Array types decode similarly, with
@@ -94,6 +118,9 @@ type Decoder interface {
 // type, Decode will return an error. Decode also supports *big.Int.
 // There is no size limit for big integers.
 //
+// To decode into a time.Time, the input must be a list of two integers, as
+// written by Encode. The decoded time is in UTC.
+//
 // To decode into an interface value, Decode stores one of these
 // in the value:
 //
@@ -174,8 +201,13 @@ func addErrorContext(err error, ctx string) error {
 var (
 	decoderInterface = reflect.TypeOf(new(Decoder)).Elem()
 	bigInt           = reflect.TypeOf(big.Int{})
+	timeType         = reflect.TypeOf(time.Time{})
 )
 
+// yearOneUnix is the Unix time of January 1, year 1 UTC (the zero time), which
+// time.Time values are encoded relative to.
+const yearOneUnix = -62135596800
+
 // 创建解码器
 func makeDecoder(typ reflect.Type, tags tags) (dec decoder, err error) {
 	kind := typ.Kind()
@@ -190,23 +222,29 @@ func makeDecoder(typ reflect.Type, tags tags) (dec decoder, err error) {
 		return decodeBigInt, nil
 	case typ.AssignableTo(bigInt):
 		return decodeBigIntNoPtr, nil
+	case typ == timeType:
+		return decodeTime, nil
 	case isUint(kind):
 		return decodeUint, nil
 	case kind == reflect.Bool:
 		return decodeBool, nil
 	case kind == reflect.String:
 		return decodeString, nil
+	case kind == reflect.Slice && tags.distinguishNil:
+		return makeNilSliceDecoder(typ)
 	case kind == reflect.Slice || kind == reflect.Array:
 		return makeListDecoder(typ, tags)
 	case kind == reflect.Struct:
 		return makeStructDecoder(typ)
 	case kind == reflect.Ptr:
 		if tags.nilOK {
-			return makeOptionalPtrDecoder(typ)
+			return makeOptionalPtrDecoder(typ, tags)
 		}
 		return makePtrDecoder(typ)
 	case kind == reflect.Interface:
 		return decodeInterface, nil
+	case kind == reflect.Map && tags.sortedMap:
+		return makeSortedMapDecoder(typ)
 	default:
 		return nil, fmt.Errorf("rlp: type %v is not RLP-serializable", typ)
 	}
@@ -271,11 +309,39 @@ func decodeBigInt(s *Stream, val reflect.Value) error {
 	return nil
 }
 
+func decodeTime(s *Stream, val reflect.Value) error {
+	if _, err := s.List(); err != nil {
+		return wrapStreamError(err, val.Type())
+	}
+	sec, err := s.Uint()
+	if err == EOL {
+		return &decodeError{msg: "too few elements", typ: val.Type()}
+	} else if err != nil {
+		return wrapStreamError(err, val.Type())
+	}
+	nsec, err := s.uint(32)
+	if err == EOL {
+		return &decodeError{msg: "too few elements", typ: val.Type()}
+	} else if err != nil {
+		return wrapStreamError(err, val.Type())
+	}
+	if sec > math.MaxInt64+yearOneUnix || nsec >= 1e9 {
+		return &decodeError{msg: "time out of range", typ: val.Type()}
+	}
+	if err := s.ListEnd(); err != nil {
+		return wrapStreamError(err, val.Type())
+	}
+	val.Set(reflect.ValueOf(time.Unix(int64(sec)+yearOneUnix, int64(nsec)).UTC()))
+	return nil
+}
+
 func makeListDecoder(typ reflect.Type, tag tags) (decoder, error) {
 	etype := typ.Elem()
 	if etype.Kind() == reflect.Uint8 && !reflect.PtrTo(etype).Implements(decoderInterface) {
 		if typ.Kind() == reflect.Array {
 			return decodeByteArray, nil
+		} else if tag.size > 0 {
+			return makeSizedByteSliceDecoder(tag.size), nil
 		} else {
 			return decodeByteSlice, nil
 		}
@@ -306,6 +372,36 @@ func makeListDecoder(typ reflect.Type, tag tags) (decoder, error) {
 	return dec, nil
 }
 
+// makeNilSliceDecoder creates a decoder for slice fields with struct tag
+// "distinguishNil". It decodes the empty value written by makeNilSliceWriter
+// for nil slices (an empty string, or an empty list for byte slices) as a nil
+// slice. All other input is decoded like a regular slice.
+func makeNilSliceDecoder(typ reflect.Type) (decoder, error) {
+	inner, err := makeDecoder(typ, tags{})
+	if err != nil {
+		return nil, err
+	}
+	nilkind := String
+	if etype := typ.Elem(); etype.Kind() == reflect.Uint8 && !reflect.PtrTo(etype).Implements(decoderInterface) {
+		nilkind = List
+	}
+	dec := func(s *Stream, val reflect.Value) error {
+		kind, size, err := s.Kind()
+		if err != nil {
+			return err
+		}
+		if kind == nilkind && size == 0 {
+			// rearm s.Kind so the input position advances past the
+			// empty value, then set the slice to nil.
+			s.kind = -1
+			val.Set(reflect.Zero(typ))
+			return nil
+		}
+		return inner(s, val)
+	}
+	return dec, nil
+}
+
 func decodeListSlice(s *Stream, val reflect.Value, elemdec decoder) error {
 	size, err := s.List()
 	if err != nil {
@@ -378,6 +474,28 @@ func decodeByteSlice(s *Stream, val reflect.Value) error {
 	return nil
 }
 
+// makeSizedByteSliceDecoder creates a decoder for byte slices with struct tag
+// "size=N", rejecting inputs which aren't exactly size bytes long. Byte arrays
+// with the tag are decoded by decodeByteArray, which checks the length anyway.
+func makeSizedByteSliceDecoder(size int) decoder {
+	return func(s *Stream, val reflect.Value) error {
+		kind, n, err := s.Kind()
+		if err != nil {
+			return err
+		}
+		if kind == Byte {
+			n = 1
+		}
+		if kind != List && n < uint64(size) {
+			return &decodeError{msg: fmt.Sprintf("input string too short (want %d bytes)", size), typ: val.Type()}
+		}
+		if kind != List && n > uint64(size) {
+			return &decodeError{msg: fmt.Sprintf("input string too long (want %d bytes)", size), typ: val.Type()}
+		}
+		return decodeByteSlice(s, val)
+	}
+}
+
 func decodeByteArray(s *Stream, val reflect.Value) error {
 	kind, size, err := s.Kind()
 	if err != nil {
@@ -424,14 +542,89 @@ func makeStructDecoder(typ reflect.Type) (decoder, error) {
 		if _, err := s.List(); err != nil {
 			return wrapStreamError(err, typ)
 		}
-		for _, f := range fields {
+		for i, f := range fields {
 			err := f.info.decoder(s, val.Field(f.index))
+			if err == EOL && f.optional {
+				// 输入中缺少的可选字段置为零值
+				for _, f := range fields[i:] {
+					fv := val.Field(f.index)
+					fv.Set(reflect.Zero(fv.Type()))
+				}
+				break
+			}
 			if err == EOL {
 				return &decodeError{msg: "too few elements", typ: typ}
 			} else if err != nil {
 				return addErrorContext(err, "."+typ.Field(f.index).Name)
 			}
 		}
+		if s.IgnoreExtraFields {
+			// Drain any elements beyond the struct's fields
+			for {
+				if _, err := s.Raw(); err == EOL {
+					break
+				} else if err != nil {
+					return wrapStreamError(err, typ)
+				}
+			}
+		}
+		return wrapStreamError(s.ListEnd(), typ)
+	}
+	return dec, nil
+}
+
+// makeSortedMapDecoder creates a decoder for map fields with struct tag
+// "sortedmap". The input must be a list of [key, value] lists, with the keys
+// in strictly increasing order of their encoding, as written by the encoder.
+func makeSortedMapDecoder(typ reflect.Type) (decoder, error) {
+	keyinfo, err := cachedTypeInfo1(typ.Key(), tags{})
+	if err != nil {
+		return nil, err
+	}
+	valinfo, err := cachedTypeInfo1(typ.Elem(), tags{})
+	if err != nil {
+		return nil, err
+	}
+	dec := func(s *Stream, val reflect.Value) error {
+		if _, err := s.List(); err != nil {
+			return wrapStreamError(err, typ)
+		}
+		m := reflect.MakeMap(typ)
+		var prev []byte
+		for i := 0; ; i++ {
+			if _, err := s.List(); err == EOL {
+				break
+			} else if err != nil {
+				return addErrorContext(wrapStreamError(err, typ), fmt.Sprint("[", i, "]"))
+			}
+			// 保证 key 严格递增，编码才是唯一的
+			raw, err := s.Raw()
+			if err == EOL {
+				return &decodeError{msg: "too few elements", typ: typ}
+			} else if err != nil {
+				return addErrorContext(err, fmt.Sprint("[", i, "]"))
+			}
+			if prev != nil && bytes.Compare(raw, prev) <= 0 {
+				return &decodeError{msg: "map keys not in strictly increasing order", typ: typ}
+			}
+			prev = raw
+
+			key := reflect.New(typ.Key()).Elem()
+			if err := keyinfo.decoder(NewStream(bytes.NewReader(raw), uint64(len(raw))), key); err != nil {
+				return addErrorContext(err, fmt.Sprint("[", i, "].key"))
+			}
+			value := reflect.New(typ.Elem()).Elem()
+			if err := valinfo.decoder(s, value); err == EOL {
+				return &decodeError{msg: "too few elements", typ: typ}
+			} else if err != nil {
+				return addErrorContext(err, fmt.Sprint("[", i, "].value"))
+			}
+			if err := s.ListEnd(); err != nil {
+				return wrapStreamError(err, typ)
+			}
+			m.SetMapIndex(key, value)
+		}
+		val.Set(m)
 		return wrapStreamError(s.ListEnd(), typ)
 	}
 	return dec, nil
@@ -463,7 +656,9 @@ func makePtrDecoder(typ reflect.Type) (decoder, error) {
 // just like makePtrDecoder does.
 //
 // This decoder is used for pointer-typed struct fields with struct tag "nil".
-func makeOptionalPtrDecoder(typ reflect.Type) (decoder, error) {
+// With "nilString" or "nilList", only the empty value of that kind decodes
+// as nil.
+func makeOptionalPtrDecoder(typ reflect.Type, ts tags) (decoder, error) {
 	etype := typ.Elem()
 	etypeinfo, err := cachedTypeInfo1(etype, tags{})
 	if err != nil {
@@ -471,7 +666,7 @@ func makeOptionalPtrDecoder(typ reflect.Type) (decoder, error) {
 	}
 	dec := func(s *Stream, val reflect.Value) (err error) {
 		kind, size, err := s.Kind()
-		if err != nil || size == 0 && kind != Byte {
+		if err != nil || size == 0 && kind != Byte && (!ts.nilString || kind == String) && (!ts.nilList || kind == List) {
 			// rearm s.Kind. This is important because the input
 			// position must advance to the next value even though
 			// we don't read anything.
@@ -614,6 +809,10 @@ type Stream struct {
 	byteval byte   // value of single byte in type tag
 	kinderr error  // error from last readKind
 	stack   []listpos
+
+	// IgnoreExtraFields makes struct decoding skip list elements beyond
+	// the fields of the struct instead of returning an error.
+	IgnoreExtraFields bool
 }
 
 type listpos struct{ pos, size uint64 }
@@ -26,6 +26,9 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
 )
 
 func TestStreamKind(t *testing.T) {
@@ -691,6 +694,294 @@ func TestDecoderInByteSlice(t *testing.T) {
 	}
 }
 
+type nilSliceStruct struct {
+	Uints []uint   `rlp:"distinguishNil"`
+	Bytes []byte   `rlp:"distinguishNil"`
+	Plain []string // nil and empty both decode as empty
+}
+
+type invalidDistinguishNil struct {
+	A uint `rlp:"distinguishNil"`
+}
+
+func TestDistinguishNilRoundTrip(t *testing.T) {
+	tests := []struct {
+		val    nilSliceStruct
+		output string
+	}{
+		{val: nilSliceStruct{}, output: "C380C0C0"},
+		{val: nilSliceStruct{Uints: []uint{}, Bytes: []byte{}, Plain: []string{}}, output: "C3C080C0"},
+		{val: nilSliceStruct{Uints: []uint{1}, Bytes: []byte{2}}, output: "C4C10102C0"},
+	}
+	for i, test := range tests {
+		enc, err := EncodeToBytes(&test.val)
+		if err != nil {
+			t.Fatalf("test %d: encode error: %v", i, err)
+		}
+		if !bytes.Equal(enc, unhex(test.output)) {
+			t.Errorf("test %d: output mismatch: got %X, want %s", i, enc, test.output)
+		}
+		var dec nilSliceStruct
+		if err := DecodeBytes(enc, &dec); err != nil {
+			t.Fatalf("test %d: decode error: %v", i, err)
+		}
+		if (dec.Uints == nil) != (test.val.Uints == nil) || (dec.Bytes == nil) != (test.val.Bytes == nil) {
+			t.Errorf("test %d: nil-ness lost: got %#v, want %#v", i, dec, test.val)
+		}
+		if len(dec.Uints) != len(test.val.Uints) || !bytes.Equal(dec.Bytes, test.val.Bytes) {
+			t.Errorf("test %d: value mismatch: got %#v, want %#v", i, dec, test.val)
+		}
+	}
+	if _, err := EncodeToBytes(&invalidDistinguishNil{}); err == nil {
+		t.Errorf("expected error for distinguishNil tag on non-slice field")
+	}
+}
+
+type nilKindBytes struct {
+	Default *[]byte `rlp:"nil"`
+	String  *[]byte `rlp:"nilString"`
+	List    *[]byte `rlp:"nilList"`
+}
+
+type nilKindStructs struct {
+	Default *simplestruct `rlp:"nil"`
+	String  *simplestruct `rlp:"nilString"`
+	List    *simplestruct `rlp:"nilList"`
+}
+
+type invalidNilString struct {
+	A []byte `rlp:"nilString"`
+}
+
+func TestNilKindRoundTrip(t *testing.T) {
+	data, value := []byte{1}, simplestruct{A: 1, B: "x"}
+	tests := []struct {
+		val    interface{}
+		output string
+	}{
+		{val: &nilKindBytes{}, output: "C38080C0"},
+		{val: &nilKindBytes{&data, &data, &data}, output: "C3010101"},
+		{val: &nilKindStructs{}, output: "C3C080C0"},
+		{val: &nilKindStructs{&value, &value, &value}, output: "C9C20178C20178C20178"},
+	}
+	for i, test := range tests {
+		enc, err := EncodeToBytes(test.val)
+		if err != nil {
+			t.Fatalf("test %d: encode error: %v", i, err)
+		}
+		if !bytes.Equal(enc, unhex(test.output)) {
+			t.Errorf("test %d: output mismatch: got %X, want %s", i, enc, test.output)
+		}
+		dec := reflect.New(reflect.TypeOf(test.val).Elem())
+		if err := DecodeBytes(enc, dec.Interface()); err != nil {
+			t.Fatalf("test %d: decode error: %v", i, err)
+		}
+		if !reflect.DeepEqual(dec.Interface(), test.val) {
+			t.Errorf("test %d: value mismatch: got %#v, want %#v", i, dec.Interface(), test.val)
+		}
+	}
+	// The empty value of the other kind doesn't decode as nil
+	var bytesDec nilKindBytes
+	if err := DecodeBytes(unhex("C380C080"), &bytesDec); err == nil {
+		t.Errorf("expected error decoding empty list into nilString field")
+	}
+	var structDec nilKindStructs
+	if err := DecodeBytes(unhex("C3C08080"), &structDec); err == nil {
+		t.Errorf("expected error decoding empty string into nilList field")
+	}
+	if _, err := EncodeToBytes(&invalidNilString{}); err == nil {
+		t.Errorf("expected error for nilString tag on non-pointer field")
+	}
+}
+
+type sortedMaps struct {
+	Bytes  map[uint64][]byte    `rlp:"sortedmap"`
+	Hashes map[common.Hash]uint `rlp:"sortedmap"`
+}
+
+type untaggedMap struct {
+	M map[uint]uint
+}
+
+func TestSortedMapRoundTrip(t *testing.T) {
+	// Keys are sorted by their encoding, not their value: 0x7f encodes as
+	// the single byte 7F, before 0 (80) and 0x80 (8180).
+	val := sortedMaps{
+		Bytes:  map[uint64][]byte{0x80: {1}, 0x7f: {2}, 0: nil},
+		Hashes: map[common.Hash]uint{{2}: 1, {1}: 2},
+	}
+	want := "F853CAC27F02C28080C3818001F846E2A0010000000000000000000000000000000000000000000000000000000000000002E2A0020000000000000000000000000000000000000000000000000000000000000001"
+	enc, err := EncodeToBytes(&val)
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	if !bytes.Equal(enc, unhex(want)) {
+		t.Errorf("output mismatch: got %X, want %s", enc, want)
+	}
+	var dec sortedMaps
+	if err := DecodeBytes(enc, &dec); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	val.Bytes[0] = []byte{} // empty byte slices decode as non-nil
+	if !reflect.DeepEqual(dec, val) {
+		t.Errorf("value mismatch: got %#v, want %#v", dec, val)
+	}
+	// Nil maps encode as empty ones
+	enc, err = EncodeToBytes(&sortedMaps{})
+	if err != nil || !bytes.Equal(enc, unhex("C2C0C0")) {
+		t.Errorf("nil map output mismatch: got %X (error %v), want C2C0C0", enc, err)
+	}
+	// Unsorted or duplicate keys aren't canonical
+	for _, input := range []string{"C8C6C28001C27F02C0", "C8C6C27F01C27F02C0"} {
+		if err := DecodeBytes(unhex(input), &dec); err == nil {
+			t.Errorf("expected error decoding %s", input)
+		}
+	}
+	if _, err := EncodeToBytes(&untaggedMap{}); err == nil {
+		t.Errorf("expected error encoding map without sortedmap tag")
+	}
+}
+
+type sizedBytes struct {
+	Slice []byte  `rlp:"size=4"`
+	Array [4]byte `rlp:"size=4"`
+}
+
+type invalidSizeArray struct {
+	A [4]byte `rlp:"size=3"`
+}
+
+type invalidSizeType struct {
+	A []uint `rlp:"size=3"`
+}
+
+func TestSizeTag(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "CA840102030484050607 08", err: ""},
+		{input: "C9830102038405060708", err: "rlp: input string too short (want 4 bytes) for []uint8, decoding into (rlp.sizedBytes).Slice"},
+		{input: "CB85010203040584050607 08", err: "rlp: input string too long (want 4 bytes) for []uint8, decoding into (rlp.sizedBytes).Slice"},
+		{input: "C60184050607 08", err: "rlp: input string too short (want 4 bytes) for []uint8, decoding into (rlp.sizedBytes).Slice"},
+		{input: "C9840102030483050607", err: "rlp: input string too short for [4]uint8, decoding into (rlp.sizedBytes).Array"},
+		{input: "CB84010203048505060708 09", err: "rlp: input string too long for [4]uint8, decoding into (rlp.sizedBytes).Array"},
+	}
+	for i, test := range tests {
+		var dec sizedBytes
+		err := DecodeBytes(unhex(strings.Replace(test.input, " ", "", -1)), &dec)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("test %d: decode error: %v", i, err)
+			} else if want := (sizedBytes{[]byte{1, 2, 3, 4}, [4]byte{5, 6, 7, 8}}); !reflect.DeepEqual(dec, want) {
+				t.Errorf("test %d: value mismatch: got %#v, want %#v", i, dec, want)
+			}
+		} else if err == nil || err.Error() != test.err {
+			t.Errorf("test %d: error mismatch: got %v, want %q", i, err, test.err)
+		}
+	}
+	if _, err := EncodeToBytes(&invalidSizeArray{}); err == nil {
+		t.Errorf("expected error for size tag mismatching array length")
+	}
+	if _, err := EncodeToBytes(&invalidSizeType{}); err == nil {
+		t.Errorf("expected error for size tag on non-byte slice")
+	}
+}
+
+type optionalFields struct {
+	A uint
+	B uint   `rlp:"optional"`
+	C []uint `rlp:"optional"`
+}
+
+type optionalBeforeRequired struct {
+	A uint `rlp:"optional"`
+	B uint
+}
+
+type optionalTail struct {
+	A uint
+	B uint   `rlp:"optional"`
+	C []uint `rlp:"tail"`
+}
+
+func TestOptionalFieldsRoundTrip(t *testing.T) {
+	tests := []struct {
+		val    optionalFields
+		output string
+	}{
+		{val: optionalFields{A: 1, B: 2, C: []uint{3}}, output: "C40102C103"},
+		// Trailing zero-valued optional fields are omitted
+		{val: optionalFields{A: 1, B: 2}, output: "C20102"},
+		{val: optionalFields{A: 1}, output: "C101"},
+		// Zero-valued optional fields followed by a set one are kept
+		{val: optionalFields{A: 1, C: []uint{3}}, output: "C40180C103"},
+	}
+	for i, test := range tests {
+		enc, err := EncodeToBytes(&test.val)
+		if err != nil {
+			t.Fatalf("test %d: encode error: %v", i, err)
+		}
+		if !bytes.Equal(enc, unhex(test.output)) {
+			t.Errorf("test %d: output mismatch: got %X, want %s", i, enc, test.output)
+		}
+		// Decode into a non-zero value to check that missing fields are reset
+		dec := optionalFields{A: 9, B: 9, C: []uint{9}}
+		if err := DecodeBytes(enc, &dec); err != nil {
+			t.Fatalf("test %d: decode error: %v", i, err)
+		}
+		if !reflect.DeepEqual(dec, test.val) {
+			t.Errorf("test %d: value mismatch: got %#v, want %#v", i, dec, test.val)
+		}
+	}
+	// Missing required fields are still rejected
+	var dec optionalFields
+	err := DecodeBytes(unhex("C0"), &dec)
+	if want := "rlp: too few elements for rlp.optionalFields"; err == nil || err.Error() != want {
+		t.Errorf("decode error mismatch: got %v, want %q", err, want)
+	}
+	// Tail fields may follow optional ones
+	var tail optionalTail
+	if err := DecodeBytes(unhex("C401020304"), &tail); err != nil {
+		t.Fatalf("tail decode error: %v", err)
+	}
+	if want := (optionalTail{A: 1, B: 2, C: []uint{3, 4}}); !reflect.DeepEqual(tail, want) {
+		t.Errorf("tail decode mismatch: got %#v, want %#v", tail, want)
+	}
+	if _, err := EncodeToBytes(&optionalBeforeRequired{}); err == nil {
+		t.Errorf("expected error for required field following optional field")
+	}
+}
+
+type threeFields struct {
+	A uint
+	B string
+	C []uint
+}
+
+func TestDecodeIgnoreExtraFields(t *testing.T) {
+	// [1, "foo", [2], 4, [5, 6]]
+	input := unhex("CB0183666F6FC10204C20506")
+
+	var strict threeFields
+	err := DecodeBytes(input, &strict)
+	if want := "rlp: input list has too many elements for rlp.threeFields"; err == nil || err.Error() != want {
+		t.Fatalf("strict decode error mismatch: got %v, want %q", err, want)
+	}
+	var tolerant threeFields
+	s := NewStream(bytes.NewReader(input), 0)
+	s.IgnoreExtraFields = true
+	if err := s.Decode(&tolerant); err != nil {
+		t.Fatalf("tolerant decode error: %v", err)
+	}
+	if want := (threeFields{A: 1, B: "foo", C: []uint{2}}); !reflect.DeepEqual(tolerant, want) {
+		t.Errorf("tolerant decode mismatch: got %#v, want %#v", tolerant, want)
+	}
+	if _, err := s.Raw(); err != io.EOF {
+		t.Errorf("stream not drained after decoding: got %v, want %v", err, io.EOF)
+	}
+}
+
 func ExampleDecode() {
 	input, _ := hex.DecodeString("C90A1486666F6F626172")
 
@@ -817,3 +1108,59 @@ func unhex(str string) []byte {
 	}
 	return b
 }
+
+type timeStruct struct {
+	T   time.Time
+	Ptr *time.Time
+}
+
+func TestTimeRoundTrip(t *testing.T) {
+	loc := time.FixedZone("UTC+5", 5*3600)
+	tests := []struct {
+		val    time.Time
+		output string
+	}{
+		{val: time.Time{}, output: "C28080"},
+		{val: time.Unix(0, 0), output: "C7850E7791F70080"},
+		{val: time.Unix(1500000000, 123456789), output: "CB850ED0FA260084075BCD15"},
+		// The same instant in another location encodes the same
+		{val: time.Unix(1500000000, 123456789).In(loc), output: "CB850ED0FA260084075BCD15"},
+		// Monotonic clock readings are dropped
+		{val: time.Now(), output: ""},
+	}
+	for i, test := range tests {
+		enc, err := EncodeToBytes(test.val)
+		if err != nil {
+			t.Fatalf("test %d: encode error: %v", i, err)
+		}
+		if test.output != "" && !bytes.Equal(enc, unhex(test.output)) {
+			t.Errorf("test %d: output mismatch: got %X, want %s", i, enc, test.output)
+		}
+		var dec time.Time
+		if err := DecodeBytes(enc, &dec); err != nil {
+			t.Fatalf("test %d: decode error: %v", i, err)
+		}
+		if !dec.Equal(test.val) || dec.Location() != time.UTC {
+			t.Errorf("test %d: value mismatch: got %v, want %v", i, dec, test.val)
+		}
+		if want := test.val.UTC().Round(0); dec != want {
+			t.Errorf("test %d: decoded time not canonical: got %#v, want %#v", i, dec, want)
+		}
+	}
+	// Pointers encode their time, nil ones the zero time
+	now := time.Unix(1500000000, 1)
+	enc, _ := EncodeToBytes(&timeStruct{Ptr: &now})
+	var dec timeStruct
+	if err := DecodeBytes(enc, &dec); err != nil || dec.Ptr == nil || !dec.Ptr.Equal(now) {
+		t.Errorf("pointer round trip mismatch: got %v (error %v), want %v", dec.Ptr, err, now)
+	}
+	if enc, _ := EncodeToBytes(&timeStruct{}); !bytes.Equal(enc, unhex("C6C28080C28080")) {
+		t.Errorf("nil pointer output mismatch: got %X, want C6C28080C28080", enc)
+	}
+	// Missing elements and nanoseconds beyond a second are rejected
+	for _, input := range []string{"C3C180C0", "C8C680843B9ACA00C0"} {
+		if err := DecodeBytes(unhex(input), &dec); err == nil {
+			t.Errorf("expected error decoding %s", input)
+		}
+	}
+}
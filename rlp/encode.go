@@ -17,11 +17,17 @@
 package rlp
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"math/big"
 	"reflect"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto/sha3"
 )
 
 var (
@@ -66,7 +72,8 @@ type Encoder interface {
 // if the array has element type byte).
 //
 // Struct values are encoded as an RLP list of all their encoded
-// public fields. Recursive struct types are supported.
+// public fields. Recursive struct types are supported. Trailing fields
+// with the "optional" tag are omitted as long as they're zero-valued.
 //
 // To encode slices and arrays, the elements are encoded as an RLP
 // list of the value's elements. Note that arrays and slices with
@@ -77,10 +84,18 @@ type Encoder interface {
 // An unsigned integer value is encoded as an RLP string. Zero always
 // encodes as an empty RLP string. Encode also supports *big.Int.
 //
+// A time.Time is encoded as an RLP list of two integers, the seconds since
+// January 1, year 1 UTC and the nanoseconds within the second.
+//
 // An interface value encodes as the value contained in the interface.
 //
+// Maps are only supported as struct fields with the "sortedmap" tag. They
+// are encoded as an RLP list of [key, value] lists sorted by the encoding
+// of the key, so the encoding is deterministic. Key and value types must
+// themselves be encodable, and distinct keys must encode differently.
+//
 // Boolean values are not supported, nor are signed integers, floating
-// point numbers, maps, channels and functions.
+// point numbers, other maps, channels and functions.
 /*
 	rlp 编码，大部分的 EncodeRLP 方法都是直接调用该方法
  */
@@ -111,6 +126,42 @@ func EncodeToBytes(val interface{}) ([]byte, error) {
 	return eb.toBytes(), nil
 }
 
+// HashRLP returns the hash of the RLP encoding of val. If hasher is nil, the
+// encoding is hashed with Keccak256.
+//
+// The encoding is assembled in a pooled buffer instead of a freshly allocated
+// slice, so hasher must not retain the bytes passed to it.
+func HashRLP(val interface{}, hasher func([]byte) common.Hash) (common.Hash, error) {
+	if hasher == nil {
+		hasher = keccak256
+	}
+	eb := encbufPool.Get().(*encbuf)
+	defer encbufPool.Put(eb)
+	eb.reset()
+	if err := eb.encode(val); err != nil {
+		return common.Hash{}, err
+	}
+	// Without list headers the string data is the complete encoding
+	if len(eb.lheads) == 0 {
+		return hasher(eb.str), nil
+	}
+	if size := eb.size(); cap(eb.outbuf) < size {
+		eb.outbuf = make([]byte, size)
+	} else {
+		eb.outbuf = eb.outbuf[:size]
+	}
+	eb.copyTo(eb.outbuf)
+	return hasher(eb.outbuf), nil
+}
+
+// keccak256 is the default hasher of HashRLP.
+func keccak256(data []byte) (h common.Hash) {
+	hw := sha3.NewKeccak256()
+	hw.Write(data)
+	hw.Sum(h[:0])
+	return h
+}
+
 // EncodeReader returns a reader from which the RLP encoding of val
 // can be read. The returned size is the total size of the encoded
 // data.
@@ -135,6 +186,7 @@ type encbuf struct {
 	lhsize  int         // sum of sizes of all encoded list headers
 	// 辅助 buffer，专门用于处理 uint 编码
 	sizebuf []byte      // 9-byte auxiliary buffer for uint encoding
+	outbuf  []byte      // reused buffer for assembling the output in HashRLP
 }
 
 type listhead struct {
@@ -250,6 +302,12 @@ func (w *encbuf) size() int {
 // encbuf 处理逻辑，主要是将数据组装成完成的 RLP 数据
 func (w *encbuf) toBytes() []byte {
 	out := make([]byte, w.size())
+	w.copyTo(out)
+	return out
+}
+
+// copyTo assembles the full encoding into out, which must be w.size() long.
+func (w *encbuf) copyTo(out []byte) {
 	strpos := 0
 	pos := 0
 	for _, head := range w.lheads {
@@ -263,7 +321,6 @@ func (w *encbuf) toBytes() []byte {
 	}
 	// copy string data after the last list header
 	copy(out[pos:], w.str[strpos:])
-	return out
 }
 
 func (w *encbuf) toWriter(out io.Writer) (err error) {
@@ -380,12 +437,16 @@ func makeWriter(typ reflect.Type, ts tags) (writer, error) {
 		return writeBigIntPtr, nil
 	case typ.AssignableTo(bigInt):
 		return writeBigIntNoPtr, nil
+	case typ == timeType:
+		return writeTime, nil
 	case isUint(kind):
 		return writeUint, nil
 	case kind == reflect.Bool:
 		return writeBool, nil
 	case kind == reflect.String:
 		return writeString, nil
+	case kind == reflect.Slice && ts.distinguishNil:
+		return makeNilSliceWriter(typ)
 	case kind == reflect.Slice && isByte(typ.Elem()):
 		return writeBytes, nil
 	case kind == reflect.Array && isByte(typ.Elem()):
@@ -395,7 +456,9 @@ func makeWriter(typ reflect.Type, ts tags) (writer, error) {
 	case kind == reflect.Struct:
 		return makeStructWriter(typ)
 	case kind == reflect.Ptr:
-		return makePtrWriter(typ)
+		return makePtrWriter(typ, ts)
+	case kind == reflect.Map && ts.sortedMap:
+		return makeSortedMapWriter(typ)
 	default:
 		return nil, fmt.Errorf("rlp: type %v is not RLP-serializable", typ)
 	}
@@ -449,6 +512,22 @@ func writeBigIntNoPtr(val reflect.Value, w *encbuf) error {
 	return writeBigInt(&i, w)
 }
 
+// writeTime encodes a time.Time as the list of its seconds since the zero time,
+// January 1, year 1 UTC, and the nanoseconds within the second. The encoding
+// doesn't depend on the location, nor on any monotonic clock reading.
+func writeTime(val reflect.Value, w *encbuf) error {
+	t := val.Interface().(time.Time)
+	sec := t.Unix() - yearOneUnix
+	if sec < 0 {
+		return fmt.Errorf("rlp: cannot encode time before year 1")
+	}
+	lh := w.list()
+	writeUint(reflect.ValueOf(uint64(sec)), w)
+	writeUint(reflect.ValueOf(uint64(t.Nanosecond())), w)
+	w.listEnd(lh)
+	return nil
+}
+
 func writeBigInt(i *big.Int, w *encbuf) error {
 	if cmp := i.Cmp(big0); cmp == -1 {
 		return fmt.Errorf("rlp: cannot encode negative *big.Int")
@@ -547,15 +626,46 @@ func makeSliceWriter(typ reflect.Type, ts tags) (writer, error) {
 	return writer, nil
 }
 
+// makeNilSliceWriter creates a writer for slice fields with struct tag
+// "distinguishNil". Empty slices are encoded as usual, but nil slices
+// are encoded using the other empty value: an empty string for regular
+// slices and an empty list for byte slices.
+func makeNilSliceWriter(typ reflect.Type) (writer, error) {
+	inner, err := makeWriter(typ, tags{})
+	if err != nil {
+		return nil, err
+	}
+	nilval := byte(0x80)
+	if isByte(typ.Elem()) {
+		nilval = 0xC0
+	}
+	writer := func(val reflect.Value, w *encbuf) error {
+		if val.IsNil() {
+			w.str = append(w.str, nilval)
+			return nil
+		}
+		return inner(val, w)
+	}
+	return writer, nil
+}
+
 // 处理结构体的方法
 func makeStructWriter(typ reflect.Type) (writer, error) {
 	fields, err := structFields(typ)
 	if err != nil {
 		return nil, err
 	}
+	firstOptional := firstOptionalField(fields)
 	writer := func(val reflect.Value, w *encbuf) error {
+		// 省略末尾为零值的可选字段
+		last := len(fields) - 1
+		for ; last >= firstOptional; last-- {
+			if !val.Field(fields[last].index).IsZero() {
+				break
+			}
+		}
 		lh := w.list()
-		for _, f := range fields {
+		for _, f := range fields[:last+1] {
 			// f 是 field 结构， f.info 是 typeinfo 的指针，
 			// 所以这里其实是调用字段的编码器方法。
 			if err := f.info.writer(val.Field(f.index), w); err != nil {
@@ -568,7 +678,54 @@ func makeStructWriter(typ reflect.Type) (writer, error) {
 	return writer, nil
 }
 
-func makePtrWriter(typ reflect.Type) (writer, error) {
+// makeSortedMapWriter creates a writer for map fields with struct tag
+// "sortedmap", encoding the map as a list of [key, value] pairs sorted by
+// the encoding of the key. A nil map encodes like an empty one.
+func makeSortedMapWriter(typ reflect.Type) (writer, error) {
+	keyinfo, err := cachedTypeInfo1(typ.Key(), tags{})
+	if err != nil {
+		return nil, err
+	}
+	valinfo, err := cachedTypeInfo1(typ.Elem(), tags{})
+	if err != nil {
+		return nil, err
+	}
+	writer := func(val reflect.Value, w *encbuf) error {
+		// 先单独编码所有的 key，再按照编码结果排序
+		keys := val.MapKeys()
+		encs := make([][]byte, len(keys))
+		for i, key := range keys {
+			eb := encbufPool.Get().(*encbuf)
+			eb.reset()
+			err := keyinfo.writer(key, eb)
+			encs[i] = eb.toBytes()
+			encbufPool.Put(eb)
+			if err != nil {
+				return err
+			}
+		}
+		order := make([]int, len(keys))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool { return bytes.Compare(encs[order[i]], encs[order[j]]) < 0 })
+
+		lh := w.list()
+		for _, i := range order {
+			plh := w.list()
+			w.str = append(w.str, encs[i]...)
+			if err := valinfo.writer(val.MapIndex(keys[i]), w); err != nil {
+				return err
+			}
+			w.listEnd(plh)
+		}
+		w.listEnd(lh)
+		return nil
+	}
+	return writer, nil
+}
+
+func makePtrWriter(typ reflect.Type, ts tags) (writer, error) {
 	etypeinfo, err := cachedTypeInfo1(typ.Elem(), tags{})
 	if err != nil {
 		return nil, err
@@ -578,12 +735,12 @@ func makePtrWriter(typ reflect.Type) (writer, error) {
 	var nilfunc func(*encbuf) error
 	kind := typ.Elem().Kind()
 	switch {
-	case kind == reflect.Array && isByte(typ.Elem().Elem()):
+	case ts.nilString || kind == reflect.Array && isByte(typ.Elem().Elem()) && !ts.nilList:
 		nilfunc = func(w *encbuf) error {
 			w.str = append(w.str, 0x80)
 			return nil
 		}
-	case kind == reflect.Struct || kind == reflect.Array:
+	case ts.nilList || kind == reflect.Struct && typ.Elem() != timeType || kind == reflect.Array:
 		nilfunc = func(w *encbuf) error {
 			// encoding the zero value of a struct/array could trigger
 			// infinite recursion, avoid that.
@@ -25,6 +25,8 @@ import (
 	"math/big"
 	"sync"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
 )
 
 type testEncoder struct {
@@ -318,6 +320,37 @@ func TestEncodeToReaderPiecewise(t *testing.T) {
 	})
 }
 
+func TestHashRLP(t *testing.T) {
+	hashers := map[string]func([]byte) common.Hash{
+		"keccak": keccak256,
+		"prefix": common.BytesToHash,
+	}
+	for name, hasher := range hashers {
+		for i, test := range encTests {
+			enc, err := EncodeToBytes(test.val)
+			if err != nil {
+				continue
+			}
+			hash, err := HashRLP(test.val, hasher)
+			if err != nil {
+				t.Errorf("%s test %d: unexpected error: %v", name, i, err)
+				continue
+			}
+			if want := hasher(enc); hash != want {
+				t.Errorf("%s test %d: hash mismatch: have %x, want %x\nvalue %#v", name, i, hash, want, test.val)
+			}
+		}
+	}
+	// A nil hasher should fall back to Keccak256
+	hash, err := HashRLP([]uint{1, 2, 3}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := keccak256(unhex("C3010203")); hash != want {
+		t.Errorf("default hash mismatch: have %x, want %x", hash, want)
+	}
+}
+
 // This is a regression test verifying that encReader
 // returns its encbuf to the pool only once.
 func TestEncodeToReaderReturnToPool(t *testing.T) {
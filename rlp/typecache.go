@@ -18,16 +18,24 @@ package rlp
 
 import (
 	"fmt"
+	"io"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 )
 
 var (
-	// 独写锁，用来在多线程中保护typeCache
-	typeCacheMutex sync.RWMutex
+	// 互斥锁，保护类型信息的生成，查找不需要加锁
+	typeCacheMutex sync.Mutex
 	// 核心数据结构，保存的就是类型->编码/解码函数
-	typeCache      = make(map[typekey]*typeinfo)
+	typeCache sync.Map // typekey -> *typeinfo, only holding complete entries
+	// 正在生成的类型信息，由 typeCacheMutex 保护
+	typeCachePending = make(map[typekey]*typeinfo)
+	// 通过 RegisterType 注册的类型，由 typeCacheMutex 保护
+	typeRegistry = make(map[reflect.Type]*typeinfo)
+	// 生成类型信息的次数，由 typeCacheMutex 保护
+	typeInfoGenerations int
 )
 
 // 存储对应的编码器和解码器函数
@@ -40,12 +48,29 @@ type typeinfo struct {
 type tags struct {
 	// rlp:"nil" controls whether empty input results in a nil pointer.
 	nilOK bool
+	// rlp:"nilString" and rlp:"nilList" imply "nil" and also fix the
+	// empty value a nil pointer encodes as, which is then the only one
+	// decoding as nil. They can only be set for pointer fields.
+	nilString, nilList bool
 	// rlp:"tail" controls whether this field swallows additional list
 	// elements. It can only be set for the last field, which must be
 	// of slice type.
 	tail bool
 	// rlp:"-" ignores fields.
 	ignored bool
+	// rlp:"optional" allows the field to be missing from the input
+	// list. It can only be followed by optional (or "tail") fields.
+	optional bool
+	// rlp:"distinguishNil" controls whether a nil slice is encoded
+	// differently from an empty one, so it decodes back as nil.
+	// It can only be set for slice fields.
+	distinguishNil bool
+	// rlp:"sortedmap" enables the encoding of map fields as a list of
+	// [key, value] pairs sorted by the encoding of the key.
+	sortedMap bool
+	// rlp:"size=N" requires byte slice and array fields to decode from
+	// exactly N bytes. For arrays N must be the array length.
+	size int
 }
 
 // 类型
@@ -62,31 +87,101 @@ type writer func(reflect.Value, *encbuf) error
 
 // 传入类型，返回该类型的编码器或者解码器函数
 func cachedTypeInfo(typ reflect.Type, tags tags) (*typeinfo, error) {
-	// 加读锁来保护
-	typeCacheMutex.RLock()
-	// 获取函数信息
-	info := typeCache[typekey{typ, tags}]
-	typeCacheMutex.RUnlock()
-	// 如果成功获取到信息，就返回
-	if info != nil {
-		return info, nil
+	// 查找不需要加锁
+	if info, ok := typeCache.Load(typekey{typ, tags}); ok {
+		return info.(*typeinfo), nil
 	}
 	// not in the cache, need to generate info for this type.
-	// 否则加写锁 调用 cachedTypeInfo1 函数创建并返回，
+	// 否则加锁 调用 cachedTypeInfo1 函数创建并返回，
 	// 这里需要注意的是在多线程环境下有可能多个线程同时调用到这个地方，
 	// 所以当你进入 cachedTypeInfo1 方法的时候需要判断一下是否
 	// 已经被别的线程先创建成功了。
 	typeCacheMutex.Lock()
 	defer typeCacheMutex.Unlock()
-	return cachedTypeInfo1(typ, tags)
+
+	info, err := cachedTypeInfo1(typ, tags)
+	// The entries generated along with the type may refer to each other's
+	// placeholders, so they're only published once all of them are complete.
+	if err == nil {
+		for key, pending := range typeCachePending {
+			typeCache.LoadOrStore(key, pending)
+		}
+	}
+	typeCachePending = make(map[typekey]*typeinfo)
+	return info, err
+}
+
+// ClearTypeCache empties the cache of generated encoders and decoders, releasing
+// those of types no longer in use, e.g. types created at runtime through
+// reflect.StructOf. Encoders and decoders are generated again when next needed.
+//
+// Generation holds the lock throughout, so clearing never interferes with the
+// placeholder entries guarding recursive types.
+func ClearTypeCache() {
+	typeCacheMutex.Lock()
+	defer typeCacheMutex.Unlock()
+
+	typeCache.Range(func(key, _ interface{}) bool {
+		typeCache.Delete(key)
+		return true
+	})
+}
+
+// Warm generates the encoders and decoders of the types of the given values
+// ahead of their first use, returning the first generation error, e.g. for a
+// type which can't be encoded.
+func Warm(vals ...interface{}) error {
+	for _, val := range vals {
+		if val == nil {
+			return fmt.Errorf("rlp: cannot warm type of nil value")
+		}
+		if _, err := cachedTypeInfo(reflect.TypeOf(val), tags{}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// RegisterType registers a custom encoder and decoder for the given type, which
+// are used instead of the generated ones, e.g. for third-party types without
+// EncodeRLP and DecodeRLP methods. The encoder must write the complete RLP
+// encoding of the value, just like EncodeRLP.
+//
+// Types can only be registered once, and only before they are first encoded or
+// decoded, so that all values of a type are handled alike.
+func RegisterType(typ reflect.Type, enc func(w io.Writer, val reflect.Value) error, dec func(s *Stream, val reflect.Value) error) error {
+	typeCacheMutex.Lock()
+	defer typeCacheMutex.Unlock()
+
+	if _, ok := typeRegistry[typ]; ok {
+		return fmt.Errorf("rlp: type %v already registered", typ)
+	}
+	var cached bool
+	typeCache.Range(func(key, _ interface{}) bool {
+		cached = key.(typekey).Type == typ
+		return !cached
+	})
+	if cached {
+		return fmt.Errorf("rlp: type %v already in use", typ)
+	}
+	typeRegistry[typ] = &typeinfo{
+		decoder: func(s *Stream, val reflect.Value) error { return dec(s, val) },
+		writer:  func(val reflect.Value, w *encbuf) error { return enc(w, val) },
+	}
+	return nil
+}
+
+// cachedTypeInfo1 looks up or generates the info of a type, with typeCacheMutex
+// held. Generated entries are left pending for cachedTypeInfo to publish.
 func cachedTypeInfo1(typ reflect.Type, tags tags) (*typeinfo, error) {
 	key := typekey{typ, tags}
-	info := typeCache[key]
-	if info != nil {
-		// another goroutine got the write lock first
+	if info, ok := typeCache.Load(key); ok {
+		// another goroutine generated it first
 		// 其他的线程可能已经创建成功了， 那么我们直接获取到信息然后返回
+		return info.(*typeinfo), nil
+	}
+	if info := typeCachePending[key]; info != nil {
+		// being generated, or generated along with the current type
 		return info, nil
 	}
 	// put a dummmy value into the cache before generating.
@@ -95,25 +190,32 @@ func cachedTypeInfo1(typ reflect.Type, tags tags) (*typeinfo, error) {
 	// 没找到
 	// 这个地方首先创建了一个值来填充这个类型的位置，
 	// 避免遇到一些递归定义的数据类型形成死循环
-	typeCache[key] = new(typeinfo)
+	//
+	// Recursion always goes through a pointer, slice or map: types containing
+	// themselves by value are rejected by the compiler (and can't be built with
+	// reflect either), so the encoding of a value can't recurse endlessly on its
+	// type. Only cyclic pointers in the encoded value itself could.
+	typeCachePending[key] = new(typeinfo)
 	// genTypeInfo：生成对应类型的编码和解码器
 	info, err := genTypeInfo(typ, tags)
 	if err != nil {
 		// remove the dummy value if the generator fails
-		delete(typeCache, key)
+		delete(typeCachePending, key)
 		return nil, err
 	}
-	*typeCache[key] = *info
-	return typeCache[key], err
+	*typeCachePending[key] = *info
+	return typeCachePending[key], nil
 }
 
 type field struct {
-	index int
-	info  *typeinfo
+	index    int
+	info     *typeinfo
+	optional bool
 }
 
 // 结构体字段
 func structFields(typ reflect.Type) (fields []field, err error) {
+	var lastOptional string // Name of the last optional field seen
 	// 遍历结构体中所有的字段
 	for i := 0; i < typ.NumField(); i++ {
 		// 该判断的条件针对的是所有导出的字段
@@ -127,17 +229,34 @@ func structFields(typ reflect.Type) (fields []field, err error) {
 			if tags.ignored {
 				continue
 			}
+			// 可选字段之后只能是可选字段或者 tail 字段
+			if tags.optional {
+				lastOptional = f.Name
+			} else if lastOptional != "" && !tags.tail {
+				return nil, fmt.Errorf(`rlp: struct field %v.%s needs "optional" tag (follows optional field %s)`, typ, f.Name, lastOptional)
+			}
 			// 获取每一个类型的编码器或者解码器函数
 			info, err := cachedTypeInfo1(f.Type, tags)
 			if err != nil {
 				return nil, err
 			}
-			fields = append(fields, field{i, info})
+			fields = append(fields, field{i, info, tags.optional})
 		}
 	}
 	return fields, nil
 }
 
+// firstOptionalField returns the index of the first optional field, or
+// len(fields) if there is none.
+func firstOptionalField(fields []field) int {
+	for i, f := range fields {
+		if f.optional {
+			return i
+		}
+	}
+	return len(fields)
+}
+
 func parseStructTag(typ reflect.Type, fi int) (tags, error) {
 	f := typ.Field(fi)
 	var ts tags
@@ -148,6 +267,14 @@ func parseStructTag(typ reflect.Type, fi int) (tags, error) {
 			ts.ignored = true
 		case "nil":
 			ts.nilOK = true
+		case "nilString", "nilList":
+			ts.nilOK = true
+			ts.nilString, ts.nilList = t == "nilString", t == "nilList"
+			if f.Type.Kind() != reflect.Ptr {
+				return ts, fmt.Errorf(`rlp: invalid struct tag %q for %v.%s (field type is not pointer)`, t, typ, f.Name)
+			}
+		case "optional":
+			ts.optional = true
 		case "tail":
 			ts.tail = true
 			if fi != typ.NumField()-1 {
@@ -156,15 +283,52 @@ func parseStructTag(typ reflect.Type, fi int) (tags, error) {
 			if f.Type.Kind() != reflect.Slice {
 				return ts, fmt.Errorf(`rlp: invalid struct tag "tail" for %v.%s (field type is not slice)`, typ, f.Name)
 			}
+		case "sortedmap":
+			ts.sortedMap = true
+			if f.Type.Kind() != reflect.Map {
+				return ts, fmt.Errorf(`rlp: invalid struct tag "sortedmap" for %v.%s (field type is not map)`, typ, f.Name)
+			}
+		case "distinguishNil":
+			ts.distinguishNil = true
+			if f.Type.Kind() != reflect.Slice {
+				return ts, fmt.Errorf(`rlp: invalid struct tag "distinguishNil" for %v.%s (field type is not slice)`, typ, f.Name)
+			}
 		default:
-			return ts, fmt.Errorf("rlp: unknown struct tag %q on %v.%s", t, typ, f.Name)
+			if !strings.HasPrefix(t, "size=") {
+				return ts, fmt.Errorf("rlp: unknown struct tag %q on %v.%s", t, typ, f.Name)
+			}
+			size, err := strconv.Atoi(strings.TrimPrefix(t, "size="))
+			if err != nil || size <= 0 {
+				return ts, fmt.Errorf(`rlp: invalid struct tag %q for %v.%s (size is not a positive integer)`, t, typ, f.Name)
+			}
+			kind := f.Type.Kind()
+			if kind != reflect.Slice && kind != reflect.Array || f.Type.Elem().Kind() != reflect.Uint8 {
+				return ts, fmt.Errorf(`rlp: invalid struct tag %q for %v.%s (field type is not byte slice or array)`, t, typ, f.Name)
+			}
+			if kind == reflect.Array && f.Type.Len() != size {
+				return ts, fmt.Errorf(`rlp: invalid struct tag %q for %v.%s (array length is %d)`, t, typ, f.Name, f.Type.Len())
+			}
+			ts.size = size
 		}
 	}
+	if ts.size > 0 && (ts.tail || ts.distinguishNil) {
+		return ts, fmt.Errorf(`rlp: invalid struct tag "size" for %v.%s (cannot be combined with "tail" or "distinguishNil")`, typ, f.Name)
+	}
+	if ts.tail && ts.optional {
+		return ts, fmt.Errorf(`rlp: invalid struct tag "optional" for %v.%s (cannot be combined with "tail")`, typ, f.Name)
+	}
+	if ts.tail && ts.distinguishNil {
+		return ts, fmt.Errorf(`rlp: invalid struct tag "distinguishNil" for %v.%s (cannot be combined with "tail")`, typ, f.Name)
+	}
 	return ts, nil
 }
 
 // 生成对应类型的编码/解码函数
 func genTypeInfo(typ reflect.Type, tags tags) (info *typeinfo, err error) {
+	typeInfoGenerations++
+	if registered := typeRegistry[typ]; registered != nil {
+		return registered, nil
+	}
 	info = new(typeinfo)
 	if info.decoder, err = makeDecoder(typ, tags); err != nil {
 		return nil, err
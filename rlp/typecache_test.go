@@ -0,0 +1,285 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func typeCacheLen() (n int) {
+	typeCache.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+type recursiveList struct {
+	Value uint
+	Next  *recursiveList `rlp:"nil"`
+}
+
+func TestClearTypeCache(t *testing.T) {
+	// Fill the cache with many distinct runtime generated types
+	for i := 0; i < 1000; i++ {
+		typ := reflect.StructOf([]reflect.StructField{{Name: fmt.Sprintf("F%d", i), Type: reflect.TypeOf(uint(0))}})
+		val := reflect.New(typ)
+		val.Elem().Field(0).SetUint(uint64(i))
+		if _, err := EncodeToBytes(val.Interface()); err != nil {
+			t.Fatalf("type %d: encode error: %v", i, err)
+		}
+	}
+	if n := typeCacheLen(); n < 1000 {
+		t.Fatalf("cache too small after filling: %d entries", n)
+	}
+	// Clear the cache repeatedly while other goroutines keep using it
+	var (
+		pend sync.WaitGroup
+		val  = &recursiveList{Value: 1, Next: &recursiveList{Value: 2}}
+		want = unhex("C401C202C0")
+	)
+	for i := 0; i < 4; i++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+			for j := 0; j < 200; j++ {
+				enc, err := EncodeToBytes(val)
+				if err != nil || !bytes.Equal(enc, want) {
+					t.Errorf("encode mismatch: got %X (error %v), want %X", enc, err, want)
+					return
+				}
+				var dec recursiveList
+				if err := DecodeBytes(enc, &dec); err != nil || !reflect.DeepEqual(&dec, val) {
+					t.Errorf("decode mismatch: got %+v (error %v), want %+v", dec, err, val)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		ClearTypeCache()
+	}
+	pend.Wait()
+
+	ClearTypeCache()
+	if n := typeCacheLen(); n != 0 {
+		t.Errorf("cache not empty after clearing: %d entries", n)
+	}
+	// Recursive types are still generated correctly after clearing
+	if enc, err := EncodeToBytes(val); err != nil || !bytes.Equal(enc, want) {
+		t.Errorf("encode after clear mismatch: got %X (error %v), want %X", enc, err, want)
+	}
+}
+
+type recursiveTree struct {
+	Value    uint
+	Children []recursiveTree
+	Parent   *recursiveTree `rlp:"nil"`
+}
+
+// Tests that goroutines concurrently generating the same self-referential types
+// all get complete encoders and decoders.
+func TestTypeCacheConcurrentRecursive(t *testing.T) {
+	val := &recursiveTree{Value: 1, Children: []recursiveTree{{Value: 2}, {Value: 3, Parent: &recursiveTree{Value: 4}}}}
+	want := unhex("CE01CBC302C0C0C603C0C304C0C0C0")
+
+	for round := 0; round < 20; round++ {
+		ClearTypeCache()
+
+		var (
+			start = make(chan struct{})
+			pend  sync.WaitGroup
+		)
+		for i := 0; i < 8; i++ {
+			pend.Add(1)
+			go func() {
+				defer pend.Done()
+				<-start
+				enc, err := EncodeToBytes(val)
+				if err != nil || !bytes.Equal(enc, want) {
+					t.Errorf("encode mismatch: got %X (error %v), want %X", enc, err, want)
+					return
+				}
+				var dec recursiveTree
+				if err := DecodeBytes(enc, &dec); err != nil {
+					t.Errorf("decode error: %v", err)
+				} else if enc2, _ := EncodeToBytes(&dec); !bytes.Equal(enc2, want) {
+					t.Errorf("round trip mismatch: got %X, want %X", enc2, want)
+				}
+			}()
+		}
+		close(start)
+		pend.Wait()
+	}
+}
+
+func BenchmarkTypeCacheParallel(b *testing.B) {
+	types := []reflect.Type{
+		reflect.TypeOf(uint(0)),
+		reflect.TypeOf(""),
+		reflect.TypeOf([]byte{}),
+		reflect.TypeOf(recursiveList{}),
+		reflect.TypeOf(recursiveTree{}),
+		reflect.TypeOf(simplestruct{}),
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := cachedTypeInfo(types[i%len(types)], tags{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type durationStruct struct {
+	Name    string
+	Timeout time.Duration
+	Retry   *time.Duration `rlp:"nil"`
+}
+
+func TestRegisterType(t *testing.T) {
+	typ := reflect.TypeOf(time.Duration(0))
+	enc := func(w io.Writer, val reflect.Value) error {
+		if val.Int() < 0 {
+			return fmt.Errorf("negative duration %v", val.Interface())
+		}
+		return Encode(w, uint64(val.Int()))
+	}
+	dec := func(s *Stream, val reflect.Value) error {
+		n, err := s.Uint()
+		if err == nil {
+			val.SetInt(int64(n))
+		}
+		return err
+	}
+	if _, err := EncodeToBytes(time.Duration(1)); err == nil {
+		t.Fatalf("expected error encoding unregistered type")
+	}
+	if err := RegisterType(typ, enc, dec); err != nil {
+		t.Fatalf("failed to register type: %v", err)
+	}
+	if err := RegisterType(typ, enc, dec); err == nil {
+		t.Errorf("expected error registering type twice")
+	}
+	retry := 5 * time.Second
+	val := &durationStruct{Name: "x", Timeout: 1000, Retry: &retry}
+	out, err := EncodeToBytes(val)
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	if want := unhex("CA788203E885012A05F200"); !bytes.Equal(out, want) {
+		t.Errorf("output mismatch: got %X, want %X", out, want)
+	}
+	var decoded durationStruct
+	if err := DecodeBytes(out, &decoded); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, val) {
+		t.Errorf("value mismatch: got %+v, want %+v", decoded, val)
+	}
+	if _, err := EncodeToBytes(time.Duration(-1)); err == nil {
+		t.Errorf("expected error from registered encoder")
+	}
+	// Types already in use can't be registered
+	if _, err := EncodeToBytes(simplestruct{}); err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	if err := RegisterType(reflect.TypeOf(simplestruct{}), enc, dec); err == nil {
+		t.Errorf("expected error registering type in use")
+	}
+}
+
+type warmStruct struct {
+	A uint
+	B []string
+	C *simplestruct
+}
+
+type unencodableStruct struct {
+	A int
+}
+
+func TestWarm(t *testing.T) {
+	ClearTypeCache()
+	if err := Warm(&warmStruct{}, uint(0)); err != nil {
+		t.Fatalf("failed to warm types: %v", err)
+	}
+	typeCacheMutex.Lock()
+	generations := typeInfoGenerations
+	typeCacheMutex.Unlock()
+
+	// Lookups of the warmed types and of the types they contain hit the cache
+	warmed, _ := cachedTypeInfo(reflect.TypeOf(&warmStruct{}), tags{})
+	for _, val := range []interface{}{&warmStruct{}, warmStruct{}, []string{}, &simplestruct{}, uint(0)} {
+		if _, err := cachedTypeInfo(reflect.TypeOf(val), tags{}); err != nil {
+			t.Fatalf("lookup of %T failed: %v", val, err)
+		}
+	}
+	if again, _ := cachedTypeInfo(reflect.TypeOf(&warmStruct{}), tags{}); again != warmed {
+		t.Errorf("cached type info changed")
+	}
+	typeCacheMutex.Lock()
+	defer typeCacheMutex.Unlock()
+	if typeInfoGenerations != generations {
+		t.Errorf("type info generated after warming: %d times", typeInfoGenerations-generations)
+	}
+}
+
+func TestWarmError(t *testing.T) {
+	err := Warm(uint(0), &unencodableStruct{}, &warmStruct{})
+	if want := "rlp: type int is not RLP-serializable"; err == nil || err.Error() != want {
+		t.Errorf("error mismatch: got %v, want %q", err, want)
+	}
+	if err := Warm(nil); err == nil {
+		t.Errorf("expected error warming nil")
+	}
+}
+
+type recursiveMap struct {
+	Value    uint
+	Children map[uint]recursiveMap `rlp:"sortedmap"`
+}
+
+// Tests that types referring to themselves through pointers, slices and maps
+// round-trip. Types containing themselves by value don't compile.
+func TestRecursiveTypes(t *testing.T) {
+	tests := []interface{}{
+		&recursiveList{Value: 1, Next: &recursiveList{Value: 2, Next: &recursiveList{Value: 3}}},
+		&recursiveTree{Value: 1, Children: []recursiveTree{{Value: 2, Children: []recursiveTree{{Value: 3}}}}},
+		&recursiveMap{Value: 1, Children: map[uint]recursiveMap{2: {Value: 2, Children: map[uint]recursiveMap{3: {Value: 3}}}}},
+	}
+	for i, val := range tests {
+		ClearTypeCache()
+		enc, err := EncodeToBytes(val)
+		if err != nil {
+			t.Fatalf("test %d: encode error: %v", i, err)
+		}
+		dec := reflect.New(reflect.TypeOf(val).Elem())
+		if err := DecodeBytes(enc, dec.Interface()); err != nil {
+			t.Fatalf("test %d: decode error: %v", i, err)
+		}
+		if reenc, _ := EncodeToBytes(dec.Interface()); !bytes.Equal(reenc, enc) {
+			t.Errorf("test %d: round trip mismatch: got %X, want %X", i, reenc, enc)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import (
+	"errors"
+	"reflect"
+)
+
+// MaxEnvelopeType is the highest type byte allowed for a typed envelope. Type
+// bytes from 0xc0 on would be indistinguishable from the start of an RLP list.
+const MaxEnvelopeType = 0x7f
+
+var (
+	// ErrEmptyEnvelope is returned by DecodeTyped for empty input.
+	ErrEmptyEnvelope = errors.New("rlp: empty typed envelope")
+
+	// ErrInvalidEnvelopeType is returned for type bytes above MaxEnvelopeType.
+	ErrInvalidEnvelopeType = errors.New("rlp: invalid typed envelope type")
+)
+
+// EncodeTyped returns the typed envelope of payload, that is the type byte
+// followed by the RLP encoding of the payload (txType || rlp(payload)), as
+// used by EIP-2718 typed transactions.
+func EncodeTyped(txType byte, payload interface{}) ([]byte, error) {
+	if txType > MaxEnvelopeType {
+		return nil, ErrInvalidEnvelopeType
+	}
+	eb := encbufPool.Get().(*encbuf)
+	defer encbufPool.Put(eb)
+	eb.reset()
+	if err := eb.encode(payload); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+eb.size())
+	out[0] = txType
+	eb.copyTo(out[1:])
+	return out, nil
+}
+
+// DecodeTyped splits a typed envelope into its type byte and payload. The
+// payload is decoded into a newly allocated value of the same type as the
+// prototype. If the prototype is a pointer, a pointer to the new value of the
+// element type is returned, otherwise the new value itself.
+func DecodeTyped(data []byte, payloadPrototype interface{}) (byte, interface{}, error) {
+	if len(data) == 0 {
+		return 0, nil, ErrEmptyEnvelope
+	}
+	if data[0] > MaxEnvelopeType {
+		return 0, nil, ErrInvalidEnvelopeType
+	}
+	if payloadPrototype == nil {
+		return 0, nil, errDecodeIntoNil
+	}
+	typ := reflect.TypeOf(payloadPrototype)
+	isPtr := typ.Kind() == reflect.Ptr
+	if isPtr {
+		typ = typ.Elem()
+	}
+	payload := reflect.New(typ)
+	if err := DecodeBytes(data[1:], payload.Interface()); err != nil {
+		return 0, nil, err
+	}
+	if isPtr {
+		return data[0], payload.Interface(), nil
+	}
+	return data[0], payload.Elem().Interface(), nil
+}
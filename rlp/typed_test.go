@@ -0,0 +1,65 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type typedPayload struct {
+	Nonce uint
+	Data  []byte
+}
+
+func TestTypedEnvelopeRoundTrip(t *testing.T) {
+	payload := typedPayload{Nonce: 5, Data: []byte{0xde, 0xad}}
+
+	enc, err := EncodeTyped(0x02, payload)
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	if want := unhex("02C40582DEAD"); !bytes.Equal(enc, want) {
+		t.Fatalf("envelope mismatch: got %X, want %X", enc, want)
+	}
+	// Decode with a pointer prototype
+	typ, dec, err := DecodeTyped(enc, new(typedPayload))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if typ != 0x02 {
+		t.Errorf("type mismatch: got %#x, want 0x02", typ)
+	}
+	if !reflect.DeepEqual(dec, &payload) {
+		t.Errorf("payload mismatch: got %#v, want %#v", dec, &payload)
+	}
+	// Decode with a value prototype
+	if _, dec, err = DecodeTyped(enc, typedPayload{}); err != nil || !reflect.DeepEqual(dec, payload) {
+		t.Errorf("value payload mismatch: got %#v (%v), want %#v", dec, err, payload)
+	}
+	// Check the invalid envelopes
+	if _, err := EncodeTyped(0xc0, payload); err != ErrInvalidEnvelopeType {
+		t.Errorf("encode type error mismatch: got %v, want %v", err, ErrInvalidEnvelopeType)
+	}
+	if _, _, err := DecodeTyped(nil, new(typedPayload)); err != ErrEmptyEnvelope {
+		t.Errorf("empty decode error mismatch: got %v, want %v", err, ErrEmptyEnvelope)
+	}
+	if _, _, err := DecodeTyped(enc[1:], new(typedPayload)); err != ErrInvalidEnvelopeType {
+		t.Errorf("untyped decode error mismatch: got %v, want %v", err, ErrInvalidEnvelopeType)
+	}
+}